@@ -2,19 +2,32 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
 	"syscall"
 	"time"
 
+	"github.com/Gaoey/scale-websocket/internal/history"
+	"github.com/Gaoey/scale-websocket/internal/repository/broker"
+	"github.com/Gaoey/scale-websocket/internal/repository/memory"
+	"github.com/Gaoey/scale-websocket/internal/repository/nats"
 	"github.com/Gaoey/scale-websocket/internal/repository/rabbitmq"
+	"github.com/Gaoey/scale-websocket/internal/repository/redis"
+	"github.com/Gaoey/scale-websocket/internal/schema"
 	"github.com/Gaoey/scale-websocket/internal/stores"
+	"github.com/Gaoey/scale-websocket/services/admin"
 	"github.com/Gaoey/scale-websocket/services/example"
 	"github.com/Gaoey/scale-websocket/services/routes"
 	"github.com/Gaoey/scale-websocket/services/store"
 	"github.com/Gaoey/scale-websocket/services/ws"
+	"github.com/google/uuid"
 	"github.com/joho/godotenv"
 	"github.com/labstack/echo/v4"
 )
@@ -25,42 +38,97 @@ func main() {
 		log.Fatal("Error loading .env file")
 	}
 
+	// Each node needs a unique name so it gets its own copy of every broadcast
+	serverName := os.Getenv("SERVER_NAME")
+	if serverName == "" {
+		serverName = generateNodeID()
+		log.Printf("SERVER_NAME is not set, using generated node ID %s", serverName)
+	}
+
 	// dependency injection
-	stores := stores.NewConnectionStorage()
-	fmt.Printf("config rabbit: %v\n", os.Getenv("RABBITMQ_URL"))
+	registryKV, err := newRegistryKV(os.Getenv("REGISTRY_REDIS_URL"))
+	if err != nil {
+		log.Fatalf("Failed to initialize connection registry: %v", err)
+	}
+	registry, err := stores.NewRegistry(registryKV, serverName, 0)
+	if err != nil {
+		log.Fatalf("Failed to initialize connection registry: %v", err)
+	}
+	stores := stores.NewDistributedStore(stores.NewConnectionStorage(), registry)
 
-	serverName := os.Getenv("SERVER_NAME")
+	reaper, pingInterval, err := newReaper(stores)
+	if err != nil {
+		log.Fatalf("Failed to configure connection reaper: %v", err)
+	}
+	reaper.Start()
 
-	rabbitmqClient, err := rabbitmq.NewClient(rabbitmq.Config{
-		URL:          os.Getenv("RABBITMQ_URL"),
-		ExchangeName: "ws_events",
-		ExchangeType: "topic",
-	})
+	brokerClient, err := newBroker(os.Getenv("BROKER_BACKEND"))
 	if err != nil {
-		log.Fatalf("Failed to initialize RabbitMQ client: %v", err)
+		log.Fatalf("Failed to initialize broker: %v", err)
+	}
+	orderUpdateRoutingKeys := []string{"ws.order.update.*"}
+
+	// A channel with a <channel>.json file in SCHEMA_DIR validates its messages
+	schemas := schema.NewRegistry()
+	if dir := os.Getenv("SCHEMA_DIR"); dir != "" {
+		path := filepath.Join(dir, ws.OrderUpdateChannel+".json")
+		err := schemas.RegisterFile(ws.OrderUpdateChannel, orderUpdateRoutingKeys, path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Fatalf("Failed to load schemas: %v", err)
+		}
 	}
+
 	e := echo.New()
 
-	storeHandler := store.NewStoreHandler(stores)
-	exampleHandler := example.NewExampleHandler(rabbitmqClient)
+	storeHandler := store.NewStoreHandler(stores, registry)
+	storeHandler.Reaper = reaper
+	exampleHandler := example.NewExampleHandler(brokerClient, schemas)
 	wsHandler := ws.NewWebSocketHandler(stores)
+	wsHandler.SetPingInterval(pingInterval)
+	deadLetters, _ := brokerClient.(broker.DeadLetterQueue)
+	adminHandler := admin.NewAdminHandler(deadLetters)
 
-	routes.SetupRoutes(e, wsHandler, exampleHandler, storeHandler)
+	routes.SetupRoutes(e, wsHandler, exampleHandler, storeHandler, adminHandler)
 
 	// Consumer
 	queueName := fmt.Sprintf("ws.order.update.%s", serverName)
 	wsOrderUpdateChannel := ws.NewWSChannel(
-		rabbitmqClient,
+		brokerClient,
 		ws.OrderUpdateChannel,
 		queueName,
-		[]string{"ws.order.update.*"},
+		orderUpdateRoutingKeys,
 		stores,
+		broker.WithRetry(3, 5*time.Second),
+		broker.WithPrefetch(64),
+		broker.WithWorkers(8),
+		broker.WithOrderingKey(broker.FieldKey("order_id")),
+		broker.WithRawPayload(),
+		broker.WithDedup(10000, 10*time.Minute),
+		// Per-node fan-out queue, removed by the broker once the node is gone
+		broker.WithQueueExpires(5*time.Minute),
 	)
 
+	wsOrderUpdateChannel.Schemas = schemas
+
+	// HISTORY_SIZE keeps that many recent messages for clients that subscribe late
+	if size, _ := strconv.Atoi(os.Getenv("HISTORY_SIZE")); size > 0 {
+		wsOrderUpdateChannel.History = history.NewRing(size)
+	}
+	wsHandler.RegisterChannel(wsOrderUpdateChannel)
+
 	if err := wsOrderUpdateChannel.StartConsumer(); err != nil {
 		log.Fatalf("Failed to start order_update consumer: %v", err)
 	}
 
+	// Answer presence questions from backend services over broker RPC
+	var presenceServer broker.Consumer
+	if rpc, ok := brokerClient.(broker.RPC); ok {
+		presenceServer, err = rpc.Serve(ws.PresenceRoutingKey, ws.PresenceHandler(registry))
+		if err != nil {
+			log.Fatalf("Failed to serve presence requests: %v", err)
+		}
+	}
+
 	go func() {
 		if err := e.Start(":8080"); err != nil {
 			log.Fatalf("Failed to start server: %v", err)
@@ -82,12 +150,120 @@ func main() {
 		log.Fatal("Server forced to shutdown:", err)
 	}
 
-	// When shutting down, stop the channel properly
+	// When shutting down, drain the channel consumers before closing the broker
 	log.Println("Stopping WebSocket channels...")
-	wsOrderUpdateChannel.Stop()
-	// Close RabbitMQ connections
-	log.Println("Closing RabbitMQ connections...")
-	rabbitmqClient.Close()
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer drainCancel()
+	if err := wsOrderUpdateChannel.Stop(drainCtx); err != nil {
+		log.Printf("WebSocket channel did not stop cleanly: %v", err)
+	}
+	if presenceServer != nil {
+		if err := presenceServer.Shutdown(drainCtx); err != nil {
+			log.Printf("Presence server did not stop cleanly: %v", err)
+		}
+	}
+	reaper.Stop()
+	// Apply the registry updates still queued, then remove this node's
+	// connections from the registry
+	stores.Close()
+	if err := registry.Close(); err != nil {
+		log.Printf("Failed to leave connection registry: %v", err)
+	}
+	if closer, ok := registryKV.(io.Closer); ok {
+		closer.Close()
+	}
+	// Close broker connections
+	log.Println("Closing broker connections...")
+	brokerClient.Close()
 
 	log.Println("Server exited properly")
 }
+
+// newBroker creates the message backend selected by BROKER_BACKEND,
+// defaulting to RabbitMQ
+func newBroker(backend string) (broker.Broker, error) {
+	switch backend {
+	case "", "rabbitmq":
+		fmt.Printf("config rabbit: %v\n", os.Getenv("RABBITMQ_URL"))
+		return rabbitmq.NewClient(rabbitmq.Config{
+			URL:          os.Getenv("RABBITMQ_URL"),
+			ExchangeName: "ws_events",
+			ExchangeType: "topic",
+		})
+	case "memory":
+		return memory.NewClient(memory.Config{
+			ExchangeName: "ws_events",
+		})
+	case "redis":
+		return redis.NewClient(redis.Config{
+			URL:          os.Getenv("REDIS_URL"),
+			ExchangeName: "ws_events",
+		})
+	case "nats":
+		return nats.NewClient(nats.Config{
+			URL:          os.Getenv("NATS_URL"),
+			ExchangeName: "ws_events",
+		})
+	default:
+		return nil, fmt.Errorf("unknown broker backend: %s", backend)
+	}
+}
+
+// newRegistryKV returns the store shared by the connection registries of
+// all nodes, Redis at url or, without one, memory that only this node sees
+func newRegistryKV(url string) (stores.KV, error) {
+	if url == "" {
+		return stores.NewMemoryKV(), nil
+	}
+	return stores.NewRedisKV(url, "ws_registry:")
+}
+
+// newReaper enforces CONN_IDLE_TIMEOUT (default 10m) and CONN_MAX_LIFETIME
+// (default 24h) on the connections of store. A limit of 0 is not enforced.
+// It also returns CONN_PING_INTERVAL (default 30s): pongs keep clients that
+// only listen active, so with an idle timeout the interval must be at most
+// half of it.
+func newReaper(store stores.ConnectionStore) (*stores.Reaper, time.Duration, error) {
+	idle, err := durationEnv("CONN_IDLE_TIMEOUT", 10*time.Minute)
+	if err != nil {
+		return nil, 0, err
+	}
+	lifetime, err := durationEnv("CONN_MAX_LIFETIME", 24*time.Hour)
+	if err != nil {
+		return nil, 0, err
+	}
+	ping, err := durationEnv("CONN_PING_INTERVAL", ws.DefaultPingInterval)
+	if err != nil {
+		return nil, 0, err
+	}
+	if idle > 0 && (ping <= 0 || ping > idle/2) {
+		return nil, 0, fmt.Errorf("CONN_PING_INTERVAL %v must be at most half of CONN_IDLE_TIMEOUT %v", ping, idle)
+	}
+
+	return stores.NewReaper(store, stores.ReaperConfig{
+		IdleTimeout: idle,
+		MaxLifetime: lifetime,
+	}), ping, nil
+}
+
+// durationEnv parses a duration such as "90s" from an environment variable
+func durationEnv(key string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return d, nil
+}
+
+// generateNodeID returns a node name that is unique across restarts
+func generateNodeID() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "node"
+	}
+	return fmt.Sprintf("%s-%s", hostname, uuid.New().String()[:8])
+}
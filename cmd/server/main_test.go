@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Gaoey/scale-websocket/internal/stores"
+)
+
+func TestGenerateNodeID(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "node"
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id := generateNodeID()
+		suffix, ok := strings.CutPrefix(id, hostname+"-")
+		if !ok || len(suffix) != 8 {
+			t.Fatalf("node ID %q is not the hostname and a short random suffix", id)
+		}
+		if seen[id] {
+			t.Fatalf("node ID %q generated twice", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestPingIntervalBelowIdleTimeout(t *testing.T) {
+	tests := []struct {
+		idle, ping string
+		want       time.Duration
+		ok         bool
+	}{
+		{"", "", 30 * time.Second, true},
+		{"1m", "30s", 30 * time.Second, true},
+		{"1m", "31s", 0, false},
+		{"1m", "0", 0, false},
+		// Nothing is reaped for being idle, pings are optional
+		{"0", "0", 0, true},
+		{"0", "1h", time.Hour, true},
+	}
+	for _, tt := range tests {
+		t.Setenv("CONN_IDLE_TIMEOUT", tt.idle)
+		t.Setenv("CONN_PING_INTERVAL", tt.ping)
+		_, ping, err := newReaper(stores.NewConnectionStorage())
+		if (err == nil) != tt.ok || ping != tt.want {
+			t.Errorf("idle timeout %q, ping interval %q: got %v, %v", tt.idle, tt.ping, ping, err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// Package history keeps the recent messages of a channel so clients that
+// subscribe late can be sent what they missed before the live messages.
+package history
+
+import (
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// Entry is one message as it was sent to the subscribers of a channel
+type Entry struct {
+	// Offset numbers the messages of a log from 1, without gaps
+	Offset uint64
+	Binary bool
+	Data   []byte
+}
+
+// Log is the history of one channel
+type Log interface {
+	// Append stores the entry built by encode under the next offset. encode
+	// receives that offset so it can embed it in the data, and appends are
+	// serialized so offsets follow the order entries were stored in.
+	Append(encode func(offset uint64) (Entry, error)) (Entry, error)
+	// Last returns up to the n newest entries, oldest first
+	Last(n int) []Entry
+	// Since returns the entries after offset, oldest first. complete is false
+	// when some of them are no longer kept, in which case every entry kept
+	// is returned.
+	Since(offset uint64) (entries []Entry, complete bool)
+	// Epoch identifies this log. Offsets of another epoch, such as those a
+	// client received from another node or before a restart, mean nothing
+	// here.
+	Epoch() string
+}
+
+var _ Log = (*Ring)(nil)
+
+// Ring is a Log holding a fixed number of entries in memory. It only sees
+// the messages consumed by this node and starts empty on every restart.
+type Ring struct {
+	mu      sync.RWMutex
+	entries []Entry
+	// head is the index of the oldest entry, count how many entries are kept
+	head  int
+	count int
+	next  uint64
+	epoch string
+}
+
+// NewRing creates a ring keeping the last capacity entries
+func NewRing(capacity int) *Ring {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &Ring{
+		entries: make([]Entry, capacity),
+		next:    1,
+		epoch:   uuid.New().String(),
+	}
+}
+
+func (r *Ring) Append(encode func(offset uint64) (Entry, error)) (Entry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, err := encode(r.next)
+	if err != nil {
+		return Entry{}, err
+	}
+	e.Offset = r.next
+	r.next++
+
+	if r.count < len(r.entries) {
+		r.entries[(r.head+r.count)%len(r.entries)] = e
+		r.count++
+	} else {
+		// Full, overwrite the oldest entry
+		r.entries[r.head] = e
+		r.head = (r.head + 1) % len(r.entries)
+	}
+	return e, nil
+}
+
+func (r *Ring) Last(n int) []Entry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if n > r.count {
+		n = r.count
+	}
+	return r.slice(r.count-n, r.count)
+}
+
+func (r *Ring) Since(offset uint64) ([]Entry, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	oldest := r.next - uint64(r.count)
+	if offset+1 < oldest || offset >= r.next {
+		return r.slice(0, r.count), false
+	}
+	return r.slice(int(offset+1-oldest), r.count), true
+}
+
+func (r *Ring) Epoch() string {
+	return r.epoch
+}
+
+// slice copies the entries from the from-th to the to-th oldest
+func (r *Ring) slice(from, to int) []Entry {
+	out := make([]Entry, 0, to-from)
+	for i := from; i < to; i++ {
+		out = append(out, r.entries[(r.head+i)%len(r.entries)])
+	}
+	return out
+}
@@ -0,0 +1,107 @@
+package history
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func appendN(t *testing.T, r *Ring, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		_, err := r.Append(func(offset uint64) (Entry, error) {
+			return Entry{Data: []byte(fmt.Sprint(offset))}, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func offsets(entries []Entry) []uint64 {
+	out := make([]uint64, len(entries))
+	for i, e := range entries {
+		out[i] = e.Offset
+	}
+	return out
+}
+
+func equal(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRing(t *testing.T) {
+	r := NewRing(3)
+	if got := r.Last(5); len(got) != 0 {
+		t.Fatalf("empty ring returned %v", offsets(got))
+	}
+	if got, complete := r.Since(0); len(got) != 0 || !complete {
+		t.Fatalf("Since(0) on an empty ring = %v, %v", offsets(got), complete)
+	}
+
+	appendN(t, r, 2)
+	if got := r.Last(5); !equal(offsets(got), []uint64{1, 2}) {
+		t.Fatalf("Last(5) = %v", offsets(got))
+	}
+
+	// Full, the oldest entries make room
+	appendN(t, r, 3)
+	tests := []struct {
+		since    uint64
+		want     []uint64
+		complete bool
+	}{
+		{0, []uint64{3, 4, 5}, false},
+		{1, []uint64{3, 4, 5}, false},
+		{2, []uint64{3, 4, 5}, true},
+		{4, []uint64{5}, true},
+		{5, nil, true},
+		// An offset this log never handed out
+		{6, []uint64{3, 4, 5}, false},
+	}
+	for _, tt := range tests {
+		got, complete := r.Since(tt.since)
+		if !equal(offsets(got), tt.want) || complete != tt.complete {
+			t.Errorf("Since(%d) = %v, %v, want %v, %v", tt.since, offsets(got), complete, tt.want, tt.complete)
+		}
+	}
+
+	got := r.Last(2)
+	if !equal(offsets(got), []uint64{4, 5}) {
+		t.Fatalf("Last(2) = %v", offsets(got))
+	}
+	// encode was given the offset the entry was stored under
+	if string(got[1].Data) != "5" {
+		t.Fatalf("entry 5 holds %q", got[1].Data)
+	}
+}
+
+func TestRingAppendError(t *testing.T) {
+	r := NewRing(3)
+	appendN(t, r, 1)
+
+	fail := errors.New("cannot encode")
+	if _, err := r.Append(func(uint64) (Entry, error) { return Entry{}, fail }); !errors.Is(err, fail) {
+		t.Fatalf("Append: %v", err)
+	}
+
+	// A failed append takes no offset
+	appendN(t, r, 1)
+	if got := r.Last(3); !equal(offsets(got), []uint64{1, 2}) {
+		t.Fatalf("Last(3) = %v", offsets(got))
+	}
+}
+
+func TestRingEpochs(t *testing.T) {
+	if NewRing(1).Epoch() == NewRing(1).Epoch() {
+		t.Fatal("two rings share an epoch")
+	}
+}
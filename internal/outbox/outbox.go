@@ -0,0 +1,185 @@
+// Package outbox implements the transactional outbox pattern. Services write
+// the messages they want to publish to an outbox table in the same database
+// transaction as the change they describe, and a Relay publishes the rows
+// afterwards. A crash between the two leaves the rows behind to be published
+// on the next poll instead of losing them.
+//
+// Rows are published at least once: a relay that stops after publishing a
+// row but before marking it sent leaves the row to be published again once
+// its claim runs out. Each row keeps its message ID across attempts, so
+// consumers started with broker.WithDedup drop the copies.
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Gaoey/scale-websocket/internal/repository/broker"
+)
+
+// DefaultTable is the outbox table used when none is configured
+const DefaultTable = "outbox"
+
+// Dialect holds what differs between the databases the outbox runs on
+type Dialect struct {
+	Name string
+	// Schema creates the outbox table, with %s standing for its name
+	Schema string
+	// Placeholder returns the bind parameter for the n-th argument, from 1
+	Placeholder func(n int) string
+	// Lock is appended to the query selecting pending rows so relays running
+	// side by side skip the rows another one is claiming. Empty for
+	// databases that lock whole tables on write, such as SQLite.
+	Lock string
+}
+
+func questionMark(int) string { return "?" }
+
+func dollar(n int) string { return "$" + strconv.Itoa(n) }
+
+// Built-in dialects
+var (
+	SQLite = Dialect{
+		Name: "sqlite",
+		Schema: `CREATE TABLE IF NOT EXISTS %s (
+	id             INTEGER PRIMARY KEY AUTOINCREMENT,
+	message_id     TEXT NOT NULL UNIQUE,
+	routing_key    TEXT NOT NULL,
+	payload        TEXT NOT NULL,
+	correlation_id TEXT NOT NULL DEFAULT '',
+	headers        TEXT,
+	created_at     TIMESTAMP NOT NULL,
+	sent_at        TIMESTAMP,
+	claimed_until  TIMESTAMP,
+	attempts       INTEGER NOT NULL DEFAULT 0,
+	last_error     TEXT NOT NULL DEFAULT ''
+)`,
+		Placeholder: questionMark,
+	}
+
+	Postgres = Dialect{
+		Name: "postgres",
+		Schema: `CREATE TABLE IF NOT EXISTS %s (
+	id             BIGSERIAL PRIMARY KEY,
+	message_id     TEXT NOT NULL UNIQUE,
+	routing_key    TEXT NOT NULL,
+	payload        JSONB NOT NULL,
+	correlation_id TEXT NOT NULL DEFAULT '',
+	headers        JSONB,
+	created_at     TIMESTAMPTZ NOT NULL,
+	sent_at        TIMESTAMPTZ,
+	claimed_until  TIMESTAMPTZ,
+	attempts       INTEGER NOT NULL DEFAULT 0,
+	last_error     TEXT NOT NULL DEFAULT ''
+)`,
+		Placeholder: dollar,
+		Lock:        "FOR UPDATE SKIP LOCKED",
+	}
+
+	MySQL = Dialect{
+		Name: "mysql",
+		Schema: `CREATE TABLE IF NOT EXISTS %s (
+	id             BIGINT AUTO_INCREMENT PRIMARY KEY,
+	message_id     VARCHAR(255) NOT NULL UNIQUE,
+	routing_key    VARCHAR(255) NOT NULL,
+	payload        JSON NOT NULL,
+	correlation_id VARCHAR(255) NOT NULL DEFAULT '',
+	headers        JSON,
+	created_at     DATETIME(6) NOT NULL,
+	sent_at        DATETIME(6),
+	claimed_until  DATETIME(6),
+	attempts       INT NOT NULL DEFAULT 0,
+	last_error     TEXT NOT NULL
+)`,
+		Placeholder: questionMark,
+		Lock:        "FOR UPDATE SKIP LOCKED",
+	}
+)
+
+// CreateTable creates the outbox table if it does not exist yet
+func CreateTable(ctx context.Context, db *sql.DB, dialect Dialect, table string) error {
+	if table == "" {
+		table = DefaultTable
+	}
+	if _, err := db.ExecContext(ctx, fmt.Sprintf(dialect.Schema, table)); err != nil {
+		return fmt.Errorf("failed to create outbox table %s: %w", table, err)
+	}
+	return nil
+}
+
+// Message is a message waiting in the outbox
+type Message struct {
+	// MessageID identifies the message to consumers, generated when empty
+	MessageID     string
+	RoutingKey    string
+	Payload       interface{}
+	CorrelationID string
+	Headers       map[string]interface{}
+}
+
+// Execer is satisfied by *sql.Tx and *sql.DB
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// Writer adds messages to an outbox table
+type Writer struct {
+	Dialect Dialect
+	Table   string
+}
+
+// Enqueue adds msg to the outbox. Pass the transaction that makes the change
+// the message announces, so both are committed or rolled back together. It
+// returns the message ID.
+func (w Writer) Enqueue(ctx context.Context, tx Execer, msg Message) (string, error) {
+	if msg.MessageID == "" {
+		msg.MessageID = broker.NewMessageID()
+	}
+
+	payload, err := json.Marshal(msg.Payload)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	var headers interface{}
+	if len(msg.Headers) > 0 {
+		encoded, err := json.Marshal(msg.Headers)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal headers: %w", err)
+		}
+		headers = string(encoded)
+	}
+
+	query := fmt.Sprintf(
+		"INSERT INTO %s (message_id, routing_key, payload, correlation_id, headers, created_at, attempts, last_error) VALUES (%s, 0, '')",
+		w.table(), placeholders(w.Dialect, 1, 6),
+	)
+	_, err = tx.ExecContext(ctx, query,
+		msg.MessageID, msg.RoutingKey, string(payload), msg.CorrelationID, headers, time.Now().UTC(),
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to write outbox message: %w", err)
+	}
+	return msg.MessageID, nil
+}
+
+func (w Writer) table() string {
+	if w.Table == "" {
+		return DefaultTable
+	}
+	return w.Table
+}
+
+// placeholders lists count bind parameters starting with the from-th
+func placeholders(dialect Dialect, from, count int) string {
+	params := make([]string, count)
+	for i := range params {
+		params[i] = dialect.Placeholder(from + i)
+	}
+	return strings.Join(params, ", ")
+}
@@ -0,0 +1,314 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Gaoey/scale-websocket/internal/repository/broker"
+)
+
+const (
+	defaultBatchSize    = 100
+	defaultPollInterval = time.Second
+	defaultClaimTimeout = time.Minute
+	// markTimeout bounds the transaction recording what was published
+	markTimeout = 5 * time.Second
+)
+
+// Config holds the configuration for a Relay
+type Config struct {
+	DB      *sql.DB
+	Broker  broker.Broker
+	Dialect Dialect
+	Table   string
+	// BatchSize is how many rows are published per poll, defaults to 100
+	BatchSize int
+	// PollInterval is how long the relay waits after a poll that left no
+	// rows behind, defaults to 1s
+	PollInterval time.Duration
+	// Mandatory fails rows no queue is bound to instead of marking them sent
+	Mandatory bool
+	// MaxAttempts leaves rows that failed this many times for an operator to
+	// look at. Zero retries them forever.
+	MaxAttempts int
+	// ClaimTimeout is how long a relay has to publish the rows it claimed
+	// before other relays take them over, defaults to 1m
+	ClaimTimeout time.Duration
+}
+
+// Relay publishes the rows of an outbox table and marks them sent
+type Relay struct {
+	db           *sql.DB
+	broker       broker.Broker
+	dialect      Dialect
+	table        string
+	batchSize    int
+	pollInterval time.Duration
+	mandatory    bool
+	maxAttempts  int
+	claimTimeout time.Duration
+}
+
+// NewRelay creates a relay, applying the defaults of cfg
+func NewRelay(cfg Config) (*Relay, error) {
+	if cfg.DB == nil || cfg.Broker == nil {
+		return nil, fmt.Errorf("database and broker required")
+	}
+
+	if cfg.Dialect.Placeholder == nil {
+		return nil, fmt.Errorf("dialect required")
+	}
+
+	if cfg.Table == "" {
+		cfg.Table = DefaultTable
+	}
+
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultBatchSize
+	}
+
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = defaultPollInterval
+	}
+
+	if cfg.ClaimTimeout <= 0 {
+		cfg.ClaimTimeout = defaultClaimTimeout
+	}
+
+	return &Relay{
+		db:           cfg.DB,
+		broker:       cfg.Broker,
+		dialect:      cfg.Dialect,
+		table:        cfg.Table,
+		batchSize:    cfg.BatchSize,
+		pollInterval: cfg.PollInterval,
+		mandatory:    cfg.Mandatory,
+		maxAttempts:  cfg.MaxAttempts,
+		claimTimeout: cfg.ClaimTimeout,
+	}, nil
+}
+
+// Run polls the outbox until ctx is cancelled. A poll that fills a whole
+// batch is followed by the next one right away so a backlog drains quickly.
+func (r *Relay) Run(ctx context.Context) error {
+	log.Printf("Starting outbox relay for table %s", r.table)
+
+	for {
+		sent, err := r.RelayOnce(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Outbox relay poll failed: %v", err)
+		}
+
+		wait := r.pollInterval
+		if err == nil && sent == r.batchSize {
+			wait = 0
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Printf("Outbox relay for table %s stopped", r.table)
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// row is a pending outbox row
+type row struct {
+	id            int64
+	messageID     string
+	routingKey    string
+	payload       []byte
+	correlationID string
+	headers       sql.NullString
+}
+
+// RelayOnce publishes one batch of pending rows, oldest first, and returns
+// how many of them were published. The rows are claimed in a short
+// transaction, published with no transaction open, so writers of the outbox
+// are not held up by the broker, and marked in a second one. A row that
+// fails is retried on a later poll, possibly after newer rows were published.
+func (r *Relay) RelayOnce(ctx context.Context) (int, error) {
+	rows, err := r.claim(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if len(rows) == 0 {
+		return 0, nil
+	}
+
+	// Rows that cannot be turned into a message fail without being published
+	errs := make([]error, len(rows))
+	var (
+		msgs  []broker.BatchMessage
+		index []int
+	)
+	for i, rw := range rows {
+		msg, err := r.toBatchMessage(rw)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		msgs = append(msgs, msg)
+		index = append(index, i)
+	}
+
+	if len(msgs) > 0 {
+		for i, err := range broker.PublishBatch(ctx, r.broker, msgs) {
+			errs[index[i]] = err
+		}
+	}
+
+	// Recorded even when ctx ends during the publish, rows published but left
+	// claimed would be published again once their claim runs out
+	markCtx, cancel := context.WithTimeout(context.Background(), markTimeout)
+	defer cancel()
+	sent, err := r.mark(markCtx, rows, errs)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Printf("Relayed %d/%d outbox messages", sent, len(rows))
+	return sent, nil
+}
+
+// claim selects the next batch of pending rows and claims them for
+// claimTimeout, during which other relays leave them alone. Rows whose claim
+// ran out, because their relay stopped before marking them, are pending again.
+func (r *Relay) claim(ctx context.Context) ([]row, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	rows, err := r.pending(ctx, tx, now)
+	if err != nil || len(rows) == 0 {
+		return nil, err
+	}
+
+	args := []interface{}{now.Add(r.claimTimeout)}
+	for _, rw := range rows {
+		args = append(args, rw.id)
+	}
+	query := fmt.Sprintf("UPDATE %s SET claimed_until = %s WHERE id IN (%s)",
+		r.table, r.dialect.Placeholder(1), placeholders(r.dialect, 2, len(rows)),
+	)
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return nil, fmt.Errorf("failed to claim outbox messages: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to claim outbox messages: %w", err)
+	}
+	return rows, nil
+}
+
+// mark records the outcome of publishing rows and releases their claim. It
+// returns how many of them were sent.
+func (r *Relay) mark(ctx context.Context, rows []row, errs []error) (int, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	sent := 0
+	now := time.Now().UTC()
+	for i, rw := range rows {
+		if errs[i] == nil {
+			err = r.exec(ctx, tx, "UPDATE %s SET sent_at = %s, claimed_until = NULL WHERE id = %s", now, rw.id)
+			sent++
+		} else {
+			log.Printf("Failed to relay outbox message %s: %v", rw.messageID, errs[i])
+			err = r.exec(ctx, tx, "UPDATE %s SET attempts = attempts + 1, last_error = %s, claimed_until = NULL WHERE id = %s", errs[i].Error(), rw.id)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to mark outbox messages: %w", err)
+	}
+	return sent, nil
+}
+
+// pending selects the next batch of rows to publish that no relay has
+// claimed at now
+func (r *Relay) pending(ctx context.Context, tx *sql.Tx, now time.Time) ([]row, error) {
+	query := fmt.Sprintf(
+		"SELECT id, message_id, routing_key, payload, correlation_id, headers FROM %s WHERE sent_at IS NULL AND (claimed_until IS NULL OR claimed_until < %s)",
+		r.table, r.dialect.Placeholder(1),
+	)
+	args := []interface{}{now}
+	if r.maxAttempts > 0 {
+		query += " AND attempts < " + r.dialect.Placeholder(2)
+		args = append(args, r.maxAttempts)
+	}
+	query += fmt.Sprintf(" ORDER BY id LIMIT %d", r.batchSize)
+	if r.dialect.Lock != "" {
+		query += " " + r.dialect.Lock
+	}
+
+	result, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read outbox: %w", err)
+	}
+	defer result.Close()
+
+	var rows []row
+	for result.Next() {
+		var rw row
+		err := result.Scan(&rw.id, &rw.messageID, &rw.routingKey, &rw.payload, &rw.correlationID, &rw.headers)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read outbox row: %w", err)
+		}
+		rows = append(rows, rw)
+	}
+	if err := result.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read outbox: %w", err)
+	}
+	return rows, nil
+}
+
+// toBatchMessage publishes the stored payload as is, keeping the row's
+// message ID so consumers recognise a row published twice
+func (r *Relay) toBatchMessage(rw row) (broker.BatchMessage, error) {
+	opts := []broker.PublishOption{
+		broker.WithMessageID(rw.messageID),
+		broker.WithCorrelationID(rw.correlationID),
+		broker.WithContentType(broker.ContentTypeJSON),
+	}
+	if rw.headers.Valid && rw.headers.String != "" {
+		var headers map[string]interface{}
+		if err := json.Unmarshal([]byte(rw.headers.String), &headers); err != nil {
+			return broker.BatchMessage{}, fmt.Errorf("invalid headers in outbox message %s: %w", rw.messageID, err)
+		}
+		opts = append(opts, broker.WithHeaders(headers))
+	}
+	if r.mandatory {
+		opts = append(opts, broker.WithMandatory())
+	}
+
+	return broker.BatchMessage{
+		RoutingKey: rw.routingKey,
+		Message:    json.RawMessage(rw.payload),
+		Options:    opts,
+	}, nil
+}
+
+// exec runs a statement whose two placeholders are marked by the last %s
+// verbs after the table name
+func (r *Relay) exec(ctx context.Context, tx *sql.Tx, format string, value interface{}, id int64) error {
+	query := fmt.Sprintf(format, r.table, r.dialect.Placeholder(1), r.dialect.Placeholder(2))
+	if _, err := tx.ExecContext(ctx, query, value, id); err != nil {
+		return fmt.Errorf("failed to update outbox message: %w", err)
+	}
+	return nil
+}
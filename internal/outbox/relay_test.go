@@ -0,0 +1,328 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Gaoey/scale-websocket/internal/repository/broker"
+	"github.com/Gaoey/scale-websocket/internal/repository/memory"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func openDB(t *testing.T, params string) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "outbox.db")+params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err := CreateTable(context.Background(), db, SQLite, ""); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func newBroker(t *testing.T) *memory.Client {
+	t.Helper()
+
+	b, err := memory.NewClient(memory.Config{ExchangeName: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+func enqueue(t *testing.T, db *sql.DB, msgs ...Message) []string {
+	t.Helper()
+
+	ctx := context.Background()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	var ids []string
+	for _, msg := range msgs {
+		id, err := Writer{Dialect: SQLite}.Enqueue(ctx, tx, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+// collector records the deliveries of a consumer
+type collector struct {
+	mu         sync.Mutex
+	deliveries []broker.Delivery
+}
+
+func (c *collector) handle(d broker.Delivery) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deliveries = append(c.deliveries, d)
+	return nil
+}
+
+// wait returns the deliveries once there are n of them
+func (c *collector) wait(t *testing.T, n int) []broker.Delivery {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		c.mu.Lock()
+		got := append([]broker.Delivery(nil), c.deliveries...)
+		c.mu.Unlock()
+		if len(got) >= n {
+			return got
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("received %d of %d messages", len(got), n)
+		}
+	}
+}
+
+func consume(t *testing.T, b broker.Broker, queue string, opts ...broker.ConsumerOption) *collector {
+	t.Helper()
+
+	c := &collector{}
+	cons, err := b.StartConsumer(context.Background(), queue, []string{"orders.*"}, c.handle, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cons.Shutdown(context.Background()) })
+	return c
+}
+
+// outboxRow is the state of a row after relaying
+type outboxRow struct {
+	sent      bool
+	claimed   bool
+	attempts  int
+	lastError string
+}
+
+func readRow(t *testing.T, db *sql.DB, messageID string) outboxRow {
+	t.Helper()
+
+	var (
+		r                 outboxRow
+		sentAt, claimedAt sql.NullTime
+	)
+	err := db.QueryRow(
+		"SELECT sent_at, claimed_until, attempts, last_error FROM outbox WHERE message_id = ?", messageID,
+	).Scan(&sentAt, &claimedAt, &r.attempts, &r.lastError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.sent, r.claimed = sentAt.Valid, claimedAt.Valid
+	return r
+}
+
+func TestRelayMarksRowsSent(t *testing.T) {
+	db := openDB(t, "")
+	b := newBroker(t)
+	got := consume(t, b, "q")
+
+	ids := enqueue(t, db,
+		Message{RoutingKey: "orders.new", Payload: map[string]int{"id": 1}},
+		Message{RoutingKey: "orders.new", Payload: map[string]int{"id": 2}, CorrelationID: "c2"},
+		Message{RoutingKey: "orders.new", Payload: map[string]int{"id": 3}, Headers: map[string]interface{}{"tenant": "t3"}},
+	)
+
+	relay, err := NewRelay(Config{DB: db, Broker: b, Dialect: SQLite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if sent, err := relay.RelayOnce(ctx); err != nil || sent != 3 {
+		t.Fatalf("relayed %d: %v", sent, err)
+	}
+
+	deliveries := got.wait(t, 3)
+	for i, d := range deliveries {
+		if d.MessageID != ids[i] {
+			t.Errorf("delivery %d has message ID %s, want %s", i, d.MessageID, ids[i])
+		}
+	}
+	if deliveries[1].CorrelationID != "c2" || deliveries[2].Headers["tenant"] != "t3" {
+		t.Errorf("metadata was not relayed: %+v, %+v", deliveries[1].Metadata, deliveries[2].Metadata)
+	}
+
+	for _, id := range ids {
+		if r := readRow(t, db, id); !r.sent || r.claimed {
+			t.Errorf("row %s: %+v", id, r)
+		}
+	}
+	if sent, err := relay.RelayOnce(ctx); err != nil || sent != 0 {
+		t.Fatalf("relayed %d sent rows again: %v", sent, err)
+	}
+}
+
+func TestRelayLeavesFailedRowsPending(t *testing.T) {
+	db := openDB(t, "")
+	b := newBroker(t)
+
+	ids := enqueue(t, db, Message{RoutingKey: "orders.new", Payload: 1})
+
+	// Nothing is bound to the routing key yet
+	relay, err := NewRelay(Config{DB: db, Broker: b, Dialect: SQLite, Mandatory: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if sent, err := relay.RelayOnce(ctx); err != nil || sent != 0 {
+		t.Fatalf("relayed %d: %v", sent, err)
+	}
+	r := readRow(t, db, ids[0])
+	if r.sent || r.claimed || r.attempts != 1 || r.lastError == "" {
+		t.Fatalf("failed row: %+v", r)
+	}
+
+	got := consume(t, b, "q")
+	if sent, err := relay.RelayOnce(ctx); err != nil || sent != 1 {
+		t.Fatalf("relayed %d: %v", sent, err)
+	}
+	if d := got.wait(t, 1)[0]; d.MessageID != ids[0] {
+		t.Fatalf("relayed message ID %s, want %s", d.MessageID, ids[0])
+	}
+	if r := readRow(t, db, ids[0]); !r.sent || r.attempts != 1 {
+		t.Fatalf("retried row: %+v", r)
+	}
+}
+
+func TestRelayRepublishesUnmarkedRowsWithTheirMessageID(t *testing.T) {
+	db := openDB(t, "")
+	b := newBroker(t)
+	all := consume(t, b, "all")
+	deduped := consume(t, b, "deduped", broker.WithDedup(100, time.Minute))
+
+	ids := enqueue(t, db, Message{RoutingKey: "orders.new", Payload: 1})
+
+	cfg := Config{DB: db, Broker: b, Dialect: SQLite, ClaimTimeout: 100 * time.Millisecond}
+	crashed, err := NewRelay(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay, err := NewRelay(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// A relay claims and publishes the row, then stops before marking it
+	rows, err := crashed.claim(ctx)
+	if err != nil || len(rows) != 1 {
+		t.Fatalf("claimed %d rows: %v", len(rows), err)
+	}
+	msg, err := crashed.toBatchMessage(rows[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish(ctx, msg.RoutingKey, msg.Message, msg.Options...); err != nil {
+		t.Fatal(err)
+	}
+
+	// The claim keeps other relays off the row until it runs out
+	if sent, err := relay.RelayOnce(ctx); err != nil || sent != 0 {
+		t.Fatalf("relayed %d claimed rows: %v", sent, err)
+	}
+	time.Sleep(cfg.ClaimTimeout)
+	if sent, err := relay.RelayOnce(ctx); err != nil || sent != 1 {
+		t.Fatalf("relayed %d: %v", sent, err)
+	}
+
+	for _, d := range all.wait(t, 2) {
+		if d.MessageID != ids[0] {
+			t.Fatalf("published with message ID %s, want %s", d.MessageID, ids[0])
+		}
+	}
+	deduped.wait(t, 1)
+	time.Sleep(50 * time.Millisecond)
+	if n := len(deduped.wait(t, 1)); n != 1 {
+		t.Fatalf("deduplicating consumer handled %d copies", n)
+	}
+}
+
+// blockingBroker holds publishes until released
+type blockingBroker struct {
+	broker.Broker
+	publishing chan struct{}
+	release    chan struct{}
+}
+
+func (b *blockingBroker) Publish(ctx context.Context, routingKey string, msg broker.Message, opts ...broker.PublishOption) error {
+	close(b.publishing)
+	<-b.release
+	return b.Broker.Publish(ctx, routingKey, msg, opts...)
+}
+
+func TestRelayPublishesWithoutHoldingTheDatabase(t *testing.T) {
+	// Writers give up at once instead of waiting for the lock
+	db := openDB(t, "?_busy_timeout=0")
+	b := &blockingBroker{
+		Broker:     newBroker(t),
+		publishing: make(chan struct{}),
+		release:    make(chan struct{}),
+	}
+	enqueue(t, db, Message{RoutingKey: "orders.new", Payload: 1})
+
+	relay, err := NewRelay(Config{DB: db, Broker: b, Dialect: SQLite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := relay.RelayOnce(context.Background())
+		done <- err
+	}()
+
+	<-b.publishing
+	enqueue(t, db, Message{RoutingKey: "orders.new", Payload: 2})
+	close(b.release)
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// cancellingBroker cancels the relay's context once a message is published,
+// as a shutdown in the middle of a poll does
+type cancellingBroker struct {
+	broker.Broker
+	cancel context.CancelFunc
+}
+
+func (b *cancellingBroker) Publish(ctx context.Context, routingKey string, msg broker.Message, opts ...broker.PublishOption) error {
+	defer b.cancel()
+	return b.Broker.Publish(ctx, routingKey, msg, opts...)
+}
+
+func TestRelayMarksPublishedRowsOnShutdown(t *testing.T) {
+	db := openDB(t, "")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := &cancellingBroker{Broker: newBroker(t), cancel: cancel}
+	ids := enqueue(t, db, Message{RoutingKey: "orders.new", Payload: 1})
+
+	relay, err := NewRelay(Config{DB: db, Broker: b, Dialect: SQLite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent, err := relay.RelayOnce(ctx); err != nil || sent != 1 {
+		t.Fatalf("relayed %d: %v", sent, err)
+	}
+	if r := readRow(t, db, ids[0]); !r.sent || r.claimed {
+		t.Fatalf("row published before shutdown: %+v", r)
+	}
+}
@@ -0,0 +1,32 @@
+package broker
+
+import "context"
+
+// BatchMessage is one message of a batch publish
+type BatchMessage struct {
+	RoutingKey string
+	Message    Message
+	Options    []PublishOption
+}
+
+// BatchPublisher is implemented by brokers that can publish many messages
+// in one round trip
+type BatchPublisher interface {
+	// PublishBatch publishes every message and returns one error per message,
+	// nil for those the broker has taken
+	PublishBatch(ctx context.Context, msgs []BatchMessage) []error
+}
+
+// PublishBatch publishes msgs with b's PublishBatch when it has one, and
+// one by one otherwise
+func PublishBatch(ctx context.Context, b Broker, msgs []BatchMessage) []error {
+	if bp, ok := b.(BatchPublisher); ok {
+		return bp.PublishBatch(ctx, msgs)
+	}
+
+	errs := make([]error, len(msgs))
+	for i, m := range msgs {
+		errs[i] = b.Publish(ctx, m.RoutingKey, m.Message, m.Options...)
+	}
+	return errs
+}
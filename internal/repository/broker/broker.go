@@ -0,0 +1,32 @@
+package broker
+
+import (
+	"context"
+)
+
+// Message represents the structure of messages passed through a broker
+type Message interface{}
+
+// ConsumeFunc is a callback function type for consuming messages
+type ConsumeFunc func(Delivery) error
+
+// Broker is the set of operations a message backend must provide so that
+// WebSocket channels and publishers do not depend on a concrete transport
+type Broker interface {
+	// Publish publishes a message to a specified routing key
+	Publish(ctx context.Context, routingKey string, msg Message, opts ...PublishOption) error
+	// StartConsumer starts consuming messages from a queue bound with the given routing keys
+	StartConsumer(ctx context.Context, queueName string, routingKeys []string, handler ConsumeFunc, opts ...ConsumerOption) (Consumer, error)
+	// Close releases every resource held by the backend
+	Close() error
+}
+
+// Consumer is a running consumer started by StartConsumer
+type Consumer interface {
+	// Shutdown stops new deliveries, waits for the handlers in flight to
+	// finish and acknowledge their deliveries, and returns once the consumer
+	// has fully stopped or ctx expires
+	Shutdown(ctx context.Context) error
+	// Done is closed once the consumer has fully stopped
+	Done() <-chan struct{}
+}
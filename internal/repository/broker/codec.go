@@ -0,0 +1,171 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"sync"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// Content types of the built-in codecs
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeMsgPack  = "application/msgpack"
+	ContentTypeProtobuf = "application/protobuf"
+)
+
+// Codec encodes and decodes message payloads of one content type
+type Codec interface {
+	ContentType() string
+	Marshal(msg Message) ([]byte, error)
+	// Unmarshal decodes a payload. meta carries the content type parameters
+	// and message type name some encodings need to pick a concrete type.
+	Unmarshal(data []byte, meta Metadata) (Message, error)
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{}
+)
+
+func init() {
+	RegisterCodec(jsonCodec{})
+	RegisterCodec(msgpackCodec{})
+	RegisterCodec(protobufCodec{})
+}
+
+// RegisterCodec makes a codec available for its content type, replacing any
+// codec registered before for the same type
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[c.ContentType()] = c
+}
+
+// CodecFor returns the codec of a content type, ignoring its parameters. An
+// empty content type is treated as JSON.
+func CodecFor(contentType string) (Codec, error) {
+	mediaType := ContentTypeJSON
+	if contentType != "" {
+		parsed, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return nil, fmt.Errorf("invalid content type %q: %w", contentType, err)
+		}
+		mediaType = parsed
+	}
+
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	c, ok := codecs[mediaType]
+	if !ok {
+		return nil, fmt.Errorf("no codec registered for content type %s", mediaType)
+	}
+	return c, nil
+}
+
+// IsJSON reports whether a content type is JSON, an empty one included
+func IsJSON(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == ContentTypeJSON
+}
+
+// ToJSON converts a decoded message into JSON for clients that cannot read
+// its native encoding
+func ToJSON(msg Message) (json.RawMessage, error) {
+	switch m := msg.(type) {
+	case json.RawMessage:
+		return m, nil
+	case proto.Message:
+		return protojson.Marshal(m)
+	default:
+		return json.Marshal(m)
+	}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return ContentTypeJSON
+}
+
+func (jsonCodec) Marshal(msg Message) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (jsonCodec) Unmarshal(data []byte, _ Metadata) (Message, error) {
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string {
+	return ContentTypeMsgPack
+}
+
+func (msgpackCodec) Marshal(msg Message) ([]byte, error) {
+	return msgpack.Marshal(msg)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, _ Metadata) (Message, error) {
+	// Maps with string keys decode into map[string]interface{}, so the
+	// result can be re-encoded as JSON
+	var msg Message
+	if err := msgpack.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// protobufCodec encodes proto.Message values. Decoding looks the message
+// type up in the global registry by the metadata Type, or by the "proto"
+// parameter of the content type, e.g. application/protobuf; proto=orders.OrderUpdate
+type protobufCodec struct{}
+
+func (protobufCodec) ContentType() string {
+	return ContentTypeProtobuf
+}
+
+func (protobufCodec) Marshal(msg Message) ([]byte, error) {
+	m, ok := msg.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("protobuf codec cannot encode %T", msg)
+	}
+	return proto.Marshal(m)
+}
+
+func (protobufCodec) Unmarshal(data []byte, meta Metadata) (Message, error) {
+	name := meta.Type
+	if name == "" {
+		if _, params, err := mime.ParseMediaType(meta.ContentType); err == nil {
+			name = params["proto"]
+		}
+	}
+	if name == "" {
+		return nil, fmt.Errorf("protobuf payload has no message type")
+	}
+
+	mt, err := protoregistry.GlobalTypes.FindMessageByName(protoreflect.FullName(name))
+	if err != nil {
+		return nil, fmt.Errorf("unknown protobuf message type %s: %w", name, err)
+	}
+
+	m := mt.New().Interface()
+	if err := proto.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,26 @@
+package broker
+
+import (
+	"context"
+	"time"
+)
+
+// DeadLetter is a delivery that exhausted its attempts or could not be decoded
+type DeadLetter struct {
+	MessageID  string    `json:"message_id,omitempty"`
+	RoutingKey string    `json:"routing_key"`
+	Body       string    `json:"body"`
+	Attempts   int       `json:"attempts"`
+	Reason     string    `json:"reason"`
+	FailedAt   time.Time `json:"failed_at"`
+}
+
+// DeadLetterQueue is implemented by backends that keep dead-lettered
+// deliveries per consumer queue
+type DeadLetterQueue interface {
+	// DeadLetters returns up to limit dead letters of a queue without removing them
+	DeadLetters(ctx context.Context, queueName string, limit int) ([]DeadLetter, error)
+	// ReplayDeadLetters moves up to limit dead letters back onto the queue they
+	// failed on and returns how many were replayed
+	ReplayDeadLetters(ctx context.Context, queueName string, limit int) (int, error)
+}
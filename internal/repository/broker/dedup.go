@@ -0,0 +1,125 @@
+package broker
+
+import (
+	"container/list"
+	"log"
+	"sync"
+	"time"
+)
+
+// DedupWindow remembers the IDs of recently handled messages so redeliveries
+// and publisher retries are not handled twice. It keeps at most size IDs and
+// forgets each one after ttl.
+type DedupWindow struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	order   *list.List // of dedupEntry, oldest first
+	seen    map[string]*list.Element
+	pending map[string]chan struct{} // closed once the handler returns
+}
+
+type dedupEntry struct {
+	id     string
+	expiry time.Time
+}
+
+// NewDedupWindow creates a window holding up to size message IDs for ttl
+func NewDedupWindow(size int, ttl time.Duration) *DedupWindow {
+	return &DedupWindow{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		seen:    make(map[string]*list.Element),
+		pending: make(map[string]chan struct{}),
+	}
+}
+
+// Wrap skips deliveries whose message ID was already handled successfully.
+// A duplicate arriving while the first delivery is still being handled waits
+// for it: it is skipped if the handler succeeded and handled again if it
+// failed, so an ID is never acked before one of its deliveries succeeded.
+// Deliveries without an ID always pass through.
+func (w *DedupWindow) Wrap(handler ConsumeFunc) ConsumeFunc {
+	return func(d Delivery) error {
+		if d.MessageID == "" {
+			return handler(d)
+		}
+
+		if !w.reserve(d.MessageID) {
+			log.Printf("Skipping duplicate message %s", d.MessageID)
+			return nil
+		}
+
+		if err := handler(d); err != nil {
+			w.release(d.MessageID)
+			return err
+		}
+
+		w.commit(d.MessageID)
+		return nil
+	}
+}
+
+// reserve marks id as in flight, it returns false when id was already handled.
+// It blocks while another delivery of id is in flight.
+func (w *DedupWindow) reserve(id string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for {
+		w.evict(time.Now())
+
+		if _, ok := w.seen[id]; ok {
+			return false
+		}
+		done, ok := w.pending[id]
+		if !ok {
+			break
+		}
+		w.mu.Unlock()
+		<-done
+		w.mu.Lock()
+	}
+	w.pending[id] = make(chan struct{})
+	return true
+}
+
+// release forgets an in-flight id whose handler failed so a retry can run
+func (w *DedupWindow) release(id string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.finish(id)
+}
+
+// commit records id as handled
+func (w *DedupWindow) commit(id string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.finish(id)
+	w.seen[id] = w.order.PushBack(dedupEntry{id: id, expiry: time.Now().Add(w.ttl)})
+	w.evict(time.Now())
+}
+
+// finish wakes the duplicates waiting on an in-flight id. w.mu must be held.
+func (w *DedupWindow) finish(id string) {
+	if done, ok := w.pending[id]; ok {
+		close(done)
+		delete(w.pending, id)
+	}
+}
+
+// evict drops expired IDs and the oldest IDs beyond size. w.mu must be held.
+func (w *DedupWindow) evict(now time.Time) {
+	for front := w.order.Front(); front != nil; front = w.order.Front() {
+		entry := front.Value.(dedupEntry)
+		if w.order.Len() <= w.size && now.Before(entry.expiry) {
+			return
+		}
+		w.order.Remove(front)
+		delete(w.seen, entry.id)
+	}
+}
@@ -0,0 +1,139 @@
+package broker
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDedupWindowSkipsHandledIDs(t *testing.T) {
+	var calls int32
+	handler := NewDedupWindow(10, time.Minute).Wrap(func(d Delivery) error {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	})
+
+	d := Delivery{Metadata: Metadata{MessageID: "m1"}}
+	for i := 0; i < 3; i++ {
+		if err := handler(d); err != nil {
+			t.Fatalf("handler: %v", err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("handled %d times, want 1", calls)
+	}
+
+	// Messages without an ID cannot be deduplicated
+	for i := 0; i < 2; i++ {
+		handler(Delivery{})
+	}
+	if calls != 3 {
+		t.Fatalf("handled %d times, want 3", calls)
+	}
+}
+
+func TestDedupWindowRetriesFailedIDs(t *testing.T) {
+	fail := errors.New("boom")
+	var calls int32
+	handler := NewDedupWindow(10, time.Minute).Wrap(func(d Delivery) error {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return fail
+		}
+		return nil
+	})
+
+	d := Delivery{Metadata: Metadata{MessageID: "m1"}}
+	if err := handler(d); !errors.Is(err, fail) {
+		t.Fatalf("first delivery: got %v, want %v", err, fail)
+	}
+	if err := handler(d); err != nil {
+		t.Fatalf("redelivery: %v", err)
+	}
+	if err := handler(d); err != nil {
+		t.Fatalf("duplicate: %v", err)
+	}
+	if calls != 2 {
+		t.Fatalf("handled %d times, want 2", calls)
+	}
+}
+
+func TestDedupWindowInFlightDuplicate(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		firstErr  error
+		wantCalls int32
+	}{
+		{name: "first succeeds", firstErr: nil, wantCalls: 1},
+		{name: "first fails", firstErr: errors.New("boom"), wantCalls: 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			started := make(chan struct{})
+			release := make(chan struct{})
+			var calls int32
+			handler := NewDedupWindow(10, time.Minute).Wrap(func(d Delivery) error {
+				if atomic.AddInt32(&calls, 1) == 1 {
+					close(started)
+					<-release
+					return tc.firstErr
+				}
+				return nil
+			})
+
+			d := Delivery{Metadata: Metadata{MessageID: "m1"}}
+			first := make(chan error, 1)
+			go func() { first <- handler(d) }()
+			<-started
+
+			second := make(chan error, 1)
+			go func() { second <- handler(d) }()
+
+			// The duplicate must not be acked while the first is in flight
+			select {
+			case err := <-second:
+				t.Fatalf("duplicate returned %v while the first delivery was in flight", err)
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			close(release)
+			if err := <-first; err != tc.firstErr {
+				t.Fatalf("first delivery: got %v, want %v", err, tc.firstErr)
+			}
+			if err := <-second; err != nil {
+				t.Fatalf("duplicate: %v", err)
+			}
+			if calls != tc.wantCalls {
+				t.Fatalf("handled %d times, want %d", calls, tc.wantCalls)
+			}
+		})
+	}
+}
+
+func TestDedupWindowEviction(t *testing.T) {
+	var calls int32
+	w := NewDedupWindow(2, time.Minute)
+	handler := w.Wrap(func(d Delivery) error {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	})
+
+	for _, id := range []string{"a", "b", "c", "a"} {
+		handler(Delivery{Metadata: Metadata{MessageID: id}})
+	}
+	// "a" was pushed out by "c" and is handled again
+	if calls != 4 {
+		t.Fatalf("handled %d times, want 4", calls)
+	}
+
+	expired := NewDedupWindow(10, time.Millisecond)
+	handler = expired.Wrap(func(d Delivery) error {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	})
+	handler(Delivery{Metadata: Metadata{MessageID: "x"}})
+	time.Sleep(5 * time.Millisecond)
+	handler(Delivery{Metadata: Metadata{MessageID: "x"}})
+	if calls != 6 {
+		t.Fatalf("handled %d times, want 6", calls)
+	}
+}
@@ -0,0 +1,77 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/proto"
+)
+
+// Metadata carries the message properties that travel alongside the payload
+type Metadata struct {
+	MessageID     string `json:"message_id,omitempty"`
+	CorrelationID string `json:"correlation_id,omitempty"`
+	ReplyTo       string `json:"reply_to,omitempty"`
+	ContentType   string `json:"content_type,omitempty"`
+	// Type names the payload type for encodings that need it, such as the
+	// full name of a protobuf message
+	Type      string                 `json:"type,omitempty"`
+	Headers   map[string]interface{} `json:"headers,omitempty"`
+	Timestamp time.Time              `json:"timestamp"`
+	// RoutingKey is the key the message was originally published with, it is
+	// only set on deliveries
+	RoutingKey string `json:"routing_key,omitempty"`
+}
+
+// Delivery is a consumed message together with its metadata
+type Delivery struct {
+	Metadata
+	// Message is the decoded payload, or the untouched body as a
+	// json.RawMessage when the consumer runs in raw mode
+	Message Message
+	// Body is the payload exactly as it was received
+	Body []byte
+}
+
+// NewMessageID returns a unique message ID for publishes that do not set one
+func NewMessageID() string {
+	return uuid.New().String()
+}
+
+// Decode turns a received body into the Message handed to a ConsumeFunc
+// using the codec registered for its content type. In raw mode JSON bodies
+// are only validated and passed through as json.RawMessage, which avoids a
+// decode/re-encode round trip and keeps large numbers intact.
+func Decode(body []byte, meta Metadata, raw bool) (Message, error) {
+	if raw && IsJSON(meta.ContentType) {
+		if !json.Valid(body) {
+			return nil, fmt.Errorf("invalid JSON payload")
+		}
+		return json.RawMessage(body), nil
+	}
+
+	codec, err := CodecFor(meta.ContentType)
+	if err != nil {
+		return nil, err
+	}
+	return codec.Unmarshal(body, meta)
+}
+
+// Encode marshals msg with the codec of meta.ContentType, defaulting to JSON,
+// and fills in the content type and protobuf message type on meta
+func Encode(msg Message, meta *Metadata) ([]byte, error) {
+	if meta.ContentType == "" {
+		meta.ContentType = ContentTypeJSON
+	}
+	if m, ok := msg.(proto.Message); ok && meta.Type == "" {
+		meta.Type = string(m.ProtoReflect().Descriptor().FullName())
+	}
+
+	codec, err := CodecFor(meta.ContentType)
+	if err != nil {
+		return nil, err
+	}
+	return codec.Marshal(msg)
+}
@@ -0,0 +1,57 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrUnroutable is matched by errors.Is when a mandatory publish reached no queue
+var ErrUnroutable = errors.New("message unroutable")
+
+// UnroutableError reports a mandatory publish the broker could not route to
+// any queue
+type UnroutableError struct {
+	RoutingKey string
+	Reason     string
+}
+
+func (e *UnroutableError) Error() string {
+	return fmt.Sprintf("message to routing key %s is unroutable: %s", e.RoutingKey, e.Reason)
+}
+
+// Is makes errors.Is(err, ErrUnroutable) true for every UnroutableError
+func (e *UnroutableError) Is(target error) bool {
+	return target == ErrUnroutable
+}
+
+// ErrDelayUnsupported is returned by backends that cannot hold a delayed
+// message durably, rather than keeping it somewhere a restart would lose it
+var ErrDelayUnsupported = errors.New("delayed delivery is not supported by this broker")
+
+// ErrPermanent is matched by errors.Is when a handler reports a message that
+// will never succeed
+var ErrPermanent = errors.New("permanent failure")
+
+// PermanentError marks a handler error that retrying cannot fix. Consumers
+// dead-letter such messages straight away instead of retrying them.
+type PermanentError struct {
+	Err error
+}
+
+// Permanent wraps err so the consumer skips the remaining retries
+func Permanent(err error) error {
+	return &PermanentError{Err: err}
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes errors.Is(err, ErrPermanent) true for every PermanentError
+func (e *PermanentError) Is(target error) bool {
+	return target == ErrPermanent
+}
@@ -0,0 +1,254 @@
+package broker
+
+import "time"
+
+// QueueMode selects the lifetime of the queue a consumer declares
+type QueueMode int
+
+const (
+	// QueueDurable survives broker restarts and is kept until deleted
+	QueueDurable QueueMode = iota
+	// QueueExclusive belongs to the connection that declared it and is
+	// deleted when that connection closes
+	QueueExclusive
+	// QueueAutoDelete is deleted once its last consumer goes away
+	QueueAutoDelete
+)
+
+// ConsumerOptions tunes how a backend delivers messages to a ConsumeFunc
+type ConsumerOptions struct {
+	// MaxAttempts is how many times a delivery is handed to the handler
+	// before it is dead-lettered, including the first attempt
+	MaxAttempts int
+	// RetryDelay is how long a failed delivery waits before the next attempt
+	RetryDelay time.Duration
+	// Prefetch caps the unacknowledged deliveries the broker pushes to the
+	// consumer, zero leaves it unlimited
+	Prefetch int
+	// Workers is how many deliveries are handled concurrently
+	Workers int
+	// OrderingKey groups deliveries that must be handled in order, such as
+	// updates for the same user or order. Deliveries with an empty key, or
+	// every delivery when it is nil, may be handled in any order.
+	OrderingKey func(Delivery) string
+	// Raw passes JSON payloads through as json.RawMessage instead of
+	// decoding them, other content types are still decoded by their codec
+	Raw bool
+	// DedupSize and DedupTTL bound the window of message IDs remembered to
+	// drop duplicate deliveries, deduplication is off when DedupSize is zero
+	DedupSize int
+	DedupTTL  time.Duration
+	// QueueMode is the lifetime of the declared queue, durable by default
+	QueueMode QueueMode
+	// QueueExpires deletes the queue once it has had no consumers for this
+	// long, zero keeps it until its QueueMode removes it
+	QueueExpires time.Duration
+}
+
+// ConsumerOption configures a consumer started with StartConsumer
+type ConsumerOption func(*ConsumerOptions)
+
+// NewConsumerOptions applies opts on top of the defaults
+func NewConsumerOptions(opts ...ConsumerOption) ConsumerOptions {
+	o := ConsumerOptions{
+		MaxAttempts: 1,
+		Workers:     1,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.MaxAttempts < 1 {
+		o.MaxAttempts = 1
+	}
+	if o.Workers < 1 {
+		o.Workers = 1
+	}
+	return o
+}
+
+// WithRetry retries a failed delivery up to maxAttempts times in total,
+// waiting delay between attempts, before dead-lettering it
+func WithRetry(maxAttempts int, delay time.Duration) ConsumerOption {
+	return func(o *ConsumerOptions) {
+		o.MaxAttempts = maxAttempts
+		o.RetryDelay = delay
+	}
+}
+
+// WithPrefetch sets how many unacknowledged deliveries the broker may push
+func WithPrefetch(count int) ConsumerOption {
+	return func(o *ConsumerOptions) {
+		o.Prefetch = count
+	}
+}
+
+// WithWorkers handles up to workers deliveries concurrently
+func WithWorkers(workers int) ConsumerOption {
+	return func(o *ConsumerOptions) {
+		o.Workers = workers
+	}
+}
+
+// WithOrderingKey keeps deliveries that share a key in order while
+// deliveries for different keys are handled in parallel
+func WithOrderingKey(key func(Delivery) string) ConsumerOption {
+	return func(o *ConsumerOptions) {
+		o.OrderingKey = key
+	}
+}
+
+// WithRawPayload hands payloads to the handler as json.RawMessage without
+// decoding them
+func WithRawPayload() ConsumerOption {
+	return func(o *ConsumerOptions) {
+		o.Raw = true
+	}
+}
+
+// WithDedup drops deliveries whose message ID was already handled, keeping
+// up to size IDs for ttl
+func WithDedup(size int, ttl time.Duration) ConsumerOption {
+	return func(o *ConsumerOptions) {
+		o.DedupSize = size
+		o.DedupTTL = ttl
+	}
+}
+
+// WithQueueMode sets the lifetime of the queue the consumer declares. Use
+// QueueExclusive or QueueAutoDelete for per-node fan-out queues that must
+// not outlive the node.
+func WithQueueMode(mode QueueMode) ConsumerOption {
+	return func(o *ConsumerOptions) {
+		o.QueueMode = mode
+	}
+}
+
+// WithQueueExpires deletes the queue after it has been unused for d, so the
+// queue of a node that was scaled away stops collecting messages
+func WithQueueExpires(d time.Duration) ConsumerOption {
+	return func(o *ConsumerOptions) {
+		o.QueueExpires = d
+	}
+}
+
+// Wrap layers the handler-level options, such as deduplication, around
+// handler. Backends call it once per consumer.
+func (o ConsumerOptions) Wrap(handler ConsumeFunc) ConsumeFunc {
+	if o.DedupSize > 0 {
+		handler = NewDedupWindow(o.DedupSize, o.DedupTTL).Wrap(handler)
+	}
+	return handler
+}
+
+// Key returns the ordering key of d, or "" when no key function is set
+func (o ConsumerOptions) Key(d Delivery) string {
+	if o.OrderingKey == nil {
+		return ""
+	}
+	return o.OrderingKey(d)
+}
+
+// PublishOptions tunes a single Publish call
+type PublishOptions struct {
+	// Mandatory makes Publish fail with ErrUnroutable when no queue is bound
+	// to the routing key
+	Mandatory bool
+	// Metadata is sent with the message. A message ID and timestamp are
+	// generated when left empty.
+	Metadata Metadata
+	// DeliverAt holds the message back until the given time. A zero or past
+	// time delivers immediately.
+	DeliverAt time.Time
+}
+
+// Delay is how long the message must be held back from now
+func (o PublishOptions) Delay() time.Duration {
+	if o.DeliverAt.IsZero() {
+		return 0
+	}
+	return time.Until(o.DeliverAt)
+}
+
+// PublishOption configures a Publish call
+type PublishOption func(*PublishOptions)
+
+// NewPublishOptions applies opts on top of the defaults
+func NewPublishOptions(opts ...PublishOption) PublishOptions {
+	var o PublishOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.Metadata.MessageID == "" {
+		o.Metadata.MessageID = NewMessageID()
+	}
+	if o.Metadata.Timestamp.IsZero() {
+		o.Metadata.Timestamp = time.Now()
+	}
+	return o
+}
+
+// WithMandatory fails the publish with ErrUnroutable instead of silently
+// dropping it when no queue is bound to the routing key
+func WithMandatory() PublishOption {
+	return func(o *PublishOptions) {
+		o.Mandatory = true
+	}
+}
+
+// WithDelay delivers the message to consumers once d has passed
+func WithDelay(d time.Duration) PublishOption {
+	return func(o *PublishOptions) {
+		o.DeliverAt = time.Now().Add(d)
+	}
+}
+
+// WithDeliverAt delivers the message to consumers at t
+func WithDeliverAt(t time.Time) PublishOption {
+	return func(o *PublishOptions) {
+		o.DeliverAt = t
+	}
+}
+
+// WithMessageID sets the ID consumers use to identify the message
+func WithMessageID(id string) PublishOption {
+	return func(o *PublishOptions) {
+		o.Metadata.MessageID = id
+	}
+}
+
+// WithCorrelationID ties the message to a request or workflow
+func WithCorrelationID(id string) PublishOption {
+	return func(o *PublishOptions) {
+		o.Metadata.CorrelationID = id
+	}
+}
+
+// WithContentType encodes the message with the codec registered for
+// contentType instead of JSON
+func WithContentType(contentType string) PublishOption {
+	return func(o *PublishOptions) {
+		o.Metadata.ContentType = contentType
+	}
+}
+
+// WithReplyTo names the queue the receiver should send its reply to
+func WithReplyTo(queueName string) PublishOption {
+	return func(o *PublishOptions) {
+		o.Metadata.ReplyTo = queueName
+	}
+}
+
+// WithHeaders adds custom headers to the message
+func WithHeaders(headers map[string]interface{}) PublishOption {
+	return func(o *PublishOptions) {
+		if len(headers) == 0 {
+			return
+		}
+		if o.Metadata.Headers == nil {
+			o.Metadata.Headers = make(map[string]interface{}, len(headers))
+		}
+		for k, v := range headers {
+			o.Metadata.Headers[k] = v
+		}
+	}
+}
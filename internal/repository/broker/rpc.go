@@ -0,0 +1,30 @@
+package broker
+
+import "context"
+
+// RPCHandler answers a request received by Serve. A returned error is sent
+// back to the caller, which receives it as an *RPCError.
+type RPCHandler func(req Delivery) (Message, error)
+
+// RPC is implemented by backends that support request/reply over the exchange
+type RPC interface {
+	// Call publishes req to routingKey and waits for the reply until ctx expires
+	Call(ctx context.Context, routingKey string, req Message) (Message, error)
+	// Serve answers every request published to routingKey with handler
+	Serve(routingKey string, handler RPCHandler) (Consumer, error)
+}
+
+// RPCError is an error returned by the remote RPCHandler
+type RPCError struct {
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return "rpc: " + e.Message
+}
+
+// RPCQueueName is the queue that serves requests for routingKey. It is shared
+// by every node, so each request is answered once.
+func RPCQueueName(routingKey string) string {
+	return "rpc." + routingKey
+}
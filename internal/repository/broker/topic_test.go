@@ -0,0 +1,59 @@
+package broker
+
+import "testing"
+
+func TestMatchRoutingKey(t *testing.T) {
+	tests := []struct {
+		pattern, key string
+		want         bool
+	}{
+		{"orders.created", "orders.created", true},
+		{"orders.created", "orders.updated", false},
+		{"orders.created", "orders.created.eu", false},
+		{"orders", "orders.created", false},
+
+		// * is exactly one word
+		{"orders.*", "orders.created", true},
+		{"orders.*", "orders", false},
+		{"orders.*", "orders.created.eu", false},
+		{"*.created", "orders.created", true},
+		{"*.*", "orders.created", true},
+		{"*", "orders", true},
+		{"orders.*.eu", "orders.created.eu", true},
+		{"orders.*.eu", "orders.eu", false},
+
+		// # is zero or more words
+		{"#", "orders", true},
+		{"#", "orders.created.eu", true},
+		{"#", "", true},
+		{"orders.#", "orders", true},
+		{"orders.#", "orders.created", true},
+		{"orders.#", "orders.created.eu", true},
+		{"orders.#", "payments.created", false},
+		{"#.eu", "orders.created.eu", true},
+		{"#.eu", "eu", true},
+		{"#.eu", "orders.created.us", false},
+		{"orders.#.eu", "orders.eu", true},
+		{"orders.#.eu", "orders.created.eu", true},
+		{"orders.#.eu", "orders.created.paid.eu", true},
+		{"orders.#.eu", "orders.created.us", false},
+		{"#.#", "orders.created", true},
+		{"#.*", "orders", true},
+		{"*.#", "orders", true},
+		{"*.#.*", "orders", false},
+		{"*.#.*", "orders.eu", true},
+		{"#.created.#", "orders.created", true},
+		{"#.created.#", "created", true},
+		{"#.created.#", "orders.paid", false},
+
+		// Words are compared whole
+		{"order.*", "orders.created", false},
+		{"orders.created", "orders.create", false},
+	}
+
+	for _, tt := range tests {
+		if got := MatchRoutingKey(tt.pattern, tt.key); got != tt.want {
+			t.Errorf("MatchRoutingKey(%q, %q) = %v, want %v", tt.pattern, tt.key, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sync"
+)
+
+// WorkerPool runs consumer jobs on a fixed number of goroutines. Jobs that
+// share a non-empty key always run on the same goroutine in submission order,
+// jobs without a key run on whichever worker is free first.
+type WorkerPool struct {
+	shared chan func()
+	keyed  []chan func()
+	wg     sync.WaitGroup
+}
+
+// NewWorkerPool starts a pool with the given number of workers
+func NewWorkerPool(workers int) *WorkerPool {
+	if workers < 1 {
+		workers = 1
+	}
+
+	p := &WorkerPool{
+		shared: make(chan func()),
+		keyed:  make([]chan func(), workers),
+	}
+	for i := range p.keyed {
+		p.keyed[i] = make(chan func())
+		p.wg.Add(1)
+		go p.run(p.keyed[i])
+	}
+	return p
+}
+
+func (p *WorkerPool) run(own chan func()) {
+	defer p.wg.Done()
+
+	for {
+		select {
+		case job, ok := <-own:
+			if !ok {
+				own = nil
+				continue
+			}
+			job()
+		case job, ok := <-p.shared:
+			if !ok {
+				return
+			}
+			job()
+		}
+	}
+}
+
+// Submit hands job to a worker, blocking until one accepts it. It returns
+// false without running the job if ctx is cancelled first.
+func (p *WorkerPool) Submit(ctx context.Context, key string, job func()) bool {
+	target := p.shared
+	if key != "" {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		target = p.keyed[h.Sum32()%uint32(len(p.keyed))]
+	}
+
+	select {
+	case target <- job:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Close stops accepting jobs and waits for the jobs already running
+func (p *WorkerPool) Close() {
+	for _, ch := range p.keyed {
+		close(ch)
+	}
+	close(p.shared)
+	p.wg.Wait()
+}
+
+// FieldKey returns an ordering key function that reads a top-level field of
+// a JSON object message, such as "user_id" or "order_id". Raw payloads are
+// read without decoding numbers, so large IDs keep every digit.
+func FieldKey(field string) func(Delivery) string {
+	return func(d Delivery) string {
+		switch msg := d.Message.(type) {
+		case map[string]interface{}:
+			value, ok := msg[field]
+			if !ok || value == nil {
+				return ""
+			}
+			return fmt.Sprint(value)
+		case json.RawMessage:
+			var obj map[string]json.RawMessage
+			if err := json.Unmarshal(msg, &obj); err != nil {
+				return ""
+			}
+			value, ok := obj[field]
+			if !ok || string(value) == "null" {
+				return ""
+			}
+			var str string
+			if err := json.Unmarshal(value, &str); err == nil {
+				return str
+			}
+			return string(value)
+		}
+		return ""
+	}
+}
@@ -0,0 +1,126 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolKeepsKeyOrder(t *testing.T) {
+	p := NewWorkerPool(4)
+
+	const keys, jobs = 8, 200
+	var mu sync.Mutex
+	handled := make(map[string][]int)
+
+	ctx := context.Background()
+	for i := 0; i < jobs; i++ {
+		key := fmt.Sprintf("user-%d", i%keys)
+		i := i
+		p.Submit(ctx, key, func() {
+			// Later jobs of other keys may overtake, never those of the same key
+			if i%3 == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			mu.Lock()
+			handled[key] = append(handled[key], i)
+			mu.Unlock()
+		})
+	}
+	p.Close()
+
+	for key, order := range handled {
+		if len(order) != jobs/keys {
+			t.Errorf("%s: handled %d jobs, want %d", key, len(order), jobs/keys)
+		}
+		for j := 1; j < len(order); j++ {
+			if order[j] < order[j-1] {
+				t.Fatalf("%s: jobs handled out of order: %v", key, order)
+			}
+		}
+	}
+}
+
+func TestWorkerPoolRunsUnkeyedJobsConcurrently(t *testing.T) {
+	const workers = 4
+	p := NewWorkerPool(workers)
+	defer p.Close()
+
+	var running, peak int32
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		p.Submit(context.Background(), "", func() {
+			defer wg.Done()
+			n := atomic.AddInt32(&running, 1)
+			for {
+				old := atomic.LoadInt32(&peak)
+				if n <= old || atomic.CompareAndSwapInt32(&peak, old, n) {
+					break
+				}
+			}
+			<-release
+			atomic.AddInt32(&running, -1)
+		})
+	}
+
+	// Every worker is busy, so another job is not accepted
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if p.Submit(ctx, "", func() {}) {
+		t.Fatal("job accepted while every worker is busy")
+	}
+
+	close(release)
+	wg.Wait()
+	if peak != workers {
+		t.Fatalf("%d jobs ran at once, want %d", peak, workers)
+	}
+}
+
+func TestWorkerPoolCloseWaitsForJobs(t *testing.T) {
+	p := NewWorkerPool(2)
+
+	var done int32
+	for i := 0; i < 2; i++ {
+		p.Submit(context.Background(), "", func() {
+			time.Sleep(20 * time.Millisecond)
+			atomic.AddInt32(&done, 1)
+		})
+	}
+	p.Close()
+
+	if done != 2 {
+		t.Fatalf("Close returned with %d of 2 jobs done", done)
+	}
+}
+
+func TestFieldKey(t *testing.T) {
+	key := FieldKey("user_id")
+
+	tests := []struct {
+		name string
+		msg  Message
+		want string
+	}{
+		{"string", map[string]interface{}{"user_id": "u1"}, "u1"},
+		{"number", map[string]interface{}{"user_id": float64(42)}, "42"},
+		{"missing", map[string]interface{}{"other": "u1"}, ""},
+		{"null", map[string]interface{}{"user_id": nil}, ""},
+		{"raw string", json.RawMessage(`{"user_id":"u1"}`), "u1"},
+		{"raw large number", json.RawMessage(`{"user_id":12345678901234567890}`), "12345678901234567890"},
+		{"raw null", json.RawMessage(`{"user_id":null}`), ""},
+		{"raw array", json.RawMessage(`[1,2]`), ""},
+		{"other type", "u1", ""},
+	}
+	for _, tt := range tests {
+		if got := key(Delivery{Message: tt.msg}); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
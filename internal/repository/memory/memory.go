@@ -0,0 +1,413 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Gaoey/scale-websocket/internal/repository/broker"
+)
+
+const defaultQueueSize = 1024
+
+var (
+	_ broker.Broker          = (*Client)(nil)
+	_ broker.DeadLetterQueue = (*Client)(nil)
+)
+
+// Client is an in-process broker with topic exchange semantics. Every queue
+// receives its own copy of a matching message and consumers of the same queue
+// compete for deliveries, mirroring how the RabbitMQ backend behaves.
+type Client struct {
+	ExchangeName string
+	queueSize    int
+
+	mu     sync.RWMutex
+	queues map[string]*queue
+	// replies holds the callers waiting in Call by correlation ID
+	replies map[string]chan rpcReply
+	done    chan struct{}
+	closed  bool
+}
+
+// Config holds the configuration for the in-memory broker
+type Config struct {
+	ExchangeName string
+	QueueSize    int // buffered messages per queue, defaults to 1024
+}
+
+type queue struct {
+	name     string
+	bindings map[string]struct{}
+	messages chan delivery
+	dead     []deadLetter
+	// consumers counts the running consumers so non-durable queues can be
+	// removed once the last one stops
+	consumers int
+	mode      broker.QueueMode
+	expires   time.Duration
+	expiry    *time.Timer
+}
+
+type delivery struct {
+	meta     broker.Metadata
+	body     []byte
+	attempts int
+}
+
+type deadLetter struct {
+	letter   broker.DeadLetter
+	delivery delivery
+}
+
+// NewClient creates a new in-memory broker client
+func NewClient(cfg Config) (*Client, error) {
+	if cfg.ExchangeName == "" {
+		return nil, fmt.Errorf("exchange name required")
+	}
+
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = defaultQueueSize
+	}
+
+	return &Client{
+		ExchangeName: cfg.ExchangeName,
+		queueSize:    cfg.QueueSize,
+		queues:       make(map[string]*queue),
+		replies:      make(map[string]chan rpcReply),
+		done:         make(chan struct{}),
+	}, nil
+}
+
+// Publish publishes a message to every queue bound to a matching routing key
+func (c *Client) Publish(ctx context.Context, routingKey string, msg broker.Message, opts ...broker.PublishOption) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	options := broker.NewPublishOptions(opts...)
+	meta := options.Metadata
+	meta.RoutingKey = routingKey
+
+	// A timer in this process would lose scheduled messages on restart
+	if options.Delay() > 0 {
+		return broker.ErrDelayUnsupported
+	}
+
+	body, err := broker.Encode(msg, &meta)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	if broker.IsJSON(meta.ContentType) {
+		log.Printf("Publishing message to routing key %s: %s", routingKey, body)
+	} else {
+		log.Printf("Publishing %d byte %s message to routing key %s", len(body), meta.ContentType, routingKey)
+	}
+
+	return c.route(ctx, routingKey, meta, body, options.Mandatory)
+}
+
+// route enqueues a message on every queue bound to its routing key
+func (c *Client) route(ctx context.Context, routingKey string, meta broker.Metadata, body []byte, mandatory bool) error {
+	c.mu.RLock()
+	if c.closed {
+		c.mu.RUnlock()
+		return fmt.Errorf("broker is closed")
+	}
+	var targets []*queue
+	for _, q := range c.queues {
+		if q.matches(routingKey) {
+			targets = append(targets, q)
+		}
+	}
+	c.mu.RUnlock()
+
+	if len(targets) == 0 && mandatory {
+		return &broker.UnroutableError{RoutingKey: routingKey, Reason: "NO_ROUTE"}
+	}
+
+	for _, q := range targets {
+		select {
+		case q.messages <- delivery{meta: meta, body: body}:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.done:
+			return fmt.Errorf("broker is closed")
+		}
+	}
+
+	return nil
+}
+
+var _ broker.BatchPublisher = (*Client)(nil)
+
+// PublishBatch publishes msgs in order. Every message is enqueued by the time
+// it is reported as published, so there is nothing to gain from pipelining.
+func (c *Client) PublishBatch(ctx context.Context, msgs []broker.BatchMessage) []error {
+	errs := make([]error, len(msgs))
+	for i, m := range msgs {
+		errs[i] = c.Publish(ctx, m.RoutingKey, m.Message, m.Options...)
+	}
+	return errs
+}
+
+// consumer is a running in-memory consumer
+type consumer struct {
+	queueName string
+	stopping  chan struct{}
+	stopOnce  sync.Once
+	done      chan struct{}
+}
+
+// StartConsumer declares the queue if needed, binds it to the given routing
+// keys and starts delivering its messages to handler. Prefetch has no effect
+// since deliveries are handed over one at a time.
+func (c *Client) StartConsumer(ctx context.Context, queueName string, routingKeys []string, handler broker.ConsumeFunc, opts ...broker.ConsumerOption) (broker.Consumer, error) {
+	log.Printf("Starting consumer for queue: %s with routing keys: %v", queueName, routingKeys)
+
+	options := broker.NewConsumerOptions(opts...)
+	handler = options.Wrap(handler)
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, fmt.Errorf("broker is closed")
+	}
+	q := c.declare(queueName)
+	for _, key := range routingKeys {
+		q.bindings[key] = struct{}{}
+	}
+	q.mode = options.QueueMode
+	q.expires = options.QueueExpires
+	q.consumers++
+	if q.expiry != nil {
+		q.expiry.Stop()
+		q.expiry = nil
+	}
+	c.mu.Unlock()
+
+	cons := &consumer{
+		queueName: queueName,
+		stopping:  make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	workers := broker.NewWorkerPool(options.Workers)
+
+	go func() {
+		defer close(cons.done)
+		defer c.release(q)
+		defer log.Println("In-memory consumer stopped for queue:", queueName)
+		defer workers.Close()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-cons.stopping:
+				return
+			case <-c.done:
+				return
+			case d := <-q.messages:
+				msg, err := broker.Decode(d.body, d.meta, options.Raw)
+				if err != nil {
+					log.Printf("Error unmarshaling message: %v", err)
+					// A body that cannot be decoded will never succeed, skip the retries
+					c.fail(q, d, broker.ConsumerOptions{MaxAttempts: 1}, err)
+					continue
+				}
+
+				delivery := broker.Delivery{Metadata: d.meta, Message: msg, Body: d.body}
+				job := func() {
+					if err := handler(delivery); err != nil {
+						log.Printf("Error handling message from %s: %v", queueName, err)
+						c.fail(q, d, options, err)
+					}
+				}
+				if !workers.Submit(ctx, options.Key(delivery), job) {
+					// Hand the delivery back to the queue, it was never handled
+					select {
+					case q.messages <- d:
+					default:
+						log.Printf("Queue %s is full, dropping undelivered message %s", queueName, d.meta.MessageID)
+					}
+					return
+				}
+			}
+		}
+	}()
+
+	return cons, nil
+}
+
+// Shutdown stops taking deliveries from the queue and waits for the handlers
+// in flight to finish, or for ctx to expire
+func (c *consumer) Shutdown(ctx context.Context) error {
+	c.stopOnce.Do(func() { close(c.stopping) })
+
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("consumer for queue %s did not drain: %w", c.queueName, ctx.Err())
+	}
+}
+
+// Done is closed once the consumer has fully stopped
+func (c *consumer) Done() <-chan struct{} {
+	return c.done
+}
+
+// release drops a consumer from q and removes the queue when it is not durable
+// and this was its last consumer, or schedules the removal after q.expires
+func (c *Client) release(q *queue) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	q.consumers--
+	if q.consumers > 0 {
+		return
+	}
+
+	switch {
+	case q.mode != broker.QueueDurable:
+		c.remove(q)
+	case q.expires > 0:
+		q.expiry = time.AfterFunc(q.expires, func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if q.consumers == 0 {
+				c.remove(q)
+			}
+		})
+	}
+}
+
+// remove deletes q unless it has already been replaced. c.mu must be held.
+func (c *Client) remove(q *queue) {
+	if c.queues[q.name] == q {
+		delete(c.queues, q.name)
+		log.Printf("Deleted unused queue: %s", q.name)
+	}
+}
+
+// declare returns the named queue, creating it when needed. c.mu must be held.
+func (c *Client) declare(queueName string) *queue {
+	q, ok := c.queues[queueName]
+	if !ok {
+		q = &queue{
+			name:     queueName,
+			bindings: make(map[string]struct{}),
+			messages: make(chan delivery, c.queueSize),
+		}
+		c.queues[queueName] = q
+	}
+	return q
+}
+
+// fail schedules a failed delivery for another attempt after opts.RetryDelay
+// or dead-letters it once opts.MaxAttempts is reached
+func (c *Client) fail(q *queue, d delivery, opts broker.ConsumerOptions, cause error) {
+	d.attempts++
+
+	if d.attempts >= opts.MaxAttempts || errors.Is(cause, broker.ErrPermanent) {
+		log.Printf("Dead-lettering message from %s after %d attempts: %v", q.name, d.attempts, cause)
+		c.mu.Lock()
+		q.dead = append(q.dead, deadLetter{
+			letter: broker.DeadLetter{
+				MessageID:  d.meta.MessageID,
+				RoutingKey: d.meta.RoutingKey,
+				Body:       string(d.body),
+				Attempts:   d.attempts,
+				Reason:     cause.Error(),
+				FailedAt:   time.Now().UTC(),
+			},
+			delivery: d,
+		})
+		c.mu.Unlock()
+		return
+	}
+
+	log.Printf("Retrying message from %s in %v (attempt %d/%d): %v", q.name, opts.RetryDelay, d.attempts, opts.MaxAttempts, cause)
+	time.AfterFunc(opts.RetryDelay, func() {
+		select {
+		case q.messages <- d:
+		case <-c.done:
+		}
+	})
+}
+
+// DeadLetters returns up to limit dead letters of a queue without removing them
+func (c *Client) DeadLetters(ctx context.Context, queueName string, limit int) ([]broker.DeadLetter, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	letters := make([]broker.DeadLetter, 0)
+	if q, ok := c.queues[queueName]; ok {
+		if limit > len(q.dead) {
+			limit = len(q.dead)
+		}
+		for _, dead := range q.dead[:limit] {
+			letters = append(letters, dead.letter)
+		}
+	}
+	return letters, nil
+}
+
+// ReplayDeadLetters moves up to limit dead letters back onto their queue
+// with their attempt counter reset
+func (c *Client) ReplayDeadLetters(ctx context.Context, queueName string, limit int) (int, error) {
+	c.mu.Lock()
+	q, ok := c.queues[queueName]
+	if !ok {
+		c.mu.Unlock()
+		return 0, nil
+	}
+	if limit > len(q.dead) {
+		limit = len(q.dead)
+	}
+	letters := append([]deadLetter(nil), q.dead[:limit]...)
+	q.dead = q.dead[limit:]
+	c.mu.Unlock()
+
+	for i, dead := range letters {
+		d := dead.delivery
+		d.attempts = 0
+
+		select {
+		case q.messages <- d:
+		case <-ctx.Done():
+			c.mu.Lock()
+			q.dead = append(letters[i:], q.dead...)
+			c.mu.Unlock()
+			return i, ctx.Err()
+		}
+	}
+
+	log.Printf("Replayed %d dead letters onto queue %s", len(letters), queueName)
+	return len(letters), nil
+}
+
+// Close stops every consumer and rejects further publishes
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		close(c.done)
+	}
+	return nil
+}
+
+func (q *queue) matches(routingKey string) bool {
+	for pattern := range q.bindings {
+		if broker.MatchRoutingKey(pattern, routingKey) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,293 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Gaoey/scale-websocket/internal/repository/broker"
+)
+
+func TestPublishRefusesDelays(t *testing.T) {
+	client, err := NewClient(Config{ExchangeName: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	err = client.Publish(ctx, "a.b", map[string]string{"k": "v"}, broker.WithDelay(time.Minute))
+	if !errors.Is(err, broker.ErrDelayUnsupported) {
+		t.Fatalf("delayed publish: got %v, want %v", err, broker.ErrDelayUnsupported)
+	}
+
+	errs := client.PublishBatch(ctx, []broker.BatchMessage{
+		{RoutingKey: "a.b", Message: 1},
+		{RoutingKey: "a.b", Message: 2, Options: []broker.PublishOption{broker.WithDeliverAt(time.Now().Add(time.Hour))}},
+	})
+	if errs[0] != nil || !errors.Is(errs[1], broker.ErrDelayUnsupported) {
+		t.Fatalf("unexpected batch results %v", errs)
+	}
+
+	// A deliver_at in the past is not a delay
+	if err := client.Publish(ctx, "a.b", 1, broker.WithDeliverAt(time.Now().Add(-time.Second))); err != nil {
+		t.Fatalf("past deliver_at: %v", err)
+	}
+}
+
+func newTestClient(t *testing.T) *Client {
+	t.Helper()
+	client, err := NewClient(Config{ExchangeName: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// collect returns a handler that sends the routing keys it handles to a channel
+func collect() (broker.ConsumeFunc, chan string) {
+	got := make(chan string, 100)
+	return func(d broker.Delivery) error {
+		got <- d.RoutingKey
+		return nil
+	}, got
+}
+
+func expect(t *testing.T, got chan string, want ...string) {
+	t.Helper()
+	for _, key := range want {
+		select {
+		case k := <-got:
+			if k != key {
+				t.Fatalf("received %s, want %s", k, key)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("did not receive %s", key)
+		}
+	}
+	select {
+	case k := <-got:
+		t.Fatalf("unexpected message %s", k)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestRouting(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+
+	orders, gotOrders := collect()
+	eu, gotEU := collect()
+	if _, err := client.StartConsumer(ctx, "orders", []string{"orders.*"}, orders); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.StartConsumer(ctx, "eu", []string{"#.eu", "payments.eu"}, eu); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"orders.created", "orders.created.eu", "payments.eu", "payments.us"} {
+		if err := client.Publish(ctx, key, map[string]string{"key": key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each queue gets its own copy, once however many of its bindings match
+	expect(t, gotOrders, "orders.created")
+	expect(t, gotEU, "orders.created.eu", "payments.eu")
+
+	err := client.Publish(ctx, "payments.us", 1, broker.WithMandatory())
+	if !errors.Is(err, broker.ErrUnroutable) {
+		t.Fatalf("mandatory publish without a queue: %v", err)
+	}
+}
+
+func TestCompetingConsumers(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+
+	handler, got := collect()
+	for i := 0; i < 2; i++ {
+		if _, err := client.StartConsumer(ctx, "orders", []string{"orders.*"}, handler); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		client.Publish(ctx, "orders.created", i)
+	}
+	// Consumers of one queue share its messages instead of each getting a copy
+	want := make([]string, 10)
+	for i := range want {
+		want[i] = "orders.created"
+	}
+	expect(t, got, want...)
+}
+
+func TestRetriesThenDeadLetters(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	attempts := make(map[string]int)
+	handler := func(d broker.Delivery) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts[d.MessageID]++
+		switch d.MessageID {
+		case "flaky":
+			if attempts[d.MessageID] < 2 {
+				return errors.New("not yet")
+			}
+			return nil
+		case "permanent":
+			return broker.Permanent(errors.New("bad message"))
+		}
+		return errors.New("always fails")
+	}
+	if _, err := client.StartConsumer(ctx, "orders", []string{"orders.*"}, handler, broker.WithRetry(3, 10*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"flaky", "permanent", "broken"} {
+		if err := client.Publish(ctx, "orders.created", id, broker.WithMessageID(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var letters []broker.DeadLetter
+	deadline := time.Now().Add(2 * time.Second)
+	for len(letters) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("dead letters %+v", letters)
+		}
+		time.Sleep(10 * time.Millisecond)
+		letters, _ = client.DeadLetters(ctx, "orders", 10)
+	}
+
+	byID := make(map[string]broker.DeadLetter)
+	for _, l := range letters {
+		byID[l.MessageID] = l
+	}
+	if l := byID["permanent"]; l.Attempts != 1 || l.Reason != "bad message" {
+		t.Fatalf("permanent failure was retried: %+v", l)
+	}
+	if l := byID["broken"]; l.Attempts != 3 || l.RoutingKey != "orders.created" {
+		t.Fatalf("broken message: %+v", l)
+	}
+	mu.Lock()
+	if attempts["flaky"] != 2 {
+		t.Fatalf("flaky message handled %d times, want 2", attempts["flaky"])
+	}
+	mu.Unlock()
+
+	// A replay starts over with a fresh attempt count
+	first := letters[0]
+	replayed, err := client.ReplayDeadLetters(ctx, "orders", 1)
+	if err != nil || replayed != 1 {
+		t.Fatalf("replayed %d: %v", replayed, err)
+	}
+	deadline = time.Now().Add(2 * time.Second)
+	for {
+		letters, _ = client.DeadLetters(ctx, "orders", 10)
+		if len(letters) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("replayed message was not dead-lettered again: %+v", letters)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if l := letters[1]; l.MessageID != first.MessageID || l.Attempts != first.Attempts {
+		t.Fatalf("replayed %+v, dead-lettered again as %+v", first, l)
+	}
+}
+
+func TestShutdownDrainsInFlightDeliveries(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var handled int32
+	handler := func(d broker.Delivery) error {
+		close(started)
+		<-release
+		atomic.AddInt32(&handled, 1)
+		return nil
+	}
+	consumer, err := client.StartConsumer(ctx, "orders", []string{"orders.*"}, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.Publish(ctx, "orders.created", 1)
+	<-started
+
+	// Shutdown waits for the handler, or gives up with ctx
+	short, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := consumer.Shutdown(short); err == nil {
+		t.Fatal("shutdown returned while a delivery was in flight")
+	}
+
+	close(release)
+	if err := consumer.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&handled) != 1 {
+		t.Fatal("shutdown returned before the delivery was handled")
+	}
+	select {
+	case <-consumer.Done():
+	default:
+		t.Fatal("Done is open after shutdown")
+	}
+}
+
+func TestOrderingKeyKeepsOrderAcrossWorkers(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	seen := make(map[string][]float64)
+	var wg sync.WaitGroup
+	handler := func(d broker.Delivery) error {
+		defer wg.Done()
+		msg := d.Message.(map[string]interface{})
+		seq := msg["seq"].(float64)
+		if int(seq)%3 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		mu.Lock()
+		seen[msg["user_id"].(string)] = append(seen[msg["user_id"].(string)], seq)
+		mu.Unlock()
+		return nil
+	}
+	_, err := client.StartConsumer(ctx, "orders", []string{"orders.*"}, handler,
+		broker.WithWorkers(4), broker.WithOrderingKey(broker.FieldKey("user_id")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const messages = 100
+	wg.Add(messages)
+	for i := 0; i < messages; i++ {
+		client.Publish(ctx, "orders.created", map[string]interface{}{"user_id": fmt.Sprintf("u%d", i%5), "seq": i})
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	for user, seqs := range seen {
+		for i := 1; i < len(seqs); i++ {
+			if seqs[i] < seqs[i-1] {
+				t.Fatalf("messages of %s handled out of order: %v", user, seqs)
+			}
+		}
+	}
+}
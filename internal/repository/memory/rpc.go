@@ -0,0 +1,90 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/Gaoey/scale-websocket/internal/repository/broker"
+)
+
+var _ broker.RPC = (*Client)(nil)
+
+// replyAddress is the reply_to of every in-process request, replies are
+// matched to callers by correlation ID
+const replyAddress = "memory.reply"
+
+type rpcReply struct {
+	body []byte
+	meta broker.Metadata
+	err  error
+}
+
+// Call publishes req to routingKey and waits for the reply until ctx expires
+func (c *Client) Call(ctx context.Context, routingKey string, req broker.Message) (broker.Message, error) {
+	correlationID := broker.NewMessageID()
+	reply := make(chan rpcReply, 1)
+
+	c.mu.Lock()
+	c.replies[correlationID] = reply
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.replies, correlationID)
+		c.mu.Unlock()
+	}()
+
+	err := c.Publish(ctx, routingKey, req,
+		broker.WithMandatory(),
+		broker.WithCorrelationID(correlationID),
+		broker.WithReplyTo(replyAddress),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case r := <-reply:
+		if r.err != nil {
+			return nil, r.err
+		}
+		return broker.Decode(r.body, r.meta, false)
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for reply from %s: %w", routingKey, ctx.Err())
+	}
+}
+
+// Serve answers requests published to routingKey from a queue shared by
+// every caller, so each request is answered once
+func (c *Client) Serve(routingKey string, handler broker.RPCHandler) (broker.Consumer, error) {
+	return c.StartConsumer(context.Background(), broker.RPCQueueName(routingKey), []string{routingKey}, func(req broker.Delivery) error {
+		if req.ReplyTo != replyAddress {
+			return fmt.Errorf("request %s has no reply_to", req.MessageID)
+		}
+
+		// Replies are encoded like the request they answer
+		r := rpcReply{meta: broker.Metadata{ContentType: req.ContentType}}
+		resp, err := handler(req)
+		if err != nil {
+			r.err = &broker.RPCError{Message: err.Error()}
+		} else if r.body, err = broker.Encode(resp, &r.meta); err != nil {
+			r.err = &broker.RPCError{Message: "failed to encode response"}
+		}
+
+		c.mu.RLock()
+		reply, ok := c.replies[req.CorrelationID]
+		c.mu.RUnlock()
+
+		if !ok {
+			log.Printf("Dropping reply for unknown correlation ID %s", req.CorrelationID)
+			return nil
+		}
+		select {
+		case reply <- r:
+		default:
+			log.Printf("Dropping duplicate reply for correlation ID %s", req.CorrelationID)
+		}
+		return nil
+	})
+}
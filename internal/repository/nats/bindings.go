@@ -0,0 +1,95 @@
+package nats
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	natsgo "github.com/nats-io/nats.go"
+)
+
+// bindingsRefresh is how long the cached consumer filters are used before
+// they are listed again, which catches consumers whose filters were changed
+// in place and advisories lost while disconnected
+const bindingsRefresh = 30 * time.Second
+
+// Advisories JetStream publishes when a consumer of a stream is created or
+// deleted, followed by the stream and consumer names
+const (
+	advisoryConsumerCreated = "$JS.EVENT.ADVISORY.CONSUMER.CREATED"
+	advisoryConsumerDeleted = "$JS.EVENT.ADVISORY.CONSUMER.DELETED"
+)
+
+// bindingsCache holds the subject filters of every durable consumer of the
+// stream, so mandatory publishes do not list the consumers each time
+type bindingsCache struct {
+	mu      sync.Mutex
+	filters []string
+	at      time.Time
+}
+
+// watchBindings drops the cached filters whenever a consumer of the stream
+// is created or deleted, on this node or any other
+func (c *Client) watchBindings() error {
+	for _, prefix := range []string{advisoryConsumerCreated, advisoryConsumerDeleted} {
+		subject := prefix + "." + c.streamName + ".*"
+		if _, err := c.nc.Subscribe(subject, func(*natsgo.Msg) {
+			c.invalidateBindings()
+		}); err != nil {
+			return fmt.Errorf("failed to subscribe to %s: %w", subject, err)
+		}
+	}
+	return nil
+}
+
+// invalidateBindings makes the next mandatory publish list the consumers again
+func (c *Client) invalidateBindings() {
+	c.bindings.mu.Lock()
+	defer c.bindings.mu.Unlock()
+	c.bindings.filters = nil
+}
+
+// routable reports whether a durable queue is bound to subject. Plain
+// subscriptions of exclusive queues are not taken into account.
+func (c *Client) routable(ctx context.Context, subject string) (bool, error) {
+	c.bindings.mu.Lock()
+	defer c.bindings.mu.Unlock()
+
+	if c.bindings.filters == nil || time.Since(c.bindings.at) >= bindingsRefresh {
+		filters, err := c.readBindings(ctx)
+		if err != nil {
+			return false, err
+		}
+		c.bindings.filters, c.bindings.at = filters, time.Now()
+	}
+
+	for _, filter := range c.bindings.filters {
+		if subjectMatches(filter, subject) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// readBindings lists the subject filters of every consumer of the stream
+func (c *Client) readBindings(ctx context.Context) ([]string, error) {
+	stream, err := c.js.Stream(ctx, c.streamName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up stream %s: %w", c.streamName, err)
+	}
+
+	// Not nil, so a stream without consumers is cached too
+	filters := []string{}
+	lister := stream.ListConsumers(ctx)
+	for info := range lister.Info() {
+		filters = append(filters, info.Config.FilterSubjects...)
+		if info.Config.FilterSubject != "" {
+			filters = append(filters, info.Config.FilterSubject)
+		}
+	}
+	if err := lister.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list consumers: %w", err)
+	}
+	return filters, nil
+}
@@ -0,0 +1,399 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Gaoey/scale-websocket/internal/repository/broker"
+	natsgo "github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// consumer is a running durable JetStream consumer or a set of plain NATS
+// subscriptions
+type consumer struct {
+	client      *Client
+	queueName   string
+	routingKeys []string
+	handler     broker.ConsumeFunc
+	opts        broker.ConsumerOptions
+	workers     *broker.WorkerPool
+
+	// consumeCtx is the durable consumer's pull loop, subs the plain
+	// subscriptions. Only one of them is set.
+	consumeCtx jetstream.ConsumeContext
+	subs       []*natsgo.Subscription
+
+	// mu is held for reading while a message is dispatched, so stopping
+	// waits for the dispatches in progress before closing the workers
+	mu       sync.RWMutex
+	stopped  bool
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// StartConsumer consumes the messages matching routingKeys. Durable queues
+// are durable JetStream consumers named after the queue, other queue modes
+// subscribe to the matching subjects and only see messages published while
+// they are connected.
+func (c *Client) StartConsumer(ctx context.Context, queueName string, routingKeys []string, handler broker.ConsumeFunc, opts ...broker.ConsumerOption) (broker.Consumer, error) {
+	log.Printf("Starting consumer for queue: %s with routing keys: %v", queueName, routingKeys)
+
+	options := broker.NewConsumerOptions(opts...)
+
+	cons := &consumer{
+		client:      c,
+		queueName:   queueName,
+		routingKeys: routingKeys,
+		handler:     options.Wrap(handler),
+		opts:        options,
+		workers:     broker.NewWorkerPool(options.Workers),
+		done:        make(chan struct{}),
+	}
+
+	var err error
+	if options.QueueMode == broker.QueueDurable {
+		err = cons.consumeStream(ctx)
+	} else {
+		err = cons.subscribe()
+	}
+	if err != nil {
+		cons.workers.Close()
+		return nil, err
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			log.Printf("Context cancelled for consumer %s", queueName)
+			cons.stop()
+		case <-cons.done:
+		}
+	}()
+
+	return cons, nil
+}
+
+// consumeStream declares the durable consumer of the queue and starts
+// pulling from it. A new consumer starts at the end of the stream, like a
+// freshly declared queue, and also receives what is addressed to the queue
+// itself, such as replayed dead letters.
+func (c *consumer) consumeStream(ctx context.Context) error {
+	filters := append(c.client.subjectFilters(c.routingKeys), c.client.replaySubject(c.queueName))
+
+	cfg := jetstream.ConsumerConfig{
+		Durable:        sanitize(c.queueName),
+		FilterSubjects: filters,
+		AckPolicy:      jetstream.AckExplicitPolicy,
+		DeliverPolicy:  jetstream.DeliverNewPolicy,
+		AckWait:        c.client.ackWait,
+		// Removes the consumer once nobody has pulled from it for this long
+		InactiveThreshold: c.opts.QueueExpires,
+	}
+	if c.opts.Prefetch > 0 {
+		cfg.MaxAckPending = c.opts.Prefetch
+	}
+
+	cons, err := c.client.js.CreateOrUpdateConsumer(ctx, c.client.streamName, cfg)
+	if err != nil {
+		return fmt.Errorf("failed to declare consumer %s: %w", c.queueName, err)
+	}
+	// The advisory arrives asynchronously, publishes from here must see the
+	// queue right away
+	c.client.invalidateBindings()
+
+	pullOpts := []jetstream.PullConsumeOpt{
+		jetstream.ConsumeErrHandler(func(_ jetstream.ConsumeContext, err error) {
+			log.Printf("Error consuming queue %s: %v", c.queueName, err)
+		}),
+	}
+	if c.opts.Prefetch > 0 {
+		pullOpts = append(pullOpts, jetstream.PullMaxMessages(c.opts.Prefetch))
+	}
+
+	c.consumeCtx, err = cons.Consume(func(m jetstream.Msg) {
+		c.dispatch(m.Subject(), m.Headers(), m.Data(), jsAcker{m})
+	}, pullOpts...)
+	if err != nil {
+		return fmt.Errorf("failed to consume queue %s: %w", c.queueName, err)
+	}
+	return nil
+}
+
+// subscribe subscribes to the subjects matching the routing keys
+func (c *consumer) subscribe() error {
+	for _, filter := range c.client.subjectFilters(c.routingKeys) {
+		sub, err := c.client.nc.Subscribe(filter, func(m *natsgo.Msg) {
+			c.dispatch(m.Subject, m.Header, m.Data, &coreAcker{consumer: c, msg: m})
+		})
+		if err != nil {
+			c.unsubscribe()
+			return fmt.Errorf("failed to subscribe to %s: %w", filter, err)
+		}
+		c.subs = append(c.subs, sub)
+	}
+	return nil
+}
+
+// acker settles a delivery, either through JetStream or locally for plain
+// NATS messages, which have no acknowledgements
+type acker interface {
+	ack()
+	// retry delivers the message again after delay
+	retry(delay time.Duration)
+	// attempts is how many times the message has been delivered so far
+	attempts() int
+}
+
+type jsAcker struct {
+	msg jetstream.Msg
+}
+
+func (a jsAcker) ack() {
+	if err := a.msg.Ack(); err != nil {
+		log.Printf("Error acknowledging message %s: %v", a.msg.Subject(), err)
+	}
+}
+
+func (a jsAcker) retry(delay time.Duration) {
+	if err := a.msg.NakWithDelay(delay); err != nil {
+		log.Printf("Error rejecting message %s: %v", a.msg.Subject(), err)
+	}
+}
+
+func (a jsAcker) attempts() int {
+	meta, err := a.msg.Metadata()
+	if err != nil {
+		return 1
+	}
+	return int(meta.NumDelivered)
+}
+
+type coreAcker struct {
+	consumer  *consumer
+	msg       *natsgo.Msg
+	delivered int
+}
+
+func (a *coreAcker) ack() {}
+
+func (a *coreAcker) retry(delay time.Duration) {
+	time.AfterFunc(delay, func() {
+		a.consumer.dispatch(a.msg.Subject, a.msg.Header, a.msg.Data, a)
+	})
+}
+
+func (a *coreAcker) attempts() int {
+	return a.delivered
+}
+
+// dispatch decodes a message and hands it to a worker
+func (c *consumer) dispatch(subject string, header natsgo.Header, data []byte, a acker) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.stopped {
+		// Left unacknowledged, JetStream redelivers it to another consumer
+		return
+	}
+
+	if core, ok := a.(*coreAcker); ok {
+		core.delivered++
+	}
+
+	meta, err := readMeta(header)
+	if err != nil {
+		log.Printf("Error reading message metadata: %v", err)
+		c.deadLetter(subject, meta, data, a, a.attempts(), err)
+		return
+	}
+	if meta.RoutingKey == "" {
+		meta.RoutingKey = c.client.routingKey(subject)
+	}
+
+	// Subject filters are wider than # bindings, messages addressed to the
+	// queue itself always match
+	if subject != c.client.replaySubject(c.queueName) && !c.matches(meta.RoutingKey) {
+		a.ack()
+		return
+	}
+
+	msg, err := broker.Decode(data, meta, c.opts.Raw)
+	if err != nil {
+		log.Printf("Error unmarshaling message: %v", err)
+		// A body that cannot be decoded will never succeed, skip the retries
+		c.fail(subject, meta, data, a, broker.Permanent(err))
+		return
+	}
+
+	delivery := broker.Delivery{
+		Metadata: meta,
+		Message:  msg,
+		Body:     data,
+	}
+	job := func() {
+		c.handle(subject, delivery, a)
+	}
+	if !c.workers.Submit(context.Background(), c.opts.Key(delivery), job) {
+		log.Printf("Consumer %s stopped before handling message", c.queueName)
+	}
+}
+
+// handle runs the handler for a single message and acknowledges it
+func (c *consumer) handle(subject string, delivery broker.Delivery, a acker) {
+	if err := c.handler(delivery); err != nil {
+		log.Printf("Error handling message from %s: %v", c.queueName, err)
+		c.fail(subject, delivery.Metadata, delivery.Body, a, err)
+		return
+	}
+
+	a.ack()
+	log.Printf("Successfully processed and acknowledged message from %s", c.queueName)
+}
+
+// fail schedules a retry of a message, or dead-letters it once its attempts
+// are used up
+func (c *consumer) fail(subject string, meta broker.Metadata, data []byte, a acker, cause error) {
+	attempts := a.attempts()
+
+	if attempts >= c.opts.MaxAttempts || errors.Is(cause, broker.ErrPermanent) {
+		log.Printf("Dead-lettering message from %s after %d attempts: %v", c.queueName, attempts, cause)
+		c.deadLetter(subject, meta, data, a, attempts, cause)
+		return
+	}
+
+	log.Printf("Retrying message from %s in %v (attempt %d/%d): %v", c.queueName, c.opts.RetryDelay, attempts, c.opts.MaxAttempts, cause)
+	a.retry(c.opts.RetryDelay)
+}
+
+// deadLetter acknowledges a message once it is stored as a dead letter. A
+// message that cannot be stored is redelivered and dead-lettered again.
+func (c *consumer) deadLetter(subject string, meta broker.Metadata, data []byte, a acker, attempts int, cause error) {
+	if err := c.client.deadLetter(c.queueName, subject, meta, data, attempts, cause); err != nil {
+		log.Printf("Error dead-lettering message, retrying in %v: %v", deadLetterRetryDelay, err)
+		a.retry(deadLetterRetryDelay)
+		return
+	}
+	a.ack()
+}
+
+func (c *consumer) matches(routingKey string) bool {
+	for _, pattern := range c.routingKeys {
+		if broker.MatchRoutingKey(pattern, routingKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// subjectFilters maps routing key patterns to subject filters. JetStream
+// rejects consumers whose filters overlap, so filters that share a subject
+// are merged into one covering both, and messages are matched against the
+// routing key patterns again once received.
+func (c *Client) subjectFilters(patterns []string) []string {
+	var filters []string
+	for _, pattern := range patterns {
+		filter := c.subjectFilter(pattern)
+		// A merged filter is wider and may now overlap another one
+		for merged := true; merged; {
+			merged = false
+			for i, f := range filters {
+				if filtersCollide(filter, f) {
+					filter = mergeFilters(filter, f)
+					filters = append(filters[:i], filters[i+1:]...)
+					merged = true
+					break
+				}
+			}
+		}
+		filters = append(filters, filter)
+	}
+	return filters
+}
+
+// filtersCollide reports whether some subject is matched by both a and b
+func filtersCollide(a, b string) bool {
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] == ">" || bs[i] == ">" {
+			return true
+		}
+		if as[i] != "*" && bs[i] != "*" && as[i] != bs[i] {
+			return false
+		}
+	}
+	return len(as) == len(bs)
+}
+
+// mergeFilters returns the narrowest filter of this shape covering both a
+// and b, which must collide: words they disagree on become *, and > wins
+// over anything
+func mergeFilters(a, b string) string {
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+	var words []string
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		switch {
+		case as[i] == ">" || bs[i] == ">":
+			return strings.Join(append(words, ">"), ".")
+		case as[i] == bs[i]:
+			words = append(words, as[i])
+		default:
+			words = append(words, "*")
+		}
+	}
+	return strings.Join(words, ".")
+}
+
+// Shutdown stops receiving new messages, lets the messages already received
+// finish and be acknowledged, and returns once the consumer has fully stopped
+// or ctx expires. JetStream redelivers what is still unacknowledged by then
+// to the other consumers of the queue once the ack wait passes.
+func (c *consumer) Shutdown(ctx context.Context) error {
+	c.stop()
+
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("consumer for queue %s did not drain: %w", c.queueName, ctx.Err())
+	}
+}
+
+// Done is closed once the consumer has stopped and its handlers have returned
+func (c *consumer) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *consumer) stop() {
+	c.stopOnce.Do(func() {
+		if c.consumeCtx != nil {
+			c.consumeCtx.Stop()
+		}
+		c.unsubscribe()
+
+		go func() {
+			c.mu.Lock()
+			c.stopped = true
+			c.mu.Unlock()
+
+			c.workers.Close()
+			close(c.done)
+			log.Printf("Consumer for queue %s has fully stopped", c.queueName)
+		}()
+	})
+}
+
+func (c *consumer) unsubscribe() {
+	for _, sub := range c.subs {
+		if err := sub.Unsubscribe(); err != nil && !errors.Is(err, natsgo.ErrConnectionClosed) {
+			log.Printf("Failed to unsubscribe consumer %s: %v", c.queueName, err)
+		}
+	}
+}
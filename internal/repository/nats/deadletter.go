@@ -0,0 +1,133 @@
+package nats
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/Gaoey/scale-websocket/internal/repository/broker"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// deadLetter stores a message in the dead-letter stream under the subject of
+// its queue
+func (c *Client) deadLetter(queueName, subject string, meta broker.Metadata, body []byte, attempts int, cause error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if meta.RoutingKey == "" {
+		meta.RoutingKey = c.routingKey(subject)
+	}
+
+	msg, err := newMsg(c.deadSubject(queueName), meta, body)
+	if err != nil {
+		return fmt.Errorf("failed to dead-letter message from %s: %w", queueName, err)
+	}
+	msg.Header.Set(headerAttempts, strconv.Itoa(attempts))
+	msg.Header.Set(headerReason, cause.Error())
+	msg.Header.Set(headerFailedAt, time.Now().UTC().Format(time.RFC3339Nano))
+
+	if _, err := c.js.PublishMsg(ctx, msg); err != nil {
+		return fmt.Errorf("failed to dead-letter message from %s: %w", queueName, err)
+	}
+	return nil
+}
+
+// DeadLetters returns up to limit dead letters of a queue without removing them
+func (c *Client) DeadLetters(ctx context.Context, queueName string, limit int) ([]broker.DeadLetter, error) {
+	msgs, err := c.fetchDeadLetters(ctx, queueName, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	letters := make([]broker.DeadLetter, 0, len(msgs))
+	for _, msg := range msgs {
+		letters = append(letters, toDeadLetter(msg))
+	}
+	return letters, nil
+}
+
+// ReplayDeadLetters republishes up to limit dead letters on the queue's own
+// subject, so only the queue they failed on receives them again
+func (c *Client) ReplayDeadLetters(ctx context.Context, queueName string, limit int) (int, error) {
+	msgs, err := c.fetchDeadLetters(ctx, queueName, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	stream, err := c.js.Stream(ctx, c.deadStreamName())
+	if err != nil {
+		return 0, fmt.Errorf("failed to look up stream %s: %w", c.deadStreamName(), err)
+	}
+
+	replayed := 0
+	for _, m := range msgs {
+		md, err := m.Metadata()
+		if err != nil {
+			return replayed, fmt.Errorf("failed to read dead letter: %w", err)
+		}
+		meta, err := readMeta(m.Headers())
+		if err != nil {
+			return replayed, err
+		}
+
+		msg, err := newMsg(c.replaySubject(queueName), meta, m.Data())
+		if err != nil {
+			return replayed, err
+		}
+		// Keyed by the dead letter, so a replay retried after a failed
+		// delete is not stored twice
+		msgID := fmt.Sprintf("replay.%s.%d", c.deadStreamName(), md.Sequence.Stream)
+		if _, err := c.js.PublishMsg(ctx, msg, jetstream.WithMsgID(msgID)); err != nil {
+			return replayed, fmt.Errorf("failed to replay dead letter: %w", err)
+		}
+		if err := stream.DeleteMsg(ctx, md.Sequence.Stream); err != nil {
+			return replayed, fmt.Errorf("failed to remove replayed dead letter: %w", err)
+		}
+		replayed++
+	}
+
+	log.Printf("Replayed %d dead letters to %s", replayed, queueName)
+	return replayed, nil
+}
+
+// fetchDeadLetters reads up to limit dead letters of a queue, oldest first
+func (c *Client) fetchDeadLetters(ctx context.Context, queueName string, limit int) ([]jetstream.Msg, error) {
+	cons, err := c.js.OrderedConsumer(ctx, c.deadStreamName(), jetstream.OrderedConsumerConfig{
+		FilterSubjects: []string{c.deadSubject(queueName)},
+		DeliverPolicy:  jetstream.DeliverAllPolicy,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dead letters: %w", err)
+	}
+
+	batch, err := cons.FetchNoWait(limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dead letters: %w", err)
+	}
+
+	var msgs []jetstream.Msg
+	for msg := range batch.Messages() {
+		msgs = append(msgs, msg)
+	}
+	if err := batch.Error(); err != nil {
+		return nil, fmt.Errorf("failed to read dead letters: %w", err)
+	}
+	return msgs, nil
+}
+
+func toDeadLetter(msg jetstream.Msg) broker.DeadLetter {
+	meta, _ := readMeta(msg.Headers())
+
+	letter := broker.DeadLetter{
+		MessageID:  meta.MessageID,
+		RoutingKey: meta.RoutingKey,
+		Body:       string(msg.Data()),
+		Reason:     msg.Headers().Get(headerReason),
+	}
+	letter.Attempts, _ = strconv.Atoi(msg.Headers().Get(headerAttempts))
+	letter.FailedAt, _ = time.Parse(time.RFC3339Nano, msg.Headers().Get(headerFailedAt))
+	return letter
+}
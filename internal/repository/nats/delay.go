@@ -0,0 +1,85 @@
+package nats
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// schedulerName is the durable consumer every client shares to release
+// delayed messages, so each is released by one of them only
+const schedulerName = "scheduler"
+
+// startScheduler starts releasing delayed messages. They are stored on the
+// delayed subject of their routing key until due and stay in the stream, so
+// they survive restarts of both this process and the server. A message that
+// is not due yet is handed back to JetStream to be redelivered when it is.
+func (c *Client) startScheduler() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cons, err := c.js.CreateOrUpdateConsumer(ctx, c.streamName, jetstream.ConsumerConfig{
+		Durable:       schedulerName,
+		FilterSubject: c.delayedPrefix() + ".>",
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		DeliverPolicy: jetstream.DeliverAllPolicy,
+		AckWait:       c.ackWait,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to declare scheduler: %w", err)
+	}
+
+	c.scheduler, err = cons.Consume(c.release, jetstream.ConsumeErrHandler(func(_ jetstream.ConsumeContext, err error) {
+		log.Printf("Error consuming delayed messages: %v", err)
+	}))
+	if err != nil {
+		return fmt.Errorf("failed to start scheduler: %w", err)
+	}
+	return nil
+}
+
+// release publishes a delayed message on its routing subject once it is due
+func (c *Client) release(m jetstream.Msg) {
+	deliverAt, err := strconv.ParseInt(m.Headers().Get(headerDeliverAt), 10, 64)
+	if err != nil {
+		log.Printf("Dropping delayed message %s without a delivery time", m.Subject())
+		m.Term()
+		return
+	}
+
+	if wait := time.Until(time.UnixMilli(deliverAt)); wait > 0 {
+		m.NakWithDelay(wait)
+		return
+	}
+
+	meta, err := readMeta(m.Headers())
+	if err != nil {
+		log.Printf("Dropping delayed message %s: %v", m.Subject(), err)
+		m.Term()
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msg, err := newMsg(c.subject(c.routingKey(m.Subject())), meta, m.Data())
+	if err != nil {
+		m.Term()
+		return
+	}
+	// The original message ID lets JetStream drop the copy published again
+	// when the acknowledgement below is lost
+	if _, err := c.js.PublishMsg(ctx, msg, jetstream.WithMsgID(meta.MessageID)); err != nil {
+		log.Printf("Failed to release delayed message %s: %v", meta.MessageID, err)
+		m.NakWithDelay(time.Second)
+		return
+	}
+
+	if err := m.Ack(); err != nil {
+		log.Printf("Error acknowledging delayed message %s: %v", meta.MessageID, err)
+	}
+}
@@ -0,0 +1,294 @@
+package nats
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/Gaoey/scale-websocket/internal/repository/broker"
+	natsgo "github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	defaultMaxAge  = 24 * time.Hour
+	defaultAckWait = 30 * time.Second
+	// deadLetterRetryDelay is how long a message that could not be
+	// dead-lettered waits before it is redelivered
+	deadLetterRetryDelay = time.Second
+)
+
+// Headers carrying broker metadata on NATS messages
+const (
+	headerMeta      = "X-Meta"
+	headerAttempts  = "X-Attempts"
+	headerReason    = "X-Dead-Reason"
+	headerFailedAt  = "X-Failed-At"
+	headerDeliverAt = "X-Deliver-At"
+)
+
+var (
+	_ broker.Broker          = (*Client)(nil)
+	_ broker.BatchPublisher  = (*Client)(nil)
+	_ broker.DeadLetterQueue = (*Client)(nil)
+)
+
+// Client is a broker backed by NATS. Routing keys become subjects under the
+// exchange name, so ws.order.update.42 is published on
+// ws_events.ws.order.update.42 and a binding of ws.order.update.* subscribes
+// to ws_events.ws.order.update.*.
+//
+// Every message is stored in a JetStream stream. Durable queues are durable
+// JetStream consumers named after the queue, which gives at-least-once
+// delivery and competing consumers within a queue. Exclusive and auto-delete
+// queues are plain NATS subscriptions that only see messages published while
+// they are connected.
+type Client struct {
+	nc           *natsgo.Conn
+	js           jetstream.JetStream
+	ExchangeName string
+	streamName   string
+	ackWait      time.Duration
+
+	// scheduler releases delayed messages once they are due
+	scheduler jetstream.ConsumeContext
+	// bindings caches the consumer filters mandatory publishes are checked against
+	bindings bindingsCache
+}
+
+// Config holds the configuration for the NATS broker
+type Config struct {
+	URL          string // e.g. nats://localhost:4222
+	ExchangeName string
+	// StreamName is the JetStream stream holding the messages, derived from
+	// the exchange name when empty (ws_events becomes WS_EVENTS)
+	StreamName string
+	// MaxAge is how long messages are kept in the stream, defaults to 24h
+	MaxAge time.Duration
+	// AckWait is how long a delivery may stay unacknowledged before it is
+	// redelivered, defaults to 30s
+	AckWait time.Duration
+}
+
+// NewClient connects to NATS, declares the JetStream streams and starts the
+// scheduler of delayed messages
+func NewClient(cfg Config) (*Client, error) {
+	if cfg.ExchangeName == "" {
+		return nil, fmt.Errorf("exchange name required")
+	}
+
+	if cfg.StreamName == "" {
+		cfg.StreamName = streamName(cfg.ExchangeName)
+	}
+
+	if cfg.MaxAge <= 0 {
+		cfg.MaxAge = defaultMaxAge
+	}
+
+	if cfg.AckWait <= 0 {
+		cfg.AckWait = defaultAckWait
+	}
+
+	nc, err := natsgo.Connect(cfg.URL,
+		natsgo.MaxReconnects(-1),
+		natsgo.DisconnectErrHandler(func(_ *natsgo.Conn, err error) {
+			log.Printf("NATS connection lost: %v", err)
+		}),
+		natsgo.ReconnectHandler(func(nc *natsgo.Conn) {
+			log.Printf("Reconnected to NATS at %s", nc.ConnectedUrl())
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("failed to open JetStream context: %w", err)
+	}
+
+	client := &Client{
+		nc:           nc,
+		js:           js,
+		ExchangeName: cfg.ExchangeName,
+		streamName:   cfg.StreamName,
+		ackWait:      cfg.AckWait,
+	}
+
+	if err := client.declareStreams(cfg.MaxAge); err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	if err := client.watchBindings(); err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	if err := client.startScheduler(); err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	log.Printf("Connected to NATS at %s", nc.ConnectedUrl())
+	return client, nil
+}
+
+// declareStreams declares the stream of routed, replayed and delayed
+// messages and the stream of dead letters, which is kept without age limit
+func (c *Client) declareStreams(maxAge time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := c.js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name: c.streamName,
+		Subjects: []string{
+			c.ExchangeName + ".>",
+			c.replayPrefix() + ".>",
+			c.delayedPrefix() + ".>",
+		},
+		Storage: jetstream.FileStorage,
+		MaxAge:  maxAge,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to declare stream %s: %w", c.streamName, err)
+	}
+
+	_, err = c.js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:     c.deadStreamName(),
+		Subjects: []string{c.deadPrefix() + ".>"},
+		Storage:  jetstream.FileStorage,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to declare stream %s: %w", c.deadStreamName(), err)
+	}
+	return nil
+}
+
+// Close stops the scheduler and closes the connection. Deliveries that are
+// still unacknowledged are redelivered to the other consumers of their queue.
+func (c *Client) Close() error {
+	if c.scheduler != nil {
+		c.scheduler.Stop()
+	}
+	c.nc.Close()
+	return nil
+}
+
+// streamName derives a stream name from an exchange name, which may contain
+// characters stream names cannot
+func streamName(exchange string) string {
+	return strings.ToUpper(sanitize(exchange))
+}
+
+// sanitize replaces the characters that are not allowed in stream and
+// consumer names
+func sanitize(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ' ', '\t', '/', '\\':
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+func (c *Client) deadStreamName() string {
+	return c.streamName + "_DEAD"
+}
+
+// subject is the subject a routing key is published on
+func (c *Client) subject(routingKey string) string {
+	return c.ExchangeName + "." + routingKey
+}
+
+func (c *Client) replayPrefix() string {
+	return c.ExchangeName + "_replay"
+}
+
+func (c *Client) deadPrefix() string {
+	return c.ExchangeName + "_dead"
+}
+
+func (c *Client) delayedPrefix() string {
+	return c.ExchangeName + "_delayed"
+}
+
+// replaySubject receives messages addressed to a single queue, such as
+// replayed dead letters
+func (c *Client) replaySubject(queueName string) string {
+	return c.replayPrefix() + "." + queueName
+}
+
+// deadSubject holds the dead letters of a queue
+func (c *Client) deadSubject(queueName string) string {
+	return c.deadPrefix() + "." + queueName
+}
+
+// routingKey recovers the routing key from a subject
+func (c *Client) routingKey(subject string) string {
+	for _, prefix := range []string{c.ExchangeName, c.delayedPrefix()} {
+		if strings.HasPrefix(subject, prefix+".") {
+			return strings.TrimPrefix(subject, prefix+".")
+		}
+	}
+	return subject
+}
+
+// subjectFilter turns a routing key pattern into a subject filter. The *
+// wildcard means the same in both, # becomes > which NATS only allows at the
+// end, so anything after it is dropped and messages are matched against the
+// routing key pattern again once received.
+func (c *Client) subjectFilter(pattern string) string {
+	words := strings.Split(pattern, ".")
+	for i, word := range words {
+		if word == "#" {
+			words = append(words[:i], ">")
+			break
+		}
+	}
+	return c.ExchangeName + "." + strings.Join(words, ".")
+}
+
+// subjectMatches reports whether a subject filter covers subject
+func subjectMatches(filter, subject string) bool {
+	fs := strings.Split(filter, ".")
+	ss := strings.Split(subject, ".")
+	for i, f := range fs {
+		if f == ">" {
+			return len(ss) > i
+		}
+		if i >= len(ss) || (f != "*" && f != ss[i]) {
+			return false
+		}
+	}
+	return len(fs) == len(ss)
+}
+
+// newMsg builds a NATS message carrying meta in its headers
+func newMsg(subject string, meta broker.Metadata, body []byte) (*natsgo.Msg, error) {
+	encodedMeta, err := json.Marshal(meta)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal metadata: %w", err)
+	}
+
+	msg := natsgo.NewMsg(subject)
+	msg.Header.Set(headerMeta, string(encodedMeta))
+	msg.Data = body
+	return msg, nil
+}
+
+// readMeta reads the metadata of a message back from its headers
+func readMeta(header natsgo.Header) (broker.Metadata, error) {
+	var meta broker.Metadata
+	if encoded := header.Get(headerMeta); encoded != "" {
+		if err := json.Unmarshal([]byte(encoded), &meta); err != nil {
+			return meta, fmt.Errorf("invalid metadata header: %w", err)
+		}
+	}
+	return meta, nil
+}
@@ -0,0 +1,339 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Gaoey/scale-websocket/internal/repository/broker"
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+// runServer starts an in-process NATS server with JetStream enabled
+func runServer(t *testing.T) string {
+	t.Helper()
+
+	ns, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server did not start")
+	}
+	t.Cleanup(ns.Shutdown)
+	return ns.ClientURL()
+}
+
+func newTestClient(t *testing.T, url string, cfg Config) *Client {
+	t.Helper()
+
+	cfg.URL = url
+	if cfg.ExchangeName == "" {
+		cfg.ExchangeName = "test"
+	}
+	client, err := NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func receive(t *testing.T, ch <-chan broker.Delivery) broker.Delivery {
+	t.Helper()
+	select {
+	case d := <-ch:
+		return d
+	case <-time.After(10 * time.Second):
+		t.Fatal("no message received")
+		return broker.Delivery{}
+	}
+}
+
+func TestSubjectFilters(t *testing.T) {
+	c := &Client{ExchangeName: "ws"}
+
+	tests := []struct {
+		patterns []string
+		want     []string
+	}{
+		{[]string{"a.b"}, []string{"ws.a.b"}},
+		{[]string{"a.b", "c.d"}, []string{"ws.a.b", "ws.c.d"}},
+		{[]string{"a.b", "a.*"}, []string{"ws.a.*"}},
+		{[]string{"a.*", "a.#"}, []string{"ws.a.>"}},
+		{[]string{"a.#.z", "a.b"}, []string{"ws.a.>"}},
+		{[]string{"a.b", "a.b.c"}, []string{"ws.a.b", "ws.a.b.c"}},
+		// Overlap without either covering the other
+		{[]string{"a.*.c", "a.b.*"}, []string{"ws.a.*.*"}},
+		// The merged filter overlaps one that was kept before
+		{[]string{"a.b.c", "a.*.d", "a.b.*"}, []string{"ws.a.*.*"}},
+	}
+
+	for _, tt := range tests {
+		if got := c.subjectFilters(tt.patterns); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("subjectFilters(%v) = %v, want %v", tt.patterns, got, tt.want)
+		}
+	}
+}
+
+func TestOverlappingBindings(t *testing.T) {
+	client := newTestClient(t, runServer(t), Config{})
+	ctx := context.Background()
+
+	got := make(chan broker.Delivery, 10)
+	cons, err := client.StartConsumer(ctx, "q", []string{"orders.*.eu", "orders.new.*"}, func(d broker.Delivery) error {
+		got <- d
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cons.Shutdown(ctx)
+
+	for _, key := range []string{"orders.old.us", "orders.new.us", "orders.old.eu"} {
+		if err := client.Publish(ctx, key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The merged filter also passes orders.old.us, which the consumer drops
+	for _, want := range []string{"orders.new.us", "orders.old.eu"} {
+		if d := receive(t, got); d.RoutingKey != want {
+			t.Fatalf("received %s, want %s", d.RoutingKey, want)
+		}
+	}
+}
+
+func TestMandatoryIsCheckedBeforeStoring(t *testing.T) {
+	url := runServer(t)
+	publisher := newTestClient(t, url, Config{})
+	ctx := context.Background()
+
+	err := publisher.Publish(ctx, "orders.new", 1, broker.WithMandatory())
+	if !errors.Is(err, broker.ErrUnroutable) {
+		t.Fatalf("got %v, want %v", err, broker.ErrUnroutable)
+	}
+	stream, err := publisher.js.Stream(ctx, publisher.streamName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := stream.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.State.Msgs != 0 {
+		t.Fatalf("stream stored %d unroutable messages", info.State.Msgs)
+	}
+
+	// A queue declared on another node is picked up through its advisory
+	other := newTestClient(t, url, Config{})
+	cons, err := other.StartConsumer(ctx, "q", []string{"orders.*"}, func(broker.Delivery) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cons.Shutdown(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err := publisher.Publish(ctx, "orders.new", 1, broker.WithMandatory())
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, broker.ErrUnroutable) || time.Now().After(deadline) {
+			t.Fatalf("publish after the queue was declared: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRedeliversUnackedMessages(t *testing.T) {
+	url := runServer(t)
+	ctx := context.Background()
+
+	// The first node takes the message and goes away without acking it
+	crashed := newTestClient(t, url, Config{AckWait: time.Second})
+	taken := make(chan struct{})
+	hang := make(chan struct{})
+	defer close(hang)
+	if _, err := crashed.StartConsumer(ctx, "q", []string{"orders.*"}, func(broker.Delivery) error {
+		close(taken)
+		<-hang
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := crashed.Publish(ctx, "orders.new", "once", broker.WithMessageID("m1")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-taken:
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was not delivered")
+	}
+	crashed.Close()
+
+	client := newTestClient(t, url, Config{AckWait: time.Second})
+	got := make(chan broker.Delivery, 1)
+	cons, err := client.StartConsumer(ctx, "q", []string{"orders.*"}, func(d broker.Delivery) error {
+		got <- d
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cons.Shutdown(ctx)
+
+	if d := receive(t, got); d.MessageID != "m1" {
+		t.Fatalf("redelivered %s, want m1", d.MessageID)
+	}
+}
+
+func TestSchedulerRelease(t *testing.T) {
+	client := newTestClient(t, runServer(t), Config{})
+	ctx := context.Background()
+
+	got := make(chan broker.Delivery, 1)
+	cons, err := client.StartConsumer(ctx, "q", []string{"orders.*"}, func(d broker.Delivery) error {
+		got <- d
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cons.Shutdown(ctx)
+
+	start := time.Now()
+	if err := client.Publish(ctx, "orders.new", "later", broker.WithDelay(time.Second), broker.WithMessageID("m1")); err != nil {
+		t.Fatal(err)
+	}
+
+	d := receive(t, got)
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Fatalf("delivered after %v", elapsed)
+	}
+	if d.MessageID != "m1" || d.RoutingKey != "orders.new" {
+		t.Fatalf("unexpected delivery %+v", d.Metadata)
+	}
+}
+
+func TestDeadLetterReplay(t *testing.T) {
+	client := newTestClient(t, runServer(t), Config{})
+	ctx := context.Background()
+
+	var healthy atomic.Bool
+	got := make(chan broker.Delivery, 1)
+	cons, err := client.StartConsumer(ctx, "q", []string{"orders.*"}, func(d broker.Delivery) error {
+		if !healthy.Load() {
+			return errors.New("boom")
+		}
+		got <- d
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cons.Shutdown(ctx)
+
+	// Bound by another queue too, which must not see the replay
+	other := make(chan broker.Delivery, 2)
+	otherCons, err := client.StartConsumer(ctx, "other", []string{"orders.*"}, func(d broker.Delivery) error {
+		other <- d
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer otherCons.Shutdown(ctx)
+
+	if err := client.Publish(ctx, "orders.new", "x", broker.WithMessageID("m1")); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, other)
+
+	var letters []broker.DeadLetter
+	for deadline := time.Now().Add(5 * time.Second); len(letters) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("message was not dead-lettered")
+		}
+		if letters, err = client.DeadLetters(ctx, "q", 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if letters[0].MessageID != "m1" || letters[0].Reason != "boom" || letters[0].RoutingKey != "orders.new" {
+		t.Fatalf("unexpected dead letter %+v", letters[0])
+	}
+
+	healthy.Store(true)
+	n, err := client.ReplayDeadLetters(ctx, "q", 10)
+	if err != nil || n != 1 {
+		t.Fatalf("replayed %d: %v", n, err)
+	}
+	if d := receive(t, got); d.MessageID != "m1" {
+		t.Fatalf("replayed %s, want m1", d.MessageID)
+	}
+
+	if letters, err = client.DeadLetters(ctx, "q", 10); err != nil || len(letters) != 0 {
+		t.Fatalf("dead letters left after replay: %v, %v", letters, err)
+	}
+	select {
+	case d := <-other:
+		t.Fatalf("replay reached another queue: %+v", d.Metadata)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestFailedDeadLetterIsRedelivered(t *testing.T) {
+	client := newTestClient(t, runServer(t), Config{})
+	ctx := context.Background()
+
+	var calls atomic.Int32
+	cons, err := client.StartConsumer(ctx, "q", []string{"orders.*"}, func(d broker.Delivery) error {
+		calls.Add(1)
+		return broker.Permanent(errors.New("boom"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cons.Shutdown(ctx)
+
+	// Nowhere to store dead letters
+	if err := client.js.DeleteStream(ctx, client.deadStreamName()); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Publish(ctx, "orders.new", "x", broker.WithMessageID("m1")); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); calls.Load() < 2; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("message was not redelivered after dead-lettering failed")
+		}
+	}
+
+	if err := client.declareStreams(defaultMaxAge); err != nil {
+		t.Fatal(err)
+	}
+	var letters []broker.DeadLetter
+	for deadline := time.Now().Add(5 * time.Second); len(letters) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("message was not dead-lettered once the stream was back")
+		}
+		if letters, err = client.DeadLetters(ctx, "q", 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(letters) != 1 || letters[0].MessageID != "m1" {
+		t.Fatalf("unexpected dead letters %+v", letters)
+	}
+}
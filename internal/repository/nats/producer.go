@@ -0,0 +1,139 @@
+package nats
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/Gaoey/scale-websocket/internal/repository/broker"
+	natsgo "github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Publish stores the message in the stream and waits for JetStream to
+// acknowledge it. The message ID doubles as the JetStream deduplication ID,
+// so a retried publish within the stream's duplicate window is stored once.
+// Mandatory publishes fail with broker.ErrUnroutable, and are not stored, when
+// no durable queue is bound to the routing key.
+func (c *Client) Publish(ctx context.Context, routingKey string, msg broker.Message, opts ...broker.PublishOption) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	options := broker.NewPublishOptions(opts...)
+	meta := options.Metadata
+	meta.RoutingKey = routingKey
+
+	body, err := broker.Encode(msg, &meta)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	if broker.IsJSON(meta.ContentType) {
+		log.Printf("Publishing message to routing key %s: %s", routingKey, body)
+	} else {
+		log.Printf("Publishing %d byte %s message to routing key %s", len(body), meta.ContentType, routingKey)
+	}
+
+	m, msgID, err := c.outgoing(meta, body, options)
+	if err != nil {
+		return err
+	}
+
+	if options.Mandatory && options.Delay() <= 0 {
+		routable, err := c.routable(ctx, m.Subject)
+		if err != nil {
+			return err
+		}
+		if !routable {
+			return &broker.UnroutableError{RoutingKey: routingKey, Reason: "NO_ROUTE"}
+		}
+	}
+
+	if _, err := c.js.PublishMsg(ctx, m, jetstream.WithMsgID(msgID)); err != nil {
+		return fmt.Errorf("failed to publish message: %w", err)
+	}
+	return nil
+}
+
+// PublishBatch publishes msgs without waiting in between and then waits for
+// all of their acknowledgements, reporting the outcome of each message
+func (c *Client) PublishBatch(ctx context.Context, msgs []broker.BatchMessage) []error {
+	errs := make([]error, len(msgs))
+	futures := make([]jetstream.PubAckFuture, len(msgs))
+
+	for i, m := range msgs {
+		if ctx.Err() != nil {
+			errs[i] = ctx.Err()
+			continue
+		}
+
+		options := broker.NewPublishOptions(m.Options...)
+		meta := options.Metadata
+		meta.RoutingKey = m.RoutingKey
+
+		body, err := broker.Encode(m.Message, &meta)
+		if err != nil {
+			errs[i] = fmt.Errorf("failed to marshal message: %w", err)
+			continue
+		}
+
+		out, msgID, err := c.outgoing(meta, body, options)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		if options.Mandatory && options.Delay() <= 0 {
+			routable, err := c.routable(ctx, out.Subject)
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			if !routable {
+				errs[i] = &broker.UnroutableError{RoutingKey: m.RoutingKey, Reason: "NO_ROUTE"}
+				continue
+			}
+		}
+
+		futures[i], err = c.js.PublishMsgAsync(out, jetstream.WithMsgID(msgID))
+		if err != nil {
+			errs[i] = fmt.Errorf("failed to publish message: %w", err)
+		}
+	}
+
+	log.Printf("Publishing batch of %d messages", len(msgs))
+
+	for i, future := range futures {
+		if future == nil {
+			continue
+		}
+
+		select {
+		case <-future.Ok():
+		case err := <-future.Err():
+			errs[i] = fmt.Errorf("failed to publish message: %w", err)
+		case <-ctx.Done():
+			errs[i] = fmt.Errorf("waiting for publish acknowledgement: %w", ctx.Err())
+		}
+	}
+	return errs
+}
+
+// outgoing builds the NATS message for a publish and the ID JetStream
+// deduplicates it by. Delayed messages go to the holding subject under a
+// separate ID, so releasing them later is not taken for a duplicate.
+func (c *Client) outgoing(meta broker.Metadata, body []byte, options broker.PublishOptions) (*natsgo.Msg, string, error) {
+	if options.Delay() <= 0 {
+		m, err := newMsg(c.subject(meta.RoutingKey), meta, body)
+		return m, meta.MessageID, err
+	}
+
+	m, err := newMsg(c.delayedPrefix()+"."+meta.RoutingKey, meta, body)
+	if err != nil {
+		return nil, "", err
+	}
+	m.Header.Set(headerDeliverAt, strconv.FormatInt(options.DeliverAt.UnixMilli(), 10))
+	return m, "delayed." + meta.MessageID, nil
+}
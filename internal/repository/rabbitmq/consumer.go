@@ -2,53 +2,197 @@ package rabbitmq
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
 	"sync"
+	"time"
+
+	"github.com/Gaoey/scale-websocket/internal/repository/broker"
+	"github.com/streadway/amqp"
 )
 
 // ConsumeFunc is a callback function type for consuming messages
-type ConsumeFunc func(Message) error
+type ConsumeFunc = broker.ConsumeFunc
+
+// consumer is a running consumer registration. It is registered again on
+// every reconnect until it is shut down or its context is cancelled.
+type consumer struct {
+	client      *Client
+	queueName   string
+	routingKeys []string
+	handler     ConsumeFunc
+	opts        broker.ConsumerOptions
+	tag         string
+	workers     *broker.WorkerPool
+	// raw, when set, takes the deliveries undecoded in place of handler and
+	// settles them itself
+	raw func(d amqp.Delivery)
+
+	mu sync.Mutex
+	// channel is the channel the consumer tag is currently registered on
+	channel *amqp.Channel
+
+	stopping chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
 
-// Consume starts consuming messages from a queue with the given routing keys
-func (c *Client) StartConsumer(ctx context.Context, queueName string, routingKeys []string, handler ConsumeFunc) error {
+// Consume starts consuming messages from a queue with the given routing keys.
+// The queue declaration, bindings and consumer are registered again on every
+// reconnect until ctx is cancelled or the returned consumer is shut down.
+func (c *Client) StartConsumer(ctx context.Context, queueName string, routingKeys []string, handler ConsumeFunc, opts ...broker.ConsumerOption) (broker.Consumer, error) {
 	log.Printf("Starting consumer for queue: %s with routing keys: %v", queueName, routingKeys)
 
+	options := broker.NewConsumerOptions(opts...)
+
+	cons := &consumer{
+		client:      c,
+		queueName:   queueName,
+		routingKeys: routingKeys,
+		handler:     options.Wrap(handler),
+		opts:        options,
+		tag:         fmt.Sprintf("%s.%s", queueName, broker.NewMessageID()),
+		stopping:    make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+
+	msgs, reconnected, err := cons.subscribe()
+	if err != nil {
+		return nil, err
+	}
+
+	cons.workers = broker.NewWorkerPool(options.Workers)
+
+	go cons.run(ctx, msgs, reconnected)
+
+	return cons, nil
+}
+
+// run consumes until ctx is cancelled, the consumer is shut down or the client
+// is closed, then waits for the handlers still in flight
+func (c *consumer) run(ctx context.Context, msgs <-chan amqp.Delivery, reconnected <-chan struct{}) {
+	defer close(c.done)
+	defer log.Printf("Consumer for queue %s has fully stopped", c.queueName)
+	defer c.workers.Close()
+
+	// Stop the broker from pushing more deliveries however the loop ends
+	defer c.stop()
+
+	for {
+		if !c.consume(ctx, msgs) {
+			log.Println("RabbitMQ consumer stopped for queue:", c.queueName)
+			return
+		}
+
+		log.Printf("RabbitMQ channel closed for queue %s, waiting for reconnect", c.queueName)
+		msgs, reconnected = c.resubscribe(ctx, reconnected)
+		if msgs == nil {
+			return
+		}
+	}
+}
+
+// Shutdown cancels the consumer tag so the broker stops sending deliveries,
+// lets the deliveries already received finish and be acknowledged, and
+// returns once the consumer has fully stopped or ctx expires. Deliveries that
+// are still unacknowledged by then are redelivered when the client closes.
+func (c *consumer) Shutdown(ctx context.Context) error {
+	c.stop()
+
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("consumer for queue %s did not drain: %w", c.queueName, ctx.Err())
+	}
+}
+
+// stop marks the consumer as stopping and cancels its consumer tag
+func (c *consumer) stop() {
+	c.stopOnce.Do(func() {
+		close(c.stopping)
+
+		c.mu.Lock()
+		channel := c.channel
+		c.mu.Unlock()
+
+		if c.client.isClosed() {
+			return
+		}
+		if err := channel.Cancel(c.tag, false); err != nil {
+			log.Printf("Failed to cancel consumer %s: %v", c.tag, err)
+		}
+	})
+}
+
+// Done is closed once the consumer has fully stopped
+func (c *consumer) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *consumer) isStopping() bool {
+	select {
+	case <-c.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// subscribe declares the queue, binds it to the exchange and registers the
+// consumer tag on the current channel. It also returns the signal that fires
+// once that channel has been replaced.
+func (c *consumer) subscribe() (<-chan amqp.Delivery, <-chan struct{}, error) {
+	channel, reconnected := c.client.current()
+
 	// Declare a queue
-	q, err := c.channel.QueueDeclare(
-		queueName, // queue name
-		true,      // durable
-		false,     // delete when unused
-		false,     // exclusive
-		false,     // no-wait
-		nil,       // arguments
+	q, err := channel.QueueDeclare(
+		c.queueName,                                // queue name
+		c.opts.QueueMode == broker.QueueDurable,    // durable
+		c.opts.QueueMode == broker.QueueAutoDelete, // delete when unused
+		c.opts.QueueMode == broker.QueueExclusive,  // exclusive
+		false,                            // no-wait
+		expiresArgs(c.opts.QueueExpires), // arguments
 	)
 	if err != nil {
-		return fmt.Errorf("failed to declare a queue: %w", err)
+		return nil, nil, fmt.Errorf("failed to declare a queue: %w", err)
 	}
 
 	log.Printf("Queue declared: %s", q.Name)
 
+	// A raw consumer settles its deliveries itself and never retries them
+	if c.raw == nil {
+		if err := declareRetryTopology(channel, q.Name, c.opts); err != nil {
+			return nil, nil, err
+		}
+	}
+
 	// Bind the queue to the exchange with the specified routing keys
-	for _, key := range routingKeys {
-		err = c.channel.QueueBind(
-			q.Name,         // queue name
-			key,            // routing key
-			c.ExchangeName, // exchange
-			false,          // no-wait
-			nil,            // arguments
+	for _, key := range c.routingKeys {
+		err = channel.QueueBind(
+			q.Name,                // queue name
+			key,                   // routing key
+			c.client.ExchangeName, // exchange
+			false,                 // no-wait
+			nil,                   // arguments
 		)
 		if err != nil {
-			return fmt.Errorf("failed to bind a queue: %w", err)
+			return nil, nil, fmt.Errorf("failed to bind a queue: %w", err)
+		}
+		log.Printf("Bound queue %s to exchange %s with routing key %s", q.Name, c.client.ExchangeName, key)
+	}
+
+	// Limit unacknowledged deliveries for the consumer registered below
+	if c.opts.Prefetch > 0 {
+		if err := channel.Qos(c.opts.Prefetch, 0, false); err != nil {
+			return nil, nil, fmt.Errorf("failed to set prefetch: %w", err)
 		}
-		log.Printf("Bound queue %s to exchange %s with routing key %s", q.Name, c.ExchangeName, key)
 	}
 
 	// Set up the consumer
-	msgs, err := c.channel.Consume(
+	msgs, err := channel.Consume(
 		q.Name, // queue
-		"",     // consumer tag
+		c.tag,  // consumer tag
 		false,  // auto-ack
 		false,  // exclusive
 		false,  // no-local
@@ -56,66 +200,128 @@ func (c *Client) StartConsumer(ctx context.Context, queueName string, routingKey
 		nil,    // args
 	)
 	if err != nil {
-		return fmt.Errorf("failed to register a consumer: %w", err)
+		return nil, nil, fmt.Errorf("failed to register a consumer: %w", err)
 	}
 
 	log.Printf("Registered consumer for queue: %s", q.Name)
 
-	// Use a waitgroup to keep the consumer goroutine running
-	var wg sync.WaitGroup
-	wg.Add(1)
-
-	// Create a new context that's cancelled when the parent context is
-	consumerCtx, cancel := context.WithCancel(ctx)
-
-	go func() {
-		defer wg.Done()
-		defer log.Println("RabbitMQ consumer stopped for queue:", queueName)
-		defer cancel() // Ensure context is cancelled when goroutine exits
-
-		for {
-			select {
-			case <-consumerCtx.Done():
-				log.Printf("Context cancelled for consumer %s", queueName)
-				return
-			case d, ok := <-msgs:
-				if !ok {
-					log.Printf("RabbitMQ channel closed for queue %s", queueName)
-					return
-				}
+	c.mu.Lock()
+	c.channel = channel
+	c.mu.Unlock()
 
-				var msg Message
-				err := json.Unmarshal(d.Body, &msg)
-				if err != nil {
-					log.Printf("Error unmarshaling message: %v", err)
-					d.Nack(false, false) // Negative acknowledgement, don't requeue
-					continue
-				}
+	return msgs, reconnected, nil
+}
 
-				err = handler(msg)
-				if err != nil {
-					log.Printf("Error handling message from %s: %v", queueName, err)
-					d.Nack(false, false) // Negative acknowledgement, requeue
-					continue
-				}
+// resubscribe waits for the client to reconnect and registers the consumer
+// again. It returns nil once ctx is cancelled, the consumer is shut down or
+// the client is closed.
+func (c *consumer) resubscribe(ctx context.Context, reconnected <-chan struct{}) (<-chan amqp.Delivery, <-chan struct{}) {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, nil
+		case <-c.stopping:
+			return nil, nil
+		case <-c.client.done:
+			return nil, nil
+		case <-reconnected:
+		}
+
+		msgs, next, err := c.subscribe()
+		if err == nil {
+			return msgs, next
+		}
 
-				// Acknowledge messageno clients connected
-				err = d.Ack(false)
-				if err != nil {
-					log.Printf("Error acknowledging message from %s: %v", queueName, err)
-				} else {
-					log.Printf("Successfully processed and acknowledged message from %s", queueName)
+		log.Printf("Failed to re-register consumer for queue %s: %v", c.queueName, err)
+		_, reconnected = c.client.current()
+	}
+}
+
+// consume dispatches deliveries to the worker pool until the delivery channel
+// is closed by a connection loss, in which case it returns true, or until ctx
+// is cancelled, the consumer is shut down or the client is closed, in which
+// case it returns false
+func (c *consumer) consume(ctx context.Context, msgs <-chan amqp.Delivery) bool {
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("Context cancelled for consumer %s", c.queueName)
+			return false
+		case d, ok := <-msgs:
+			if !ok {
+				// Shutdown cancels the consumer tag, which also closes msgs
+				return !c.client.isClosed() && !c.isStopping()
+			}
+
+			if c.raw != nil {
+				if !c.workers.Submit(ctx, "", func() { c.raw(d) }) {
+					d.Nack(false, true)
+					return false
 				}
+				continue
+			}
+
+			delivery := toDelivery(d)
+			msg, err := broker.Decode(d.Body, delivery.Metadata, c.opts.Raw)
+			if err != nil {
+				log.Printf("Error unmarshaling message: %v", err)
+				// A body that cannot be decoded will never succeed, skip the retries
+				c.client.fail(c.queueName, d, broker.ConsumerOptions{MaxAttempts: 1}, err)
+				continue
+			}
+			delivery.Message = msg
+
+			job := func() {
+				c.handle(d, delivery)
+			}
+			if !c.workers.Submit(ctx, c.opts.Key(delivery), job) {
+				log.Printf("Context cancelled for consumer %s", c.queueName)
+				d.Nack(false, true) // Hand the delivery back, it was never handled
+				return false
 			}
 		}
-	}()
+	}
+}
+
+// handle runs the handler for a single delivery and acknowledges it
+func (c *consumer) handle(d amqp.Delivery, delivery broker.Delivery) {
+	err := c.handler(delivery)
+	if err != nil {
+		log.Printf("Error handling message from %s: %v", c.queueName, err)
+		c.client.fail(c.queueName, d, c.opts, err)
+		return
+	}
 
-	// This will prevent the consumer from stopping when StartConsumer returns
-	go func() {
-		// Wait for the consumer to finish
-		wg.Wait()
-		log.Printf("Consumer for queue %s has fully stopped", queueName)
-	}()
+	// Acknowledge the message once it is handled
+	err = d.Ack(false)
+	if err != nil {
+		log.Printf("Error acknowledging message from %s: %v", c.queueName, err)
+	} else {
+		log.Printf("Successfully processed and acknowledged message from %s", c.queueName)
+	}
+}
 
-	return nil
+// toDelivery copies the AMQP properties of d into a broker.Delivery
+func toDelivery(d amqp.Delivery) broker.Delivery {
+	return broker.Delivery{
+		Metadata: broker.Metadata{
+			MessageID:     d.MessageId,
+			CorrelationID: d.CorrelationId,
+			ReplyTo:       d.ReplyTo,
+			ContentType:   d.ContentType,
+			Type:          d.Type,
+			Headers:       map[string]interface{}(d.Headers),
+			Timestamp:     d.Timestamp,
+			RoutingKey:    originalRoutingKey(d),
+		},
+		Body: d.Body,
+	}
+}
+
+// expiresArgs returns the x-expires queue argument, or nil when d is zero
+func expiresArgs(d time.Duration) amqp.Table {
+	if d <= 0 {
+		return nil
+	}
+	return amqp.Table{"x-expires": d.Milliseconds()}
 }
@@ -0,0 +1,188 @@
+package rabbitmq
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Gaoey/scale-websocket/internal/repository/broker"
+	"github.com/streadway/amqp"
+)
+
+// newTestClient returns a Client connected to the fake broker
+func newTestClient(t *testing.T, s *fakeAMQP) *Client {
+	t.Helper()
+	client, err := NewClient(Config{URL: s.url(), ExchangeName: "test", PublishTimeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// eventually waits for cond to hold
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func receive(t *testing.T, got <-chan broker.Delivery) broker.Delivery {
+	t.Helper()
+	select {
+	case d := <-got:
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+		return broker.Delivery{}
+	}
+}
+
+func TestConsumerResubscribesAfterReconnect(t *testing.T) {
+	s := newFakeAMQP(t, routeByKey(nil))
+	client := newTestClient(t, s)
+	ctx := context.Background()
+
+	got := make(chan broker.Delivery, 10)
+	cons, err := client.StartConsumer(ctx, "orders", []string{"orders.*"}, func(d broker.Delivery) error {
+		got <- d
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cons.Shutdown(ctx)
+
+	eventually(t, "the consumer is registered", func() bool { return s.consuming("orders") == 1 })
+	if !s.deliver("orders", "orders.created", []byte(`{"n":1}`)) {
+		t.Fatal("no consumer to deliver to")
+	}
+	if d := receive(t, got); d.RoutingKey != "orders.created" {
+		t.Fatalf("unexpected delivery %+v", d.Metadata)
+	}
+
+	s.setDown(true)
+	s.drop()
+	eventually(t, "the connection is gone", func() bool { return s.consuming("orders") == 0 })
+
+	// Publishes fail instead of hanging while there is no connection
+	start := time.Now()
+	if err := client.Publish(ctx, "orders.created", 1); err == nil {
+		t.Fatal("publish succeeded without a connection")
+	}
+	if waited := time.Since(start); waited > 2*time.Second {
+		t.Fatalf("publish without a connection took %v", waited)
+	}
+
+	s.setDown(false)
+	eventually(t, "the consumer is registered again", func() bool { return s.consuming("orders") == 1 })
+
+	// Declared and bound again, and so is the scheduler's queue
+	if _, declares := s.queue("orders"); declares != 2 {
+		t.Fatalf("queue declared %d times, want 2", declares)
+	}
+	eventually(t, "the scheduler consumes again", func() bool { return s.consuming(dueQueueName("test")) == 1 })
+
+	if !s.deliver("orders", "orders.updated", []byte(`{"n":2}`)) {
+		t.Fatal("no consumer to deliver to")
+	}
+	if d := receive(t, got); d.RoutingKey != "orders.updated" {
+		t.Fatalf("unexpected delivery %+v", d.Metadata)
+	}
+	if err := client.Publish(ctx, "orders.created", 1); err != nil {
+		t.Fatalf("publish after reconnecting: %v", err)
+	}
+}
+
+func TestConsumerQueueModes(t *testing.T) {
+	expires := amqp.Table{"x-expires": (5 * time.Minute).Milliseconds()}
+	sideExpires := amqp.Table{"x-expires": sideQueueExpires.Milliseconds()}
+	retryArgs := func(queue string, expires amqp.Table) amqp.Table {
+		args := amqp.Table{"x-dead-letter-exchange": "", "x-dead-letter-routing-key": queue}
+		for k, v := range expires {
+			args[k] = v
+		}
+		return args
+	}
+
+	tests := []struct {
+		name  string
+		opts  []broker.ConsumerOption
+		queue fakeQueue
+		// side is the declaration of the dead-letter queue, the retry queue
+		// has the same lifetime
+		side fakeQueue
+	}{
+		{
+			name:  "durable",
+			queue: fakeQueue{durable: true, args: amqp.Table{}},
+			side:  fakeQueue{durable: true, args: amqp.Table{}},
+		},
+		{
+			name:  "exclusive and expiring",
+			opts:  []broker.ConsumerOption{broker.WithQueueMode(broker.QueueExclusive), broker.WithQueueExpires(5 * time.Minute)},
+			queue: fakeQueue{exclusive: true, args: expires},
+			side:  fakeQueue{args: expires},
+		},
+		{
+			name:  "auto-delete",
+			opts:  []broker.ConsumerOption{broker.WithQueueMode(broker.QueueAutoDelete)},
+			queue: fakeQueue{autoDelete: true, args: amqp.Table{}},
+			// Kept around for a while after the work queue is gone
+			side: fakeQueue{args: sideExpires},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFakeAMQP(t, routeByKey(nil))
+			client := newTestClient(t, s)
+			ctx := context.Background()
+
+			cons, err := client.StartConsumer(ctx, "node-1", []string{"#"}, func(broker.Delivery) error { return nil }, tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cons.Shutdown(ctx)
+
+			if got, _ := s.queue("node-1"); !reflect.DeepEqual(got, tt.queue) {
+				t.Errorf("queue declared as %+v, want %+v", got, tt.queue)
+			}
+			if got, _ := s.queue(deadLetterQueueName("node-1")); !reflect.DeepEqual(got, tt.side) {
+				t.Errorf("dead-letter queue declared as %+v, want %+v", got, tt.side)
+			}
+			retry := tt.side
+			retry.args = retryArgs("node-1", tt.side.args)
+			if got, _ := s.queue(retryQueueName("node-1")); !reflect.DeepEqual(got, retry) {
+				t.Errorf("retry queue declared as %+v, want %+v", got, retry)
+			}
+			want := fakeExchange{kind: ExchangeFanout, durable: tt.side.durable, autoDelete: !tt.side.durable}
+			if got, _ := s.exchange(deadLetterExchange("node-1")); got != want {
+				t.Errorf("dead-letter exchange declared as %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestSchedulerQueueHasNoRetryTopology(t *testing.T) {
+	s := newFakeAMQP(t, routeByKey(nil))
+	newTestClient(t, s)
+
+	due := dueQueueName("test")
+	if got, _ := s.queue(due); !got.durable || s.consuming(due) != 1 {
+		t.Fatalf("due queue declared as %+v with %d consumers", got, s.consuming(due))
+	}
+	for _, name := range []string{retryQueueName(due), deadLetterQueueName(due)} {
+		if _, declares := s.queue(name); declares != 0 {
+			t.Errorf("declared %s for the due queue", name)
+		}
+	}
+	if _, ok := s.exchange(deadLetterExchange(due)); ok {
+		t.Errorf("declared a dead-letter exchange for the due queue")
+	}
+}
@@ -0,0 +1,284 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/Gaoey/scale-websocket/internal/repository/broker"
+	"github.com/streadway/amqp"
+)
+
+var _ broker.DeadLetterQueue = (*Client)(nil)
+
+// Headers used to carry retry state across redeliveries
+const (
+	headerAttempts           = "x-attempts"
+	headerOriginalRoutingKey = "x-original-routing-key"
+	headerDeadReason         = "x-dead-reason"
+	headerFailedAt           = "x-failed-at"
+)
+
+// Names of the per-queue retry and dead-letter topology
+func retryQueueName(queueName string) string {
+	return queueName + ".retry"
+}
+
+func deadLetterExchange(queueName string) string {
+	return queueName + ".dlx"
+}
+
+func deadLetterQueueName(queueName string) string {
+	return queueName + ".dead"
+}
+
+// sideQueueExpires is how long the retry and dead-letter queues of a
+// non-durable work queue are kept once unused, since nothing consumes them
+// and they would otherwise outlive the work queue
+const sideQueueExpires = time.Hour
+
+// declareRetryTopology declares the retry queue, which dead-letters expired
+// messages back onto the work queue through the default exchange, and the
+// dead-letter exchange with its queue. Their lifetime follows the work queue.
+func declareRetryTopology(channel *amqp.Channel, queueName string, opts broker.ConsumerOptions) error {
+	durable := opts.QueueMode == broker.QueueDurable
+	expires := opts.QueueExpires
+	if !durable && expires <= 0 {
+		expires = sideQueueExpires
+	}
+
+	retryArgs := amqp.Table{
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": queueName,
+	}
+	for k, v := range expiresArgs(expires) {
+		retryArgs[k] = v
+	}
+
+	_, err := channel.QueueDeclare(
+		retryQueueName(queueName), // queue name
+		durable,                   // durable
+		false,                     // delete when unused
+		false,                     // exclusive
+		false,                     // no-wait
+		retryArgs,                 // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("failed to declare retry queue: %w", err)
+	}
+
+	err = channel.ExchangeDeclare(
+		deadLetterExchange(queueName), // exchange name
+		ExchangeFanout,                // exchange type
+		durable,                       // durable
+		!durable,                      // auto-deleted
+		false,                         // internal
+		false,                         // no-wait
+		nil,                           // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("failed to declare dead-letter exchange: %w", err)
+	}
+
+	_, err = channel.QueueDeclare(
+		deadLetterQueueName(queueName), // queue name
+		durable,                        // durable
+		false,                          // delete when unused
+		false,                          // exclusive
+		false,                          // no-wait
+		expiresArgs(expires),           // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("failed to declare dead-letter queue: %w", err)
+	}
+
+	err = channel.QueueBind(
+		deadLetterQueueName(queueName), // queue name
+		"",                             // routing key
+		deadLetterExchange(queueName),  // exchange
+		false,                          // no-wait
+		nil,                            // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("failed to bind dead-letter queue: %w", err)
+	}
+
+	return nil
+}
+
+// fail schedules a failed delivery for another attempt or dead-letters it
+// once opts.MaxAttempts is reached. The original delivery is acked only after
+// the copy has been published, otherwise it is requeued.
+func (c *Client) fail(queueName string, d amqp.Delivery, opts broker.ConsumerOptions, cause error) {
+	attempts := deliveryAttempts(d) + 1
+
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers[headerAttempts] = int32(attempts)
+	headers[headerOriginalRoutingKey] = originalRoutingKey(d)
+
+	publishing := amqp.Publishing{
+		Headers:       headers,
+		ContentType:   d.ContentType,
+		Type:          d.Type,
+		MessageId:     d.MessageId,
+		CorrelationId: d.CorrelationId,
+		Body:          d.Body,
+		DeliveryMode:  amqp.Persistent,
+		Timestamp:     d.Timestamp,
+	}
+
+	exchange, routingKey := "", retryQueueName(queueName)
+	if attempts < opts.MaxAttempts && !errors.Is(cause, broker.ErrPermanent) {
+		publishing.Expiration = strconv.FormatInt(opts.RetryDelay.Milliseconds(), 10)
+		log.Printf("Retrying message from %s in %v (attempt %d/%d): %v", queueName, opts.RetryDelay, attempts, opts.MaxAttempts, cause)
+	} else {
+		exchange, routingKey = deadLetterExchange(queueName), ""
+		headers[headerDeadReason] = cause.Error()
+		headers[headerFailedAt] = time.Now().UTC().Format(time.RFC3339Nano)
+		log.Printf("Dead-lettering message from %s after %d attempts: %v", queueName, attempts, cause)
+	}
+
+	if err := c.publish(context.Background(), exchange, routingKey, false, publishing); err != nil {
+		log.Printf("Failed to republish message from %s, requeueing: %v", queueName, err)
+		d.Nack(false, true)
+		return
+	}
+
+	if err := d.Ack(false); err != nil {
+		log.Printf("Error acknowledging failed message from %s: %v", queueName, err)
+	}
+}
+
+// DeadLetters returns up to limit dead letters of a queue without removing them
+func (c *Client) DeadLetters(ctx context.Context, queueName string, limit int) ([]broker.DeadLetter, error) {
+	channel, err := c.openChannel()
+	if err != nil {
+		return nil, err
+	}
+	// Closing the channel requeues every message fetched without an ack
+	defer channel.Close()
+
+	letters := make([]broker.DeadLetter, 0)
+	for len(letters) < limit && ctx.Err() == nil {
+		d, ok, err := channel.Get(deadLetterQueueName(queueName), false)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read dead letters: %w", err)
+		}
+		if !ok {
+			break
+		}
+		letters = append(letters, toDeadLetter(d))
+	}
+
+	return letters, ctx.Err()
+}
+
+// ReplayDeadLetters republishes up to limit dead letters directly onto the
+// queue they failed on, with their attempt counter reset
+func (c *Client) ReplayDeadLetters(ctx context.Context, queueName string, limit int) (int, error) {
+	channel, err := c.openChannel()
+	if err != nil {
+		return 0, err
+	}
+	defer channel.Close()
+
+	replayed := 0
+	for replayed < limit && ctx.Err() == nil {
+		d, ok, err := channel.Get(deadLetterQueueName(queueName), false)
+		if err != nil {
+			return replayed, fmt.Errorf("failed to read dead letters: %w", err)
+		}
+		if !ok {
+			break
+		}
+
+		headers := amqp.Table{}
+		for k, v := range d.Headers {
+			headers[k] = v
+		}
+		delete(headers, headerAttempts)
+		delete(headers, headerDeadReason)
+		delete(headers, headerFailedAt)
+
+		// Confirmed before the dead letter is acked, so a lost publish
+		// leaves it in the dead-letter queue
+		err = c.publish(ctx, "", queueName, false, amqp.Publishing{
+			Headers:       headers,
+			ContentType:   d.ContentType,
+			Type:          d.Type,
+			MessageId:     d.MessageId,
+			CorrelationId: d.CorrelationId,
+			Body:          d.Body,
+			DeliveryMode:  amqp.Persistent,
+			Timestamp:     d.Timestamp,
+		})
+		if err != nil {
+			d.Nack(false, true)
+			return replayed, fmt.Errorf("failed to replay dead letter: %w", err)
+		}
+		if err := d.Ack(false); err != nil {
+			return replayed, fmt.Errorf("failed to acknowledge dead letter: %w", err)
+		}
+		replayed++
+	}
+
+	log.Printf("Replayed %d dead letters onto queue %s", replayed, queueName)
+	return replayed, ctx.Err()
+}
+
+// openChannel opens a short-lived channel on the current connection
+func (c *Client) openChannel() (*amqp.Channel, error) {
+	c.mu.RLock()
+	conn := c.conn
+	c.mu.RUnlock()
+
+	channel, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open a channel: %w", err)
+	}
+	return channel, nil
+}
+
+func toDeadLetter(d amqp.Delivery) broker.DeadLetter {
+	letter := broker.DeadLetter{
+		MessageID:  d.MessageId,
+		RoutingKey: originalRoutingKey(d),
+		Body:       string(d.Body),
+		Attempts:   deliveryAttempts(d),
+	}
+	if reason, ok := d.Headers[headerDeadReason].(string); ok {
+		letter.Reason = reason
+	}
+	if failedAt, ok := d.Headers[headerFailedAt].(string); ok {
+		letter.FailedAt, _ = time.Parse(time.RFC3339Nano, failedAt)
+	}
+	return letter
+}
+
+// deliveryAttempts returns how many attempts a delivery has already failed
+func deliveryAttempts(d amqp.Delivery) int {
+	switch v := d.Headers[headerAttempts].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	}
+	return 0
+}
+
+// originalRoutingKey returns the routing key a message was first published
+// with, since retries arrive through the default exchange
+func originalRoutingKey(d amqp.Delivery) string {
+	if key, ok := d.Headers[headerOriginalRoutingKey].(string); ok {
+		return key
+	}
+	return d.RoutingKey
+}
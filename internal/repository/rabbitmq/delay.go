@@ -0,0 +1,226 @@
+package rabbitmq
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Gaoey/scale-websocket/internal/repository/broker"
+	"github.com/streadway/amqp"
+)
+
+const (
+	// delayPrecision is the granularity of delayed delivery and the delay of
+	// the shortest holding queue
+	delayPrecision = time.Second
+	// maxDelayLevel is the longest holding queue, 2^maxDelayLevel seconds
+	// (about four years). Longer delays go round it again.
+	maxDelayLevel = 27
+	// delayQueueGrace is how long a holding queue outlives its delay once
+	// nothing has been published to it
+	delayQueueGrace = time.Hour
+	// delayRedeclareInterval is how often a holding queue in use is declared
+	// again, which resets its expiry. It must stay below delayQueueGrace so
+	// no queue expires while it still holds messages.
+	delayRedeclareInterval = 30 * time.Minute
+)
+
+// Headers carrying the schedule of a held message
+const (
+	headerDeliverAt       = "x-deliver-at"
+	headerDelayRoutingKey = "x-delay-routing-key"
+)
+
+// delayTopology remembers which holding queues have been declared recently.
+// There is one queue per level, so it never holds more than maxDelayLevel+1
+// entries.
+type delayTopology struct {
+	mu       sync.Mutex
+	declared map[int]time.Time
+}
+
+// holdingQueueName is the holding queue of one level, e.g. ws_events.hold.4000
+// for the queue that holds messages for 4s
+func holdingQueueName(exchange string, level int) string {
+	return fmt.Sprintf("%s.hold.%d", exchange, levelDelay(level).Milliseconds())
+}
+
+// dueQueueName is where held messages land once their holding queue's delay
+// has passed
+func dueQueueName(exchange string) string {
+	return exchange + ".hold.due"
+}
+
+func levelDelay(level int) time.Duration {
+	return delayPrecision << level
+}
+
+// delayLevel picks the longest holding queue that does not overshoot
+// remaining, which must be at least delayPrecision
+func delayLevel(remaining time.Duration) int {
+	level := 0
+	for level < maxDelayLevel && levelDelay(level+1) <= remaining {
+		level++
+	}
+	return level
+}
+
+// isDue reports whether a message scheduled for deliverAt should go out now
+// rather than be held for another round
+func isDue(deliverAt time.Time) bool {
+	return time.Until(deliverAt) < delayPrecision/2
+}
+
+// holdingQueue returns the holding queue of level, declaring it when needed.
+// Holding queues are durable and have a message TTL equal to their delay, after
+// which messages are dead-lettered to the due queue through the default
+// exchange, so they survive restarts of both this process and the broker.
+// Delays are held in powers of two: a message is republished to the next
+// shorter queue each time it comes back early, so a handful of queues serve
+// every delay.
+func (c *Client) holdingQueue(level int) (string, error) {
+	name := holdingQueueName(c.ExchangeName, level)
+
+	c.delays.mu.Lock()
+	defer c.delays.mu.Unlock()
+
+	if at, ok := c.delays.declared[level]; ok && time.Since(at) < delayRedeclareInterval {
+		return name, nil
+	}
+
+	channel, err := c.openChannel()
+	if err != nil {
+		return "", err
+	}
+	defer channel.Close()
+
+	delay := levelDelay(level)
+	_, err = channel.QueueDeclare(
+		name,  // queue name
+		true,  // durable
+		false, // delete when unused
+		false, // exclusive
+		false, // no-wait
+		amqp.Table{
+			"x-message-ttl":             delay.Milliseconds(),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": dueQueueName(c.ExchangeName),
+			"x-expires":                 (delay + delayQueueGrace).Milliseconds(),
+		}, // arguments
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to declare delay queue %s: %w", name, err)
+	}
+
+	c.delays.declared[level] = time.Now()
+	return name, nil
+}
+
+// destination picks where a message is published: the exchange itself when
+// it is due, otherwise the holding queue that fits the time it has left, with
+// its schedule recorded in msg's headers
+func (c *Client) destination(routingKey string, deliverAt time.Time, msg *amqp.Publishing) (string, string, error) {
+	if deliverAt.IsZero() || isDue(deliverAt) {
+		return c.ExchangeName, routingKey, nil
+	}
+
+	queue, err := c.holdingQueue(delayLevel(time.Until(deliverAt)))
+	if err != nil {
+		return "", "", err
+	}
+
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[headerDeliverAt] = deliverAt.UnixMilli()
+	headers[headerDelayRoutingKey] = routingKey
+	msg.Headers = headers
+
+	return "", queue, nil
+}
+
+// deliverAt is when a message published with options is due, zero when it
+// is not delayed
+func deliverAt(options broker.PublishOptions) time.Time {
+	if delay := options.Delay(); delay > 0 {
+		return time.Now().Add(delay)
+	}
+	return time.Time{}
+}
+
+// startScheduler consumes the due queue, sending every message that is due
+// to the exchange and holding the others for another round. The queue is
+// shared by every client on the exchange and outlives them all.
+func (c *Client) startScheduler() error {
+	options := broker.NewConsumerOptions(broker.WithPrefetch(64), broker.WithWorkers(8))
+	scheduler := &consumer{
+		client:    c,
+		queueName: dueQueueName(c.ExchangeName),
+		opts:      options,
+		raw:       c.release,
+		tag:       fmt.Sprintf("%s.%s", dueQueueName(c.ExchangeName), broker.NewMessageID()),
+		stopping:  make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	msgs, reconnected, err := scheduler.subscribe()
+	if err != nil {
+		return fmt.Errorf("failed to start delay scheduler: %w", err)
+	}
+	scheduler.workers = broker.NewWorkerPool(options.Workers)
+
+	go scheduler.run(context.Background(), msgs, reconnected)
+	return nil
+}
+
+// release republishes a message that came back from a holding queue. It is
+// acked only once the copy has been confirmed, so a crash in between sends
+// the message again with the same ID rather than losing it.
+func (c *Client) release(d amqp.Delivery) {
+	routingKey, _ := d.Headers[headerDelayRoutingKey].(string)
+	var due time.Time
+	if ms, ok := d.Headers[headerDeliverAt].(int64); ok {
+		due = time.UnixMilli(ms)
+	}
+
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	delete(headers, headerDeliverAt)
+	delete(headers, headerDelayRoutingKey)
+	// The dead-letter hop records itself, which is of no use to consumers
+	delete(headers, "x-death")
+	delete(headers, "x-first-death-exchange")
+	delete(headers, "x-first-death-queue")
+	delete(headers, "x-first-death-reason")
+
+	msg := amqp.Publishing{
+		Headers:       headers,
+		ContentType:   d.ContentType,
+		Type:          d.Type,
+		MessageId:     d.MessageId,
+		CorrelationId: d.CorrelationId,
+		ReplyTo:       d.ReplyTo,
+		Body:          d.Body,
+		DeliveryMode:  amqp.Persistent,
+		Timestamp:     d.Timestamp,
+	}
+
+	exchange, key, err := c.destination(routingKey, due, &msg)
+	if err == nil {
+		err = c.publish(context.Background(), exchange, key, false, msg)
+	}
+	if err != nil {
+		log.Printf("Failed to release delayed message %s, requeueing: %v", d.MessageId, err)
+		d.Nack(false, true)
+		return
+	}
+
+	if err := d.Ack(false); err != nil {
+		log.Printf("Error acknowledging delayed message %s: %v", d.MessageId, err)
+	}
+}
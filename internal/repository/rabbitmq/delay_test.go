@@ -0,0 +1,57 @@
+package rabbitmq
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDelayLevel(t *testing.T) {
+	for _, tc := range []struct {
+		remaining time.Duration
+		want      int
+	}{
+		{remaining: time.Second, want: 0},
+		{remaining: 1999 * time.Millisecond, want: 0},
+		{remaining: 2 * time.Second, want: 1},
+		{remaining: 5 * time.Minute, want: 8}, // 256s
+		{remaining: 24 * time.Hour, want: 16}, // 65536s
+		{remaining: 100 * 365 * 24 * time.Hour, want: maxDelayLevel},
+	} {
+		if got := delayLevel(tc.remaining); got != tc.want {
+			t.Errorf("delayLevel(%v) = %d, want %d", tc.remaining, got, tc.want)
+		}
+	}
+}
+
+func TestDelayRoundsReachDeliverAt(t *testing.T) {
+	// Each round holds the message in the longest queue that fits the time
+	// left, until what is left is below the precision
+	for _, delay := range []time.Duration{
+		time.Second,
+		1500 * time.Millisecond,
+		90 * time.Second,
+		37*time.Hour + 12*time.Minute + 7*time.Second,
+	} {
+		remaining, rounds := delay, 0
+		for remaining >= delayPrecision/2 {
+			held := levelDelay(delayLevel(max(remaining, delayPrecision)))
+			remaining -= held
+			rounds++
+		}
+		if remaining < -delayPrecision/2 {
+			t.Errorf("%v: delivered %v late", delay, -remaining)
+		}
+		if rounds > maxDelayLevel+1 {
+			t.Errorf("%v: took %d rounds", delay, rounds)
+		}
+	}
+}
+
+func TestHoldingQueueNames(t *testing.T) {
+	if got := holdingQueueName("ws_events", 2); got != "ws_events.hold.4000" {
+		t.Errorf("holdingQueueName = %s", got)
+	}
+	if got := dueQueueName("ws_events"); got != "ws_events.hold.due" {
+		t.Errorf("dueQueueName = %s", got)
+	}
+}
@@ -2,42 +2,108 @@ package rabbitmq
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
-	"time"
 
+	"github.com/Gaoey/scale-websocket/internal/repository/broker"
 	"github.com/streadway/amqp"
 )
 
-// Publish publishes a message to a specified routing key
-func (c *Client) Publish(ctx context.Context, routingKey string, msg Message) error {
+// Publish publishes a message to a specified routing key and waits until the
+// broker confirms it has taken the message. Mandatory publishes that reach no
+// queue fail with broker.ErrUnroutable. Delayed messages are confirmed once
+// they are held by the broker, so Mandatory cannot detect that they will be
+// unroutable when they come due.
+func (c *Client) Publish(ctx context.Context, routingKey string, msg Message, opts ...broker.PublishOption) error {
+	options := broker.NewPublishOptions(opts...)
+
 	// Context handling for cancellation/timeout
 	if ctx.Err() != nil {
 		return ctx.Err()
 	}
 
-	body, err := json.Marshal(msg)
+	meta := options.Metadata
+	body, err := broker.Encode(msg, &meta)
 	if err != nil {
 		return fmt.Errorf("failed to marshal message: %w", err)
 	}
 
-	log.Printf("Publishing message to routing key %s: %s", routingKey, body)
+	if broker.IsJSON(meta.ContentType) {
+		log.Printf("Publishing message to routing key %s: %s", routingKey, body)
+	} else {
+		log.Printf("Publishing %d byte %s message to routing key %s", len(body), meta.ContentType, routingKey)
+	}
 
-	err = c.channel.Publish(
-		c.ExchangeName, // exchange
-		routingKey,     // routing key
-		false,          // mandatory
-		false,          // immediate
-		amqp.Publishing{
-			ContentType:  "application/json",
-			Body:         body,
-			DeliveryMode: amqp.Persistent,
-			Timestamp:    time.Now(),
-		})
+	publishing := toPublishing(meta, body)
+	exchange, key, err := c.destination(routingKey, deliverAt(options), &publishing)
+	if err != nil {
+		return err
+	}
+
+	err = c.publish(ctx, exchange, key, options.Mandatory, publishing)
 	if err != nil {
-		return fmt.Errorf("failed to publish message: %w", err)
+		return err
 	}
 
 	return nil
 }
+
+var _ broker.BatchPublisher = (*Client)(nil)
+
+// PublishBatch publishes msgs over a single confirm-mode channel and waits for
+// all of their confirms at once, which is much faster than publishing them one
+// by one. The returned slice holds the outcome of each message.
+func (c *Client) PublishBatch(ctx context.Context, msgs []broker.BatchMessage) []error {
+	errs := make([]error, len(msgs))
+	if ctx.Err() != nil {
+		for i := range errs {
+			errs[i] = ctx.Err()
+		}
+		return errs
+	}
+
+	items := make([]batchItem, 0, len(msgs))
+	for i, m := range msgs {
+		options := broker.NewPublishOptions(m.Options...)
+		meta := options.Metadata
+		body, err := broker.Encode(m.Message, &meta)
+		if err != nil {
+			errs[i] = fmt.Errorf("failed to marshal message: %w", err)
+			continue
+		}
+
+		msg := toPublishing(meta, body)
+		exchange, key, err := c.destination(m.RoutingKey, deliverAt(options), &msg)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		items = append(items, batchItem{
+			index:      i,
+			exchange:   exchange,
+			routingKey: key,
+			mandatory:  options.Mandatory,
+			msg:        msg,
+		})
+	}
+
+	log.Printf("Publishing batch of %d messages", len(items))
+	c.publishBatch(ctx, items, errs)
+	return errs
+}
+
+// toPublishing builds a persistent AMQP message from broker metadata
+func toPublishing(meta broker.Metadata, body []byte) amqp.Publishing {
+	return amqp.Publishing{
+		Headers:       amqp.Table(meta.Headers),
+		ContentType:   meta.ContentType,
+		Type:          meta.Type,
+		MessageId:     meta.MessageID,
+		CorrelationId: meta.CorrelationID,
+		ReplyTo:       meta.ReplyTo,
+		Body:          body,
+		DeliveryMode:  amqp.Persistent,
+		Timestamp:     meta.Timestamp,
+	}
+}
@@ -0,0 +1,310 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Gaoey/scale-websocket/internal/repository/broker"
+	"github.com/streadway/amqp"
+)
+
+const (
+	defaultPublisherPoolSize = 8
+	defaultPublishTimeout    = 5 * time.Second
+)
+
+// headerBatchSeq numbers the messages of a batch so a basic.return can be
+// matched to its message. Message IDs are chosen by callers and need not be
+// unique within a batch.
+const headerBatchSeq = "x-batch-seq"
+
+// ErrNacked is returned when the broker refuses to take responsibility for a
+// published message
+var ErrNacked = errors.New("message nacked by broker")
+
+// publisherChannel is a channel in confirm mode owned by one publisher at a time
+type publisherChannel struct {
+	channel  *amqp.Channel
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+	closed   chan *amqp.Error
+	// stale fires once the connection the channel belongs to is replaced
+	stale <-chan struct{}
+}
+
+// healthy reports whether the channel can be handed to the next publisher
+func (p *publisherChannel) healthy() bool {
+	select {
+	case <-p.closed:
+		return false
+	case <-p.stale:
+		return false
+	default:
+		return true
+	}
+}
+
+// acquirePublisher takes an idle publishing channel from the pool or opens a
+// new one, waiting for a free slot when the pool is exhausted
+func (c *Client) acquirePublisher(ctx context.Context) (*publisherChannel, error) {
+	select {
+	case c.publisherSlots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, fmt.Errorf("client is closed")
+	}
+
+	for {
+		select {
+		case p := <-c.publishers:
+			if p.healthy() {
+				return p, nil
+			}
+			p.channel.Close()
+		default:
+			p, err := c.openPublisher()
+			if err != nil {
+				<-c.publisherSlots
+				return nil, err
+			}
+			return p, nil
+		}
+	}
+}
+
+// openPublisher opens a new channel on the current connection and puts it
+// into confirm mode
+func (c *Client) openPublisher() (*publisherChannel, error) {
+	c.mu.RLock()
+	conn, stale := c.conn, c.reconnected
+	c.mu.RUnlock()
+
+	channel, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open a publishing channel: %w", err)
+	}
+
+	if err := channel.Confirm(false); err != nil {
+		channel.Close()
+		return nil, fmt.Errorf("failed to put channel into confirm mode: %w", err)
+	}
+
+	return &publisherChannel{
+		channel:  channel,
+		confirms: channel.NotifyPublish(make(chan amqp.Confirmation, 1)),
+		returns:  channel.NotifyReturn(make(chan amqp.Return, 1)),
+		closed:   channel.NotifyClose(make(chan *amqp.Error, 1)),
+		stale:    stale,
+	}, nil
+}
+
+// releasePublisher returns a channel to the pool, or closes it when it can
+// no longer be trusted
+func (c *Client) releasePublisher(p *publisherChannel, reuse bool) {
+	defer func() { <-c.publisherSlots }()
+
+	if reuse && p.healthy() {
+		select {
+		case c.publishers <- p:
+			return
+		default:
+		}
+	}
+	p.channel.Close()
+}
+
+// publish sends msg on a pooled channel and waits until the broker confirms
+// it, or until ctx expires. The broker sends basic.return before the confirm
+// of an unroutable mandatory message, so a return is always visible by the
+// time the confirm arrives.
+func (c *Client) publish(ctx context.Context, exchange, routingKey string, mandatory bool, msg amqp.Publishing) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.publishTimeout)
+		defer cancel()
+	}
+
+	p, err := c.acquirePublisher(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = p.channel.Publish(
+		exchange,   // exchange
+		routingKey, // routing key
+		mandatory,  // mandatory
+		false,      // immediate
+		msg,
+	)
+	if err != nil {
+		c.releasePublisher(p, false)
+		return fmt.Errorf("failed to publish message: %w", err)
+	}
+
+	select {
+	case confirm, ok := <-p.confirms:
+		if !ok {
+			c.releasePublisher(p, false)
+			return fmt.Errorf("publishing channel closed before confirm")
+		}
+		var returned *amqp.Return
+		select {
+		case r := <-p.returns:
+			returned = &r
+		default:
+		}
+		c.releasePublisher(p, true)
+
+		if !confirm.Ack {
+			return ErrNacked
+		}
+		if returned != nil {
+			return &broker.UnroutableError{
+				RoutingKey: returned.RoutingKey,
+				Reason:     returned.ReplyText,
+			}
+		}
+		return nil
+	case <-ctx.Done():
+		// The confirm is still outstanding, so the channel cannot be reused
+		c.releasePublisher(p, false)
+		return fmt.Errorf("waiting for publish confirm: %w", ctx.Err())
+	}
+}
+
+// batchItem is one message of a batch published on a single channel
+type batchItem struct {
+	index      int
+	exchange   string
+	routingKey string
+	mandatory  bool
+	msg        amqp.Publishing
+}
+
+// publishBatch sends items on one pooled channel and waits for all of their
+// confirms, storing the outcome of each item at errs[item.index]. Confirms
+// arrive in publish order, so the n-th confirm belongs to the n-th item;
+// returns carry no delivery tag and are matched by a per-item sequence header.
+func (c *Client) publishBatch(ctx context.Context, items []batchItem, errs []error) {
+	if len(items) == 0 {
+		return
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.publishTimeout)
+		defer cancel()
+	}
+
+	// Number the items on copies of their headers, the caller's maps may be
+	// shared between messages
+	for i := range items {
+		headers := amqp.Table{}
+		for k, v := range items[i].msg.Headers {
+			headers[k] = v
+		}
+		headers[headerBatchSeq] = strconv.Itoa(i)
+		items[i].msg.Headers = headers
+	}
+
+	p, err := c.acquirePublisher(ctx)
+	if err != nil {
+		for _, item := range items {
+			errs[item.index] = err
+		}
+		return
+	}
+
+	// Publish from a separate goroutine while confirms are collected here,
+	// so the connection never stalls on a full confirm channel
+	type outcome struct {
+		sent int
+		err  error
+	}
+	published := make(chan outcome, 1)
+	go func() {
+		for i, item := range items {
+			err := p.channel.Publish(
+				item.exchange,   // exchange
+				item.routingKey, // routing key
+				item.mandatory,  // mandatory
+				false,           // immediate
+				item.msg,
+			)
+			if err != nil {
+				published <- outcome{sent: i, err: fmt.Errorf("failed to publish message: %w", err)}
+				return
+			}
+		}
+		published <- outcome{sent: len(items)}
+	}()
+
+	var (
+		confirms []amqp.Confirmation
+		result   *outcome
+		waitErr  error
+	)
+	returned := make(map[string]amqp.Return)
+	addReturn := func(r amqp.Return) {
+		if seq, ok := r.Headers[headerBatchSeq].(string); ok {
+			returned[seq] = r
+		}
+	}
+	drainReturns := func() {
+		for {
+			select {
+			case r := <-p.returns:
+				addReturn(r)
+			default:
+				return
+			}
+		}
+	}
+
+collect:
+	for result == nil || len(confirms) < result.sent {
+		select {
+		case r := <-p.returns:
+			addReturn(r)
+		case confirm, ok := <-p.confirms:
+			if !ok {
+				waitErr = fmt.Errorf("publishing channel closed before confirm")
+				break collect
+			}
+			drainReturns()
+			confirms = append(confirms, confirm)
+		case o := <-published:
+			result = &o
+		case <-ctx.Done():
+			waitErr = fmt.Errorf("waiting for publish confirm: %w", ctx.Err())
+			break collect
+		}
+	}
+
+	// The channel can only be reused once every message on it is confirmed
+	reuse := waitErr == nil && result.err == nil
+	c.releasePublisher(p, reuse)
+	if result == nil {
+		// Closing the channel makes the publishing goroutine give up
+		o := <-published
+		result = &o
+	}
+
+	for i, item := range items {
+		switch {
+		case i < len(confirms) && !confirms[i].Ack:
+			errs[item.index] = ErrNacked
+		case i < len(confirms):
+			if r, ok := returned[strconv.Itoa(i)]; ok && item.mandatory {
+				errs[item.index] = &broker.UnroutableError{RoutingKey: r.RoutingKey, Reason: r.ReplyText}
+			}
+		case i < result.sent:
+			errs[item.index] = waitErr
+		default:
+			errs[item.index] = result.err
+		}
+	}
+}
@@ -0,0 +1,659 @@
+package rabbitmq
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Gaoey/scale-websocket/internal/repository/broker"
+	"github.com/streadway/amqp"
+)
+
+// outcome is what the fake broker does with a published message
+type outcome int
+
+const (
+	confirmAck outcome = iota
+	confirmNack
+	// returnUnroutable returns mandatory messages before acking them, as
+	// RabbitMQ does when no queue is bound
+	returnUnroutable
+	// noConfirm never confirms the message
+	noConfirm
+)
+
+// fakeAMQP speaks just enough AMQP 0-9-1 to publish on confirm-mode
+// channels and to consume: the connection handshake, opening and closing
+// channels, confirm.select and basic.publish answered by basic.ack,
+// basic.nack or basic.return, and the declarations, bindings and consumers
+// a Client registers. It records what was declared and delivers messages
+// only when asked to with deliver.
+type fakeAMQP struct {
+	ln    net.Listener
+	route func(routingKey string) outcome
+
+	mu      sync.Mutex
+	opened  int
+	open    int
+	maxOpen int
+
+	conns map[net.Conn]struct{}
+	// down refuses new connections
+	down bool
+
+	queues    map[string]fakeQueue
+	declares  map[string]int
+	exchanges map[string]fakeExchange
+	consumers []*fakeConsumer
+}
+
+// fakeQueue is the last declaration of a queue
+type fakeQueue struct {
+	durable    bool
+	exclusive  bool
+	autoDelete bool
+	args       amqp.Table
+}
+
+// fakeExchange is the last declaration of an exchange
+type fakeExchange struct {
+	kind       string
+	durable    bool
+	autoDelete bool
+}
+
+// fakeConsumer is a consumer tag registered on a channel
+type fakeConsumer struct {
+	conn    net.Conn
+	channel uint16
+	tag     string
+	queue   string
+	// delivered numbers the deliveries sent to it
+	delivered uint64
+}
+
+func newFakeAMQP(t *testing.T, route func(routingKey string) outcome) *fakeAMQP {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeAMQP{
+		ln:        ln,
+		route:     route,
+		conns:     make(map[net.Conn]struct{}),
+		queues:    make(map[string]fakeQueue),
+		declares:  make(map[string]int),
+		exchanges: make(map[string]fakeExchange),
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			if s.down {
+				s.mu.Unlock()
+				conn.Close()
+				continue
+			}
+			s.conns[conn] = struct{}{}
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeAMQP) url() string {
+	return "amqp://guest:guest@" + s.ln.Addr().String() + "/"
+}
+
+// stats returns how many channels were opened in total and at most at once
+func (s *fakeAMQP) stats() (opened, maxOpen int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.opened, s.maxOpen
+}
+
+// drop closes every connection, as a broker restart does
+func (s *fakeAMQP) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// setDown refuses or accepts new connections
+func (s *fakeAMQP) setDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = down
+}
+
+// queue returns the last declaration of a queue and how many times it was
+// declared
+func (s *fakeAMQP) queue(name string) (fakeQueue, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queues[name], s.declares[name]
+}
+
+func (s *fakeAMQP) exchange(name string) (fakeExchange, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.exchanges[name]
+	return e, ok
+}
+
+// consuming returns how many consumers are registered on a queue
+func (s *fakeAMQP) consuming(queue string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, c := range s.consumers {
+		if c.queue == queue {
+			n++
+		}
+	}
+	return n
+}
+
+// deliver sends a message to a consumer of queue and reports whether there
+// was one
+func (s *fakeAMQP) deliver(queue, routingKey string, body []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.consumers {
+		if c.queue != queue {
+			continue
+		}
+		c.delivered++
+
+		// basic.deliver and its content in a single write, so nothing else
+		// comes in between
+		var buf bytes.Buffer
+		w := frameWriter{&buf}
+		args := append(shortstr(c.tag), binary.BigEndian.AppendUint64(nil, c.delivered)...)
+		args = append(args, 0) // redelivered
+		args = append(args, shortstr("test")...)
+		args = append(args, shortstr(routingKey)...)
+		w.method(c.channel, 60, 60, args)
+		header := binary.BigEndian.AppendUint16(nil, 60)
+		header = binary.BigEndian.AppendUint16(header, 0)
+		header = binary.BigEndian.AppendUint64(header, uint64(len(body)))
+		header = binary.BigEndian.AppendUint16(header, 0) // no properties
+		w.frame(2, c.channel, header)
+		w.frame(3, c.channel, body)
+		_, err := c.conn.Write(buf.Bytes())
+		return err == nil
+	}
+	return false
+}
+
+// removeConsumers unregisters the consumers of a connection, of one of its
+// channels when channel is not zero, or the one with tag
+func (s *fakeAMQP) removeConsumers(conn net.Conn, channel uint16, tag string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.consumers[:0]
+	for _, c := range s.consumers {
+		if c.conn == conn && (channel == 0 || c.channel == channel) && (tag == "" || c.tag == tag) {
+			continue
+		}
+		kept = append(kept, c)
+	}
+	s.consumers = kept
+}
+
+type frameWriter struct {
+	w io.Writer
+}
+
+func (f frameWriter) frame(typ byte, channel uint16, payload []byte) error {
+	var hdr [7]byte
+	hdr[0] = typ
+	binary.BigEndian.PutUint16(hdr[1:], channel)
+	binary.BigEndian.PutUint32(hdr[3:], uint32(len(payload)))
+	_, err := f.w.Write(append(append(hdr[:], payload...), 0xCE))
+	return err
+}
+
+func (f frameWriter) method(channel, class, method uint16, args []byte) error {
+	payload := binary.BigEndian.AppendUint16(nil, class)
+	payload = binary.BigEndian.AppendUint16(payload, method)
+	return f.frame(1, channel, append(payload, args...))
+}
+
+func shortstr(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+func longstr(s string) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(s))), s...)
+}
+
+func readShortstr(b []byte) (string, []byte) {
+	n := int(b[0])
+	return string(b[1 : 1+n]), b[1+n:]
+}
+
+// readTable decodes a field table holding the value types a Client sends
+func readTable(b []byte) amqp.Table {
+	n := binary.BigEndian.Uint32(b)
+	b = b[4 : 4+n]
+
+	table := amqp.Table{}
+	for len(b) > 0 {
+		var key string
+		key, b = readShortstr(b)
+		typ := b[0]
+		b = b[1:]
+		switch typ {
+		case 'S':
+			size := binary.BigEndian.Uint32(b)
+			table[key] = string(b[4 : 4+size])
+			b = b[4+size:]
+		case 'l':
+			table[key] = int64(binary.BigEndian.Uint64(b))
+			b = b[8:]
+		case 'I':
+			table[key] = int32(binary.BigEndian.Uint32(b))
+			b = b[4:]
+		case 't':
+			table[key] = b[0] != 0
+			b = b[1:]
+		default:
+			panic(fmt.Sprintf("unsupported field type %q of %s", typ, key))
+		}
+	}
+	return table
+}
+
+// publishing is a basic.publish waiting for its content
+type publishing struct {
+	routingKey string
+	mandatory  bool
+	header     []byte
+	size       uint64
+	body       []byte
+}
+
+type fakeChannel struct {
+	tag     uint64
+	pending *publishing
+}
+
+func (s *fakeAMQP) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := frameWriter{conn}
+
+	if _, err := io.ReadFull(r, make([]byte, 8)); err != nil {
+		return
+	}
+	start := append([]byte{0, 9}, 0, 0, 0, 0) // version, empty server properties
+	start = append(start, longstr("PLAIN")...)
+	start = append(start, longstr("en_US")...)
+	w.method(0, 10, 10, start)
+
+	channels := make(map[uint16]*fakeChannel)
+	defer func() {
+		s.mu.Lock()
+		s.open -= len(channels)
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		s.removeConsumers(conn, 0, "")
+	}()
+
+	for {
+		var hdr [7]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return
+		}
+		typ, channel := hdr[0], binary.BigEndian.Uint16(hdr[1:])
+		payload := make([]byte, binary.BigEndian.Uint32(hdr[3:])+1)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return
+		}
+		payload = payload[:len(payload)-1]
+
+		ch := channels[channel]
+		switch typ {
+		case 2: // content header
+			ch.pending.header = payload
+			ch.pending.size = binary.BigEndian.Uint64(payload[4:])
+			if ch.pending.size == 0 {
+				s.confirm(w, channel, ch)
+			}
+			continue
+		case 3: // content body
+			ch.pending.body = append(ch.pending.body, payload...)
+			if uint64(len(ch.pending.body)) >= ch.pending.size {
+				s.confirm(w, channel, ch)
+			}
+			continue
+		case 8: // heartbeat
+			continue
+		}
+
+		class, method, args := binary.BigEndian.Uint16(payload), binary.BigEndian.Uint16(payload[2:]), payload[4:]
+		switch {
+		case class == 10 && method == 11: // connection.start-ok
+			tune := binary.BigEndian.AppendUint16(nil, 0)
+			tune = binary.BigEndian.AppendUint32(tune, 131072)
+			tune = binary.BigEndian.AppendUint16(tune, 0)
+			w.method(0, 10, 30, tune)
+		case class == 10 && method == 40: // connection.open
+			w.method(0, 10, 41, shortstr(""))
+		case class == 10 && method == 50: // connection.close
+			w.method(0, 10, 51, nil)
+			return
+		case class == 20 && method == 10: // channel.open
+			channels[channel] = &fakeChannel{}
+			s.mu.Lock()
+			s.opened++
+			s.open++
+			s.maxOpen = max(s.maxOpen, s.open)
+			s.mu.Unlock()
+			w.method(channel, 20, 11, longstr(""))
+		case class == 20 && method == 40: // channel.close
+			delete(channels, channel)
+			s.mu.Lock()
+			s.open--
+			s.mu.Unlock()
+			s.removeConsumers(conn, channel, "")
+			w.method(channel, 20, 41, nil)
+		case class == 40 && method == 10: // exchange.declare
+			name, rest := readShortstr(args[2:])
+			kind, rest := readShortstr(rest)
+			s.mu.Lock()
+			s.exchanges[name] = fakeExchange{kind: kind, durable: rest[0]&2 != 0, autoDelete: rest[0]&4 != 0}
+			s.mu.Unlock()
+			if rest[0]&16 == 0 {
+				w.method(channel, 40, 11, nil)
+			}
+		case class == 50 && method == 10: // queue.declare
+			name, rest := readShortstr(args[2:])
+			s.mu.Lock()
+			s.queues[name] = fakeQueue{
+				durable:    rest[0]&2 != 0,
+				exclusive:  rest[0]&4 != 0,
+				autoDelete: rest[0]&8 != 0,
+				args:       readTable(rest[1:]),
+			}
+			s.declares[name]++
+			s.mu.Unlock()
+			if rest[0]&16 == 0 {
+				w.method(channel, 50, 11, append(shortstr(name), make([]byte, 8)...))
+			}
+		case class == 50 && method == 20: // queue.bind
+			_, rest := readShortstr(args[2:]) // queue
+			_, rest = readShortstr(rest)      // exchange
+			_, rest = readShortstr(rest)      // routing key
+			if rest[0]&1 == 0 {
+				w.method(channel, 50, 21, nil)
+			}
+		case class == 60 && method == 10: // basic.qos
+			w.method(channel, 60, 11, nil)
+		case class == 60 && method == 20: // basic.consume
+			queue, rest := readShortstr(args[2:])
+			tag, rest := readShortstr(rest)
+			s.mu.Lock()
+			s.consumers = append(s.consumers, &fakeConsumer{conn: conn, channel: channel, tag: tag, queue: queue})
+			s.mu.Unlock()
+			if rest[0]&8 == 0 {
+				w.method(channel, 60, 21, shortstr(tag))
+			}
+		case class == 60 && method == 30: // basic.cancel
+			tag, rest := readShortstr(args)
+			s.removeConsumers(conn, channel, tag)
+			if rest[0]&1 == 0 {
+				w.method(channel, 60, 31, shortstr(tag))
+			}
+		case class == 85 && method == 10: // confirm.select
+			w.method(channel, 85, 11, nil)
+		case class == 60 && method == 40: // basic.publish
+			_, rest := readShortstr(args[2:]) // exchange
+			key, rest := readShortstr(rest)
+			ch.pending = &publishing{routingKey: key, mandatory: rest[0]&1 != 0}
+		}
+	}
+}
+
+// confirm answers a fully received publish as the route decides
+func (s *fakeAMQP) confirm(w frameWriter, channel uint16, ch *fakeChannel) {
+	p := ch.pending
+	ch.pending = nil
+	ch.tag++
+
+	ack := binary.BigEndian.AppendUint64(nil, ch.tag)
+	switch s.route(p.routingKey) {
+	case confirmAck:
+		w.method(channel, 60, 80, append(ack, 0))
+	case confirmNack:
+		w.method(channel, 60, 120, append(ack, 0))
+	case returnUnroutable:
+		if p.mandatory {
+			ret := binary.BigEndian.AppendUint16(nil, 312)
+			ret = append(ret, shortstr("NO_ROUTE")...)
+			ret = append(ret, shortstr("test")...)
+			ret = append(ret, shortstr(p.routingKey)...)
+			w.method(channel, 60, 50, ret)
+			w.frame(2, channel, p.header)
+			if len(p.body) > 0 {
+				w.frame(3, channel, p.body)
+			}
+		}
+		w.method(channel, 60, 80, append(ack, 0))
+	case noConfirm:
+	}
+}
+
+// newPublishingClient returns a Client that only publishes, connected to
+// the fake broker
+func newPublishingClient(t *testing.T, s *fakeAMQP, poolSize int, timeout time.Duration) *Client {
+	t.Helper()
+	conn, err := amqp.Dial(s.url())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &Client{
+		conn:           conn,
+		reconnected:    make(chan struct{}),
+		publishers:     make(chan *publisherChannel, poolSize),
+		publisherSlots: make(chan struct{}, poolSize),
+		publishTimeout: timeout,
+		done:           make(chan struct{}),
+	}
+}
+
+func routeByKey(outcomes map[string]outcome) func(string) outcome {
+	return func(key string) outcome {
+		return outcomes[key]
+	}
+}
+
+func TestPublishReusesPooledChannels(t *testing.T) {
+	s := newFakeAMQP(t, routeByKey(nil))
+	c := newPublishingClient(t, s, 3, 5*time.Second)
+	ctx := context.Background()
+
+	for i := 0; i < 10; i++ {
+		if err := c.publish(ctx, "test", "orders.created", false, amqp.Publishing{Body: []byte("m")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if opened, _ := s.stats(); opened != 1 {
+		t.Fatalf("sequential publishes opened %d channels, want 1", opened)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.publish(ctx, "test", "orders.created", false, amqp.Publishing{Body: []byte("m")}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if opened, maxOpen := s.stats(); opened > 3 || maxOpen > 3 {
+		t.Fatalf("pool of 3 opened %d channels, %d at once", opened, maxOpen)
+	}
+}
+
+func TestPublishConfirmOutcomes(t *testing.T) {
+	s := newFakeAMQP(t, routeByKey(map[string]outcome{
+		"nacked":     confirmNack,
+		"unroutable": returnUnroutable,
+	}))
+	c := newPublishingClient(t, s, 2, 5*time.Second)
+	ctx := context.Background()
+
+	if err := c.publish(ctx, "test", "nacked", false, amqp.Publishing{Body: []byte("m")}); !errors.Is(err, ErrNacked) {
+		t.Fatalf("nacked publish: %v", err)
+	}
+
+	err := c.publish(ctx, "test", "unroutable", true, amqp.Publishing{Body: []byte("m")})
+	var unroutable *broker.UnroutableError
+	if !errors.As(err, &unroutable) || unroutable.RoutingKey != "unroutable" || unroutable.Reason != "NO_ROUTE" {
+		t.Fatalf("mandatory publish without a queue: %v", err)
+	}
+
+	// Only mandatory messages are returned
+	if err := c.publish(ctx, "test", "unroutable", false, amqp.Publishing{Body: []byte("m")}); err != nil {
+		t.Fatalf("publish without a queue: %v", err)
+	}
+
+	// The return was consumed with its confirm, the channel is clean
+	if err := c.publish(ctx, "test", "orders.created", true, amqp.Publishing{Body: []byte("m")}); err != nil {
+		t.Fatalf("publish after a return: %v", err)
+	}
+	if opened, _ := s.stats(); opened != 1 {
+		t.Fatalf("opened %d channels, want 1", opened)
+	}
+}
+
+func TestPublishTimeoutDropsTheChannel(t *testing.T) {
+	s := newFakeAMQP(t, routeByKey(map[string]outcome{"lost": noConfirm}))
+	c := newPublishingClient(t, s, 2, 50*time.Millisecond)
+	ctx := context.Background()
+
+	if err := c.publish(ctx, "test", "lost", false, amqp.Publishing{Body: []byte("m")}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unconfirmed publish: %v", err)
+	}
+
+	// Its confirm may still arrive, so the next publish gets a new channel
+	if err := c.publish(ctx, "test", "orders.created", false, amqp.Publishing{Body: []byte("m")}); err != nil {
+		t.Fatal(err)
+	}
+	if opened, _ := s.stats(); opened != 2 {
+		t.Fatalf("opened %d channels, want 2", opened)
+	}
+}
+
+func TestPublishWaitsForAFreeChannel(t *testing.T) {
+	s := newFakeAMQP(t, routeByKey(map[string]outcome{"lost": noConfirm}))
+	c := newPublishingClient(t, s, 1, time.Second)
+
+	held := make(chan error, 1)
+	go func() {
+		held <- c.publish(context.Background(), "test", "lost", false, amqp.Publishing{Body: []byte("m")})
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// The only channel is waiting for its confirm
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.publish(ctx, "test", "orders.created", false, amqp.Publishing{Body: []byte("m")}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("publish with the pool exhausted: %v", err)
+	}
+	if err := <-held; err == nil {
+		t.Fatal("unconfirmed publish succeeded")
+	}
+	if err := c.publish(context.Background(), "test", "orders.created", false, amqp.Publishing{Body: []byte("m")}); err != nil {
+		t.Fatalf("publish once the slot was freed: %v", err)
+	}
+}
+
+func TestPublishBatch(t *testing.T) {
+	s := newFakeAMQP(t, routeByKey(map[string]outcome{
+		"nacked":     confirmNack,
+		"unroutable": returnUnroutable,
+	}))
+	c := newPublishingClient(t, s, 2, 5*time.Second)
+
+	keys := []string{"orders.created", "unroutable", "nacked", "orders.created", "unroutable"}
+	items := make([]batchItem, len(keys))
+	for i, key := range keys {
+		items[i] = batchItem{
+			index:      len(keys) - 1 - i,
+			exchange:   "test",
+			routingKey: key,
+			mandatory:  true,
+			// The same message ID everywhere, returns are matched by sequence
+			msg: amqp.Publishing{MessageId: "same", Body: []byte(fmt.Sprint(i)), Headers: amqp.Table{"k": "v"}},
+		}
+	}
+	items[4].mandatory = false
+	shared := items[0].msg.Headers
+
+	errs := make([]error, len(keys))
+	c.publishBatch(context.Background(), items, errs)
+
+	// Stored at each item's index, in reverse
+	want := []error{nil, broker.ErrUnroutable, ErrNacked, nil, nil}
+	for i, w := range want {
+		got := errs[len(keys)-1-i]
+		if (w == nil) != (got == nil) || (w != nil && !errors.Is(got, w)) {
+			t.Errorf("item %d (%s): got %v, want %v", i, keys[i], got, w)
+		}
+	}
+	if _, ok := shared[headerBatchSeq]; ok {
+		t.Fatal("the caller's headers were modified")
+	}
+	if opened, _ := s.stats(); opened != 1 {
+		t.Fatalf("batch opened %d channels, want 1", opened)
+	}
+}
+
+func TestPublishDropsChannelsOfAReplacedConnection(t *testing.T) {
+	s := newFakeAMQP(t, routeByKey(nil))
+	c := newPublishingClient(t, s, 2, 5*time.Second)
+	ctx := context.Background()
+
+	if err := c.publish(ctx, "test", "orders.created", false, amqp.Publishing{Body: []byte("m")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// As a reconnect does
+	c.mu.Lock()
+	close(c.reconnected)
+	c.reconnected = make(chan struct{})
+	c.mu.Unlock()
+
+	if err := c.publish(ctx, "test", "orders.created", false, amqp.Publishing{Body: []byte("m")}); err != nil {
+		t.Fatal(err)
+	}
+	if opened, maxOpen := s.stats(); opened != 2 || maxOpen != 1 {
+		t.Fatalf("opened %d channels, %d at once, want 2 one after the other", opened, maxOpen)
+	}
+}
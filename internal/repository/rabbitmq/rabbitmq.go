@@ -3,8 +3,10 @@ package rabbitmq
 import (
 	"fmt"
 	"log"
+	"sync"
 	"time"
 
+	"github.com/Gaoey/scale-websocket/internal/repository/broker"
 	"github.com/streadway/amqp"
 )
 
@@ -15,22 +17,52 @@ const (
 	ExchangeHeaders = amqp.ExchangeHeaders
 )
 
+const defaultMaxReconnectAttempts = 10
+
+var _ broker.Broker = (*Client)(nil)
+
 // Client represents a RabbitMQ client connection
 type Client struct {
-	conn         *amqp.Connection
-	channel      *amqp.Channel
+	mu      sync.RWMutex
+	conn    *amqp.Connection
+	channel *amqp.Channel
+	// reconnected is closed and replaced every time a new connection is
+	// established, so consumers can wait for the next generation
+	reconnected chan struct{}
+
+	// publishers holds idle confirm-mode channels and publisherSlots bounds
+	// how many are open at once
+	publishers     chan *publisherChannel
+	publisherSlots chan struct{}
+	publishTimeout time.Duration
+
+	// replies is the callback queue used by Call
+	replies replyQueue
+	// delays tracks the holding queues of delayed publishes
+	delays delayTopology
+
 	ExchangeName string
+	exchangeType string
 	url          string
+	maxRetries   int
+
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 // Message represents the structure of messages passed through RabbitMQ
-type Message interface{}
+type Message = broker.Message
 
 // Config holds the configuration for RabbitMQ connection
 type Config struct {
-	URL          string
-	ExchangeName string
-	ExchangeType string // "direct", "topic", "fanout", etc.
+	URL                  string
+	ExchangeName         string
+	ExchangeType         string // "direct", "topic", "fanout", etc.
+	MaxReconnectAttempts int    // attempts per reconnect round, defaults to 10
+	PublisherPoolSize    int    // concurrent publishing channels, defaults to 8
+	// PublishTimeout bounds the wait for a publisher confirm when the
+	// caller's context has no deadline, defaults to 5s
+	PublishTimeout time.Duration
 }
 
 // NewClient creates a new RabbitMQ client
@@ -43,55 +75,154 @@ func NewClient(cfg Config) (*Client, error) {
 		cfg.ExchangeType = ExchangeTopic
 	}
 
+	if cfg.MaxReconnectAttempts <= 0 {
+		cfg.MaxReconnectAttempts = defaultMaxReconnectAttempts
+	}
+
+	if cfg.PublisherPoolSize <= 0 {
+		cfg.PublisherPoolSize = defaultPublisherPoolSize
+	}
+
+	if cfg.PublishTimeout <= 0 {
+		cfg.PublishTimeout = defaultPublishTimeout
+	}
+
 	client := &Client{
-		url:          cfg.URL,
-		ExchangeName: cfg.ExchangeName,
+		url:            cfg.URL,
+		ExchangeName:   cfg.ExchangeName,
+		exchangeType:   cfg.ExchangeType,
+		maxRetries:     cfg.MaxReconnectAttempts,
+		publishers:     make(chan *publisherChannel, cfg.PublisherPoolSize),
+		publisherSlots: make(chan struct{}, cfg.PublisherPoolSize),
+		publishTimeout: cfg.PublishTimeout,
+		replies: replyQueue{
+			pending: make(map[string]chan amqp.Delivery),
+		},
+		delays: delayTopology{
+			declared: make(map[int]time.Time),
+		},
+		reconnected: make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+
+	conn, channel, err := client.connect()
+	if err != nil {
+		return nil, err
+	}
+	client.conn = conn
+	client.channel = channel
+
+	if err := client.startScheduler(); err != nil {
+		conn.Close()
+		return nil, err
 	}
 
+	go client.supervise()
+
+	return client, nil
+}
+
+// connect dials RabbitMQ, opens a channel and declares the exchange
+func (c *Client) connect() (*amqp.Connection, *amqp.Channel, error) {
 	// Connect to RabbitMQ
-	var err error
-	client.conn, err = amqp.Dial(cfg.URL)
+	conn, err := amqp.Dial(c.url)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to RabbitMQ: %w", err)
+		return nil, nil, fmt.Errorf("failed to connect to RabbitMQ: %w", err)
 	}
 
 	// Create a channel
-	client.channel, err = client.conn.Channel()
+	channel, err := conn.Channel()
 	if err != nil {
-		client.Close()
-		return nil, fmt.Errorf("failed to open a channel: %w", err)
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to open a channel: %w", err)
 	}
 
 	// Declare the exchange
-	err = client.channel.ExchangeDeclare(
-		cfg.ExchangeName, // exchange name
-		cfg.ExchangeType, // exchange type
-		true,             // durable
-		false,            // auto-deleted
-		false,            // internal
-		false,            // no-wait
-		nil,              // arguments
+	err = channel.ExchangeDeclare(
+		c.ExchangeName, // exchange name
+		c.exchangeType, // exchange type
+		true,           // durable
+		false,          // auto-deleted
+		false,          // internal
+		false,          // no-wait
+		nil,            // arguments
 	)
 	if err != nil {
-		client.Close()
-		return nil, fmt.Errorf("failed to declare an exchange: %w", err)
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to declare an exchange: %w", err)
 	}
 
-	return client, nil
+	return conn, channel, nil
+}
+
+// current returns the active channel together with the signal that is
+// closed once that channel has been replaced by a reconnect
+func (c *Client) current() (*amqp.Channel, <-chan struct{}) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.channel, c.reconnected
+}
+
+// isClosed reports whether Close has been called
+func (c *Client) isClosed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// supervise watches the connection and channel for unexpected closes and
+// reconnects until the client is closed
+func (c *Client) supervise() {
+	for {
+		c.mu.RLock()
+		connClosed := c.conn.NotifyClose(make(chan *amqp.Error, 1))
+		chanClosed := c.channel.NotifyClose(make(chan *amqp.Error, 1))
+		c.mu.RUnlock()
+
+		var reason *amqp.Error
+		select {
+		case <-c.done:
+			return
+		case reason = <-connClosed:
+		case reason = <-chanClosed:
+		}
+
+		if c.isClosed() {
+			return
+		}
+		log.Printf("RabbitMQ connection lost: %v", reason)
+
+		for {
+			err := c.Reconnect(c.maxRetries)
+			if err == nil {
+				break
+			}
+			if c.isClosed() {
+				return
+			}
+			log.Printf("RabbitMQ reconnect round failed: %v", err)
+		}
+	}
 }
 
 // Close closes the RabbitMQ connection and channel
 func (c *Client) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	var err error
 	if c.channel != nil {
 		err = c.channel.Close()
-		c.channel = nil
 	}
 	if c.conn != nil {
 		if closeErr := c.conn.Close(); closeErr != nil && err == nil {
 			err = closeErr
 		}
-		c.conn = nil
 	}
 	return err
 }
@@ -103,31 +234,40 @@ func (c *Client) Reconnect(maxRetries int) error {
 	backoff := 1 * time.Second
 
 	for retries < maxRetries {
+		if c.isClosed() {
+			return fmt.Errorf("client is closed")
+		}
+
 		log.Printf("Attempting to reconnect to RabbitMQ (attempt %d/%d)", retries+1, maxRetries)
 
-		if c.conn, err = amqp.Dial(c.url); err == nil {
-			if c.channel, err = c.conn.Channel(); err == nil {
-				// Re-declare exchange
-				err = c.channel.ExchangeDeclare(
-					c.ExchangeName, // exchange name
-					"topic",        // exchange type
-					true,           // durable
-					false,          // auto-deleted
-					false,          // internal
-					false,          // no-wait
-					nil,            // arguments
-				)
-				if err == nil {
-					log.Println("Successfully reconnected to RabbitMQ")
-					return nil
-				}
+		var conn *amqp.Connection
+		var channel *amqp.Channel
+		if conn, channel, err = c.connect(); err == nil {
+			c.mu.Lock()
+			if c.isClosed() {
+				c.mu.Unlock()
+				conn.Close()
+				return fmt.Errorf("client is closed")
+			}
+			if c.conn != nil {
+				c.conn.Close()
 			}
-			// Close connection if channel creation failed
-			c.conn.Close()
+			c.conn = conn
+			c.channel = channel
+			close(c.reconnected)
+			c.reconnected = make(chan struct{})
+			c.mu.Unlock()
+
+			log.Println("Successfully reconnected to RabbitMQ")
+			return nil
 		}
 
 		log.Printf("Failed to reconnect: %v. Retrying in %v", err, backoff)
-		time.Sleep(backoff)
+		select {
+		case <-time.After(backoff):
+		case <-c.done:
+			return fmt.Errorf("client is closed")
+		}
 
 		// Exponential backoff with a cap
 		backoff *= 2
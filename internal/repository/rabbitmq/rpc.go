@@ -0,0 +1,197 @@
+package rabbitmq
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Gaoey/scale-websocket/internal/repository/broker"
+	"github.com/streadway/amqp"
+)
+
+var _ broker.RPC = (*Client)(nil)
+
+// headerRPCError marks a reply that carries the error returned by the handler
+const headerRPCError = "x-rpc-error"
+
+// replyQueue is the exclusive callback queue of a client. It lives as long
+// as the connection it was declared on.
+type replyQueue struct {
+	mu      sync.Mutex
+	name    string
+	stale   <-chan struct{}
+	pending map[string]chan amqp.Delivery
+}
+
+// Call publishes req to routingKey with a reply_to pointing at the client's
+// callback queue and waits for the reply with the same correlation ID. The
+// request expires on the broker together with ctx, so servers do not answer
+// callers that have given up.
+func (c *Client) Call(ctx context.Context, routingKey string, req Message) (Message, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.publishTimeout)
+		defer cancel()
+	}
+
+	var meta broker.Metadata
+	body, err := broker.Encode(req, &meta)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	replyTo, err := c.ensureReplyQueue()
+	if err != nil {
+		return nil, err
+	}
+
+	correlationID := broker.NewMessageID()
+	reply := make(chan amqp.Delivery, 1)
+	c.replies.mu.Lock()
+	c.replies.pending[correlationID] = reply
+	c.replies.mu.Unlock()
+
+	defer func() {
+		c.replies.mu.Lock()
+		delete(c.replies.pending, correlationID)
+		c.replies.mu.Unlock()
+	}()
+
+	deadline, _ := ctx.Deadline()
+	ttl := time.Until(deadline).Milliseconds()
+	if ttl < 1 {
+		return nil, context.DeadlineExceeded
+	}
+
+	err = c.publish(ctx, c.ExchangeName, routingKey, true, amqp.Publishing{
+		ContentType:   meta.ContentType,
+		Type:          meta.Type,
+		CorrelationId: correlationID,
+		MessageId:     correlationID,
+		ReplyTo:       replyTo,
+		Expiration:    strconv.FormatInt(ttl, 10),
+		Body:          body,
+		DeliveryMode:  amqp.Transient,
+		Timestamp:     time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case d := <-reply:
+		if reason, ok := d.Headers[headerRPCError].(string); ok {
+			return nil, &broker.RPCError{Message: reason}
+		}
+		return broker.Decode(d.Body, broker.Metadata{ContentType: d.ContentType, Type: d.Type}, false)
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for reply from %s: %w", routingKey, ctx.Err())
+	}
+}
+
+// ensureReplyQueue returns the callback queue, declaring it and starting its
+// dispatcher when there is none on the current connection yet
+func (c *Client) ensureReplyQueue() (string, error) {
+	c.replies.mu.Lock()
+	defer c.replies.mu.Unlock()
+
+	if c.replies.name != "" {
+		select {
+		case <-c.replies.stale:
+		default:
+			return c.replies.name, nil
+		}
+	}
+
+	c.mu.RLock()
+	conn, stale := c.conn, c.reconnected
+	c.mu.RUnlock()
+
+	channel, err := conn.Channel()
+	if err != nil {
+		return "", fmt.Errorf("failed to open a reply channel: %w", err)
+	}
+
+	q, err := channel.QueueDeclare(
+		"",    // server-named queue
+		false, // durable
+		true,  // delete when unused
+		true,  // exclusive
+		false, // no-wait
+		nil,   // arguments
+	)
+	if err != nil {
+		channel.Close()
+		return "", fmt.Errorf("failed to declare reply queue: %w", err)
+	}
+
+	msgs, err := channel.Consume(
+		q.Name, // queue
+		"",     // consumer tag
+		true,   // auto-ack
+		true,   // exclusive
+		false,  // no-local
+		false,  // no-wait
+		nil,    // args
+	)
+	if err != nil {
+		channel.Close()
+		return "", fmt.Errorf("failed to consume reply queue: %w", err)
+	}
+
+	c.replies.name = q.Name
+	c.replies.stale = stale
+
+	go func() {
+		for d := range msgs {
+			c.replies.mu.Lock()
+			reply, ok := c.replies.pending[d.CorrelationId]
+			c.replies.mu.Unlock()
+
+			if !ok {
+				log.Printf("Dropping reply for unknown correlation ID %s", d.CorrelationId)
+				continue
+			}
+			select {
+			case reply <- d:
+			default:
+				log.Printf("Dropping duplicate reply for correlation ID %s", d.CorrelationId)
+			}
+		}
+	}()
+
+	log.Printf("Declared reply queue: %s", q.Name)
+	return q.Name, nil
+}
+
+// Serve answers requests published to routingKey. Requests are consumed from a
+// queue shared by every node, so each one is answered once.
+func (c *Client) Serve(routingKey string, handler broker.RPCHandler) (broker.Consumer, error) {
+	return c.StartConsumer(context.Background(), broker.RPCQueueName(routingKey), []string{routingKey}, func(req broker.Delivery) error {
+		if req.ReplyTo == "" {
+			return fmt.Errorf("request %s has no reply_to", req.MessageID)
+		}
+
+		publishing := amqp.Publishing{
+			CorrelationId: req.CorrelationID,
+			DeliveryMode:  amqp.Transient,
+			Timestamp:     time.Now(),
+		}
+
+		// Replies are encoded like the request they answer
+		meta := broker.Metadata{ContentType: req.ContentType}
+		resp, err := handler(req)
+		if err != nil {
+			publishing.Headers = amqp.Table{headerRPCError: err.Error()}
+		} else if publishing.Body, err = broker.Encode(resp, &meta); err != nil {
+			publishing.Headers = amqp.Table{headerRPCError: "failed to encode response"}
+		}
+		publishing.ContentType, publishing.Type = meta.ContentType, meta.Type
+
+		// Replies go straight to the caller's callback queue through the default exchange
+		return c.publish(context.Background(), "", req.ReplyTo, false, publishing)
+	})
+}
@@ -0,0 +1,160 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Gaoey/scale-websocket/internal/repository/broker"
+)
+
+// bindingsRefresh is how long the bindings cached for publishing are used
+// before they are read again, which catches changes whose notification was
+// lost
+const bindingsRefresh = 30 * time.Second
+
+// bindingsCache holds the routing keys of every durable queue by queue name
+type bindingsCache struct {
+	mu     sync.Mutex
+	queues map[string][]string
+	at     time.Time
+}
+
+// bindingsKey is the hash of the routing keys each durable queue is bound to
+func (c *Client) bindingsKey() string {
+	return c.ExchangeName + ":bindings"
+}
+
+// bindingsChannel is the Pub/Sub channel a change to the bindings is announced
+// on. Routing key channels are all named <exchange>:<key>, so no pattern
+// subscription of a queue ever matches it.
+func (c *Client) bindingsChannel() string {
+	return c.ExchangeName + ".bindings"
+}
+
+// watchBindings drops the cached bindings whenever a queue is declared or
+// removed, on this node or any other. They are dropped as well each time the
+// subscription is established again after a connection loss, since changes
+// announced in between were missed.
+func (c *Client) watchBindings() error {
+	ctx := context.Background()
+	ps := c.rdb.Subscribe(ctx, c.bindingsChannel())
+	if _, err := ps.Receive(ctx); err != nil {
+		ps.Close()
+		return fmt.Errorf("failed to subscribe to %s: %w", c.bindingsChannel(), err)
+	}
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		<-c.done
+		ps.Close()
+	}()
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		for {
+			// Subscription confirmations, which follow a reconnect, and
+			// notifications alike
+			_, err := ps.Receive(ctx)
+			c.invalidateBindings()
+			if err == nil {
+				continue
+			}
+			if c.isClosed() {
+				return
+			}
+			select {
+			case <-c.done:
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}()
+	return nil
+}
+
+// readBindings returns the routing keys of every durable queue by queue name
+func (c *Client) readBindings(ctx context.Context) (map[string][]string, error) {
+	raw, err := c.rdb.HGetAll(ctx, c.bindingsKey()).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read queue bindings: %w", err)
+	}
+
+	bindings := make(map[string][]string, len(raw))
+	for queueName, encoded := range raw {
+		var keys []string
+		if err := json.Unmarshal([]byte(encoded), &keys); err != nil {
+			continue
+		}
+		bindings[queueName] = keys
+	}
+	return bindings, nil
+}
+
+// routes returns the durable queues bound to routingKey, from the cached
+// bindings
+func (c *Client) routes(ctx context.Context, routingKey string) ([]string, error) {
+	c.bindings.mu.Lock()
+	defer c.bindings.mu.Unlock()
+
+	if c.bindings.queues == nil || time.Since(c.bindings.at) >= bindingsRefresh {
+		queues, err := c.readBindings(ctx)
+		if err != nil {
+			return nil, err
+		}
+		c.bindings.queues, c.bindings.at = queues, time.Now()
+	}
+
+	var matched []string
+	for queueName, keys := range c.bindings.queues {
+		for _, pattern := range keys {
+			if broker.MatchRoutingKey(pattern, routingKey) {
+				matched = append(matched, queueName)
+				break
+			}
+		}
+	}
+	return matched, nil
+}
+
+// invalidateBindings makes the next publish read the bindings again
+func (c *Client) invalidateBindings() {
+	c.bindings.mu.Lock()
+	defer c.bindings.mu.Unlock()
+	c.bindings.queues = nil
+}
+
+// sweep removes the expiring queues whose consumers have all been gone for
+// longer than their expiry, together with their own and dead-letter streams
+func (c *Client) sweep(ctx context.Context) error {
+	queues, err := c.rdb.SMembers(ctx, c.expiringKey()).Result()
+	if err != nil {
+		return err
+	}
+
+	for _, queueName := range queues {
+		alive, err := c.rdb.Exists(ctx, c.aliveKey(queueName)).Result()
+		if err != nil {
+			return err
+		}
+		if alive > 0 {
+			continue
+		}
+
+		log.Printf("Removing expired queue %s", queueName)
+		pipe := c.rdb.TxPipeline()
+		pipe.Del(ctx, c.queueKey(queueName), c.deadKey(queueName))
+		pipe.HDel(ctx, c.bindingsKey(), queueName)
+		pipe.SRem(ctx, c.expiringKey(), queueName)
+		pipe.Publish(ctx, c.bindingsChannel(), queueName)
+		if _, err := pipe.Exec(ctx); err != nil {
+			log.Printf("Failed to remove expired queue %s: %v", queueName, err)
+		}
+	}
+	return nil
+}
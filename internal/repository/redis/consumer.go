@@ -0,0 +1,511 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Gaoey/scale-websocket/internal/repository/broker"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+// defaultReadCount is how many stream entries are read at once when the
+// consumer sets no prefetch
+const defaultReadCount = 100
+
+// consumer is a running consumer of a stream consumer group or of a pattern
+// subscription
+type consumer struct {
+	client      *Client
+	queueName   string
+	routingKeys []string
+	handler     broker.ConsumeFunc
+	opts        broker.ConsumerOptions
+	// name identifies the consumer within its group
+	name    string
+	workers *broker.WorkerPool
+	// retries receives failed messages once their retry delay has passed
+	retries chan message
+	// pubsub is the pattern subscription, nil for stream consumers
+	pubsub *goredis.PubSub
+
+	// inflight holds the stream entries this consumer is handling or
+	// waiting to retry, which claim must not hand out a second time
+	mu       sync.Mutex
+	inflight map[string]struct{}
+
+	stopping chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// StartConsumer consumes the messages matching routingKeys. Durable queues
+// read from a consumer group named after the queue, other queue modes
+// subscribe to the matching channels and only see messages published while
+// they are connected.
+func (c *Client) StartConsumer(ctx context.Context, queueName string, routingKeys []string, handler broker.ConsumeFunc, opts ...broker.ConsumerOption) (broker.Consumer, error) {
+	log.Printf("Starting consumer for queue: %s with routing keys: %v", queueName, routingKeys)
+
+	options := broker.NewConsumerOptions(opts...)
+
+	cons := &consumer{
+		client:      c,
+		queueName:   queueName,
+		routingKeys: routingKeys,
+		handler:     options.Wrap(handler),
+		opts:        options,
+		name:        fmt.Sprintf("%s.%s", queueName, broker.NewMessageID()),
+		retries:     make(chan message),
+		inflight:    make(map[string]struct{}),
+		stopping:    make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+
+	var (
+		msgs <-chan message
+		err  error
+	)
+	if options.QueueMode == broker.QueueDurable {
+		msgs, err = cons.subscribeStream(ctx)
+	} else {
+		msgs, err = cons.subscribePubSub(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cons.workers = broker.NewWorkerPool(options.Workers)
+
+	go cons.run(ctx, msgs)
+
+	return cons, nil
+}
+
+// subscribeStream declares the queue's stream and consumer group, records
+// its bindings so publishers copy matching messages to it, then starts
+// reading it
+func (c *consumer) subscribeStream(ctx context.Context) (<-chan message, error) {
+	if err := c.client.sweep(ctx); err != nil {
+		log.Printf("Failed to remove expired queues: %v", err)
+	}
+
+	if err := c.declareGroup(ctx); err != nil {
+		return nil, err
+	}
+
+	bindings, err := json.Marshal(c.routingKeys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal bindings: %w", err)
+	}
+
+	pipe := c.client.rdb.TxPipeline()
+	pipe.HSet(ctx, c.client.bindingsKey(), c.queueName, bindings)
+	pipe.Publish(ctx, c.client.bindingsChannel(), c.queueName)
+	if c.opts.QueueExpires > 0 {
+		pipe.SAdd(ctx, c.client.expiringKey(), c.queueName)
+		pipe.Set(ctx, c.client.aliveKey(c.queueName), c.name, c.opts.QueueExpires)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to register queue %s: %w", c.queueName, err)
+	}
+	// The notification arrives asynchronously, publishes from here must see
+	// the queue right away
+	c.client.invalidateBindings()
+
+	msgs := make(chan message)
+	go c.readStream(msgs)
+	return msgs, nil
+}
+
+// declareGroup creates the queue's stream and its consumer group, which
+// starts at the beginning of the stream since the stream only ever holds
+// messages addressed to the queue
+func (c *consumer) declareGroup(ctx context.Context) error {
+	stream := c.client.queueKey(c.queueName)
+	err := c.client.rdb.XGroupCreateMkStream(ctx, stream, c.queueName, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return fmt.Errorf("failed to create consumer group %s on %s: %w", c.queueName, stream, err)
+	}
+	return nil
+}
+
+// readStream reads new entries for this consumer until it stops
+func (c *consumer) readStream(out chan<- message) {
+	defer close(out)
+
+	count := int64(c.opts.Prefetch)
+	if count <= 0 {
+		count = defaultReadCount
+	}
+	streams := []string{c.client.queueKey(c.queueName), ">"}
+
+	for !c.isStopping() && !c.client.isClosed() {
+		res, err := c.client.rdb.XReadGroup(context.Background(), &goredis.XReadGroupArgs{
+			Group:    c.queueName,
+			Consumer: c.name,
+			Streams:  streams,
+			Count:    count,
+			Block:    time.Second,
+		}).Result()
+		if errors.Is(err, goredis.Nil) {
+			continue
+		}
+		if err != nil {
+			if c.isStopping() || c.client.isClosed() {
+				return
+			}
+			log.Printf("Failed to read queue %s: %v", c.queueName, err)
+			if strings.HasPrefix(err.Error(), "NOGROUP") {
+				// The group was removed as expired while we were away
+				if err := c.declareGroup(context.Background()); err != nil {
+					log.Printf("Failed to declare queue %s again: %v", c.queueName, err)
+				}
+			}
+			select {
+			case <-time.After(time.Second):
+			case <-c.stopping:
+				return
+			}
+			continue
+		}
+
+		for _, stream := range res {
+			for _, entry := range stream.Messages {
+				m, err := fromStream(stream.Stream, entry)
+				if err != nil {
+					c.client.deadLetter(c.queueName, m, err)
+					continue
+				}
+				select {
+				case out <- m:
+				case <-c.stopping:
+					return
+				}
+			}
+		}
+	}
+}
+
+// subscribePubSub subscribes to the channels matching the routing keys
+func (c *consumer) subscribePubSub(ctx context.Context) (<-chan message, error) {
+	patterns := make([]string, len(c.routingKeys))
+	for i, key := range c.routingKeys {
+		patterns[i] = c.client.channelPattern(key)
+	}
+
+	ps := c.client.rdb.PSubscribe(ctx, patterns...)
+	if _, err := ps.Receive(ctx); err != nil {
+		ps.Close()
+		return nil, fmt.Errorf("failed to subscribe to %v: %w", patterns, err)
+	}
+	c.pubsub = ps
+
+	msgs := make(chan message)
+	go func() {
+		defer close(msgs)
+		for pm := range ps.Channel() {
+			var env envelope
+			if err := json.Unmarshal([]byte(pm.Payload), &env); err != nil {
+				log.Printf("Dropping malformed message on %s: %v", pm.Channel, err)
+				continue
+			}
+			select {
+			case msgs <- message{meta: env.Meta, body: env.Body}:
+			case <-c.stopping:
+				return
+			}
+		}
+	}()
+	return msgs, nil
+}
+
+// run dispatches messages to the workers until ctx is cancelled, the
+// consumer is shut down or the client is closed, then waits for the handlers
+// still in flight
+func (c *consumer) run(ctx context.Context, msgs <-chan message) {
+	defer close(c.done)
+	defer log.Printf("Consumer for queue %s has fully stopped", c.queueName)
+	defer c.unregister()
+	defer c.workers.Close()
+	defer c.stop()
+
+	var claims, heartbeats <-chan time.Time
+	if c.pubsub == nil {
+		claimTicker := time.NewTicker(c.client.claimIdle / 2)
+		defer claimTicker.Stop()
+		claims = claimTicker.C
+
+		if c.opts.QueueExpires > 0 {
+			heartbeatTicker := time.NewTicker(c.opts.QueueExpires / 3)
+			defer heartbeatTicker.Stop()
+			heartbeats = heartbeatTicker.C
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("Context cancelled for consumer %s", c.queueName)
+			return
+		case <-c.stopping:
+			return
+		case <-c.client.done:
+			return
+		case m, ok := <-msgs:
+			if !ok || !c.dispatch(ctx, m) {
+				return
+			}
+		case m := <-c.retries:
+			if !c.dispatch(ctx, m) {
+				return
+			}
+		case <-claims:
+			for _, m := range c.claim() {
+				if !c.dispatch(ctx, m) {
+					return
+				}
+			}
+		case <-heartbeats:
+			err := c.client.rdb.Set(context.Background(), c.client.aliveKey(c.queueName), c.name, c.opts.QueueExpires).Err()
+			if err != nil {
+				log.Printf("Failed to keep queue %s alive: %v", c.queueName, err)
+			}
+		}
+	}
+}
+
+// dispatch decodes a message and hands it to a worker. It returns false when
+// ctx is cancelled before a worker takes it, leaving stream entries pending
+// for another consumer to claim.
+func (c *consumer) dispatch(ctx context.Context, m message) bool {
+	// Channel patterns carry more than the queue is bound to, stream entries
+	// were addressed to the queue by the publisher
+	if m.stream == "" && !c.matches(m.meta.RoutingKey) {
+		return true
+	}
+	c.track(m)
+
+	msg, err := broker.Decode(m.body, m.meta, c.opts.Raw)
+	if err != nil {
+		log.Printf("Error unmarshaling message: %v", err)
+		// A body that cannot be decoded will never succeed, skip the retries
+		c.fail(m, broker.Permanent(err))
+		return true
+	}
+
+	delivery := broker.Delivery{
+		Metadata: m.meta,
+		Message:  msg,
+		Body:     m.body,
+	}
+	job := func() {
+		c.handle(m, delivery)
+	}
+	if !c.workers.Submit(ctx, c.opts.Key(delivery), job) {
+		log.Printf("Context cancelled for consumer %s", c.queueName)
+		c.untrack(m)
+		return false
+	}
+	return true
+}
+
+// track records a stream entry as being handled by this consumer
+func (c *consumer) track(m message) {
+	if m.stream == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inflight[m.id] = struct{}{}
+}
+
+func (c *consumer) untrack(m message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.inflight, m.id)
+}
+
+func (c *consumer) isInflight(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.inflight[id]
+	return ok
+}
+
+// handle runs the handler for a single message and acknowledges it
+func (c *consumer) handle(m message, delivery broker.Delivery) {
+	if err := c.handler(delivery); err != nil {
+		log.Printf("Error handling message from %s: %v", c.queueName, err)
+		c.fail(m, err)
+		return
+	}
+
+	c.ack(m)
+	log.Printf("Successfully processed and acknowledged message from %s", c.queueName)
+}
+
+// fail schedules a retry of m, or dead-letters it once its attempts are used up
+func (c *consumer) fail(m message, cause error) {
+	m.attempts++
+
+	if m.attempts >= c.opts.MaxAttempts || errors.Is(cause, broker.ErrPermanent) {
+		log.Printf("Dead-lettering message from %s after %d attempts: %v", c.queueName, m.attempts, cause)
+		c.client.deadLetter(c.queueName, m, cause)
+		c.untrack(m)
+		return
+	}
+
+	// Stream entries stay pending while they wait, so a consumer that stops
+	// in the meantime leaves them to be claimed by another one
+	log.Printf("Retrying message from %s in %v (attempt %d/%d): %v", c.queueName, c.opts.RetryDelay, m.attempts, c.opts.MaxAttempts, cause)
+	time.AfterFunc(c.opts.RetryDelay, func() {
+		select {
+		case c.retries <- m:
+		case <-c.stopping:
+		case <-c.client.done:
+		}
+	})
+}
+
+// ack acknowledges a stream entry and deletes it. Each stream is read by
+// its queue's group only, so nobody else still needs the entry.
+func (c *consumer) ack(m message) {
+	if m.stream == "" {
+		return
+	}
+	defer c.untrack(m)
+
+	ctx := context.Background()
+	pipe := c.client.rdb.TxPipeline()
+	pipe.XAck(ctx, m.stream, c.queueName, m.id)
+	pipe.XDel(ctx, m.stream, m.id)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Error acknowledging message from %s: %v", c.queueName, err)
+	}
+}
+
+func (c *consumer) matches(routingKey string) bool {
+	for _, pattern := range c.routingKeys {
+		if broker.MatchRoutingKey(pattern, routingKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// claim takes over the entries other consumers of the queue have left
+// unacknowledged for too long, typically because they crashed. The idle time
+// allows for the retry delay, during which entries are pending on purpose.
+// Entries this consumer is still working on are claimed too, which only
+// resets their idle time, but are not handed out again.
+func (c *consumer) claim() []message {
+	ctx := context.Background()
+	minIdle := c.client.claimIdle + c.opts.RetryDelay
+	stream := c.client.queueKey(c.queueName)
+
+	var claimed []message
+	start := "0-0"
+	for {
+		entries, next, err := c.client.rdb.XAutoClaim(ctx, &goredis.XAutoClaimArgs{
+			Stream:   stream,
+			Group:    c.queueName,
+			Consumer: c.name,
+			MinIdle:  minIdle,
+			Start:    start,
+			Count:    defaultReadCount,
+		}).Result()
+		if err != nil {
+			if !errors.Is(err, goredis.Nil) {
+				log.Printf("Failed to claim pending messages of %s: %v", c.queueName, err)
+			}
+			break
+		}
+
+		for _, entry := range entries {
+			if c.isInflight(entry.ID) {
+				continue
+			}
+			m, err := fromStream(stream, entry)
+			if err != nil {
+				c.client.deadLetter(c.queueName, m, err)
+				continue
+			}
+			claimed = append(claimed, m)
+		}
+
+		if next == "0-0" || next == "" {
+			break
+		}
+		start = next
+	}
+
+	if len(claimed) > 0 {
+		log.Printf("Claimed %d pending messages of %s", len(claimed), c.queueName)
+	}
+	return claimed
+}
+
+// Shutdown stops reading new messages, lets the messages already received
+// finish and be acknowledged, and returns once the consumer has fully stopped
+// or ctx expires. Stream entries still unacknowledged by then are claimed by
+// the other consumers of the queue.
+func (c *consumer) Shutdown(ctx context.Context) error {
+	c.stop()
+
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("consumer for queue %s did not drain: %w", c.queueName, ctx.Err())
+	}
+}
+
+// Done is closed once the consumer has stopped and its handlers have returned
+func (c *consumer) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *consumer) stop() {
+	c.stopOnce.Do(func() {
+		close(c.stopping)
+		if c.pubsub != nil {
+			if err := c.pubsub.Close(); err != nil {
+				log.Printf("Failed to unsubscribe consumer %s: %v", c.name, err)
+			}
+		}
+	})
+}
+
+func (c *consumer) isStopping() bool {
+	select {
+	case <-c.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// unregister removes the consumer from its group once it has nothing left
+// pending, so groups do not collect the names of every consumer they had
+func (c *consumer) unregister() {
+	if c.pubsub != nil || c.client.isClosed() {
+		return
+	}
+
+	ctx := context.Background()
+	stream := c.client.queueKey(c.queueName)
+	consumers, err := c.client.rdb.XInfoConsumers(ctx, stream, c.queueName).Result()
+	if err != nil {
+		return
+	}
+	for _, info := range consumers {
+		if info.Name == c.name && info.Pending == 0 {
+			c.client.rdb.XGroupDelConsumer(ctx, stream, c.queueName, c.name)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/Gaoey/scale-websocket/internal/repository/broker"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+// deadLetter moves m to the dead-letter stream of a queue and acknowledges
+// and deletes it in the same transaction
+func (c *Client) deadLetter(queueName string, m message, cause error) {
+	ctx := context.Background()
+
+	values, err := streamValues(m.meta, m.body)
+	if err != nil {
+		log.Printf("Failed to dead-letter message from %s: %v", queueName, err)
+		return
+	}
+	values = append(values,
+		"attempts", m.attempts,
+		"reason", cause.Error(),
+		"failed_at", time.Now().UTC().Format(time.RFC3339Nano),
+	)
+
+	pipe := c.rdb.TxPipeline()
+	pipe.XAdd(ctx, &goredis.XAddArgs{
+		Stream: c.deadKey(queueName),
+		MaxLen: c.deadMaxLen,
+		Approx: true,
+		Values: values,
+	})
+	if m.stream != "" {
+		pipe.XAck(ctx, m.stream, queueName, m.id)
+		pipe.XDel(ctx, m.stream, m.id)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		// The entry stays pending and is claimed again later
+		log.Printf("Failed to dead-letter message from %s: %v", queueName, err)
+	}
+}
+
+// DeadLetters returns up to limit dead letters of a queue without removing them
+func (c *Client) DeadLetters(ctx context.Context, queueName string, limit int) ([]broker.DeadLetter, error) {
+	entries, err := c.rdb.XRangeN(ctx, c.deadKey(queueName), "-", "+", int64(limit)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dead letters: %w", err)
+	}
+
+	letters := make([]broker.DeadLetter, 0, len(entries))
+	for _, entry := range entries {
+		letters = append(letters, toDeadLetter(entry))
+	}
+	return letters, nil
+}
+
+// ReplayDeadLetters moves up to limit dead letters to the queue's own stream,
+// so only the queue they failed on receives them again
+func (c *Client) ReplayDeadLetters(ctx context.Context, queueName string, limit int) (int, error) {
+	entries, err := c.rdb.XRangeN(ctx, c.deadKey(queueName), "-", "+", int64(limit)).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read dead letters: %w", err)
+	}
+
+	replayed := 0
+	for _, entry := range entries {
+		m, err := fromStream("", entry)
+		if err != nil {
+			return replayed, err
+		}
+		values, err := streamValues(m.meta, m.body)
+		if err != nil {
+			return replayed, err
+		}
+
+		pipe := c.rdb.TxPipeline()
+		pipe.XAdd(ctx, &goredis.XAddArgs{
+			Stream: c.queueKey(queueName),
+			Values: values,
+		})
+		pipe.XDel(ctx, c.deadKey(queueName), entry.ID)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return replayed, fmt.Errorf("failed to replay dead letter: %w", err)
+		}
+		replayed++
+	}
+
+	log.Printf("Replayed %d dead letters to %s", replayed, queueName)
+	return replayed, nil
+}
+
+func toDeadLetter(entry goredis.XMessage) broker.DeadLetter {
+	m, _ := fromStream("", entry)
+
+	letter := broker.DeadLetter{
+		MessageID:  m.meta.MessageID,
+		RoutingKey: m.meta.RoutingKey,
+		Body:       string(m.body),
+	}
+	if attempts, ok := entry.Values["attempts"].(string); ok {
+		letter.Attempts, _ = strconv.Atoi(attempts)
+	}
+	if reason, ok := entry.Values["reason"].(string); ok {
+		letter.Reason = reason
+	}
+	if failedAt, ok := entry.Values["failed_at"].(string); ok {
+		letter.FailedAt, _ = time.Parse(time.RFC3339Nano, failedAt)
+	}
+	return letter
+}
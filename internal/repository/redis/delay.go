@@ -0,0 +1,130 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/Gaoey/scale-websocket/internal/repository/broker"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+const (
+	// schedulerInterval is how often due delayed messages are looked for
+	schedulerInterval = 500 * time.Millisecond
+	// schedulerBatch caps the messages taken by one run of the script
+	schedulerBatch = 100
+	// releaseTimeout is how long a node has to publish the messages it took.
+	// Messages it has not finished by then, because it crashed, are taken
+	// over by the next node that polls.
+	releaseTimeout = 30 * time.Second
+)
+
+// takeDue moves due delayed messages to the releasing set and returns them,
+// together with the messages whose release was started too long ago. It runs
+// as one script, so with many nodes polling the same set each message is
+// taken by one of them, and it declares every key it touches so it runs on
+// Redis Cluster.
+var takeDue = goredis.NewScript(`
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, m in ipairs(due) do
+	redis.call('ZREM', KEYS[1], m)
+end
+local stale = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[3], 'LIMIT', 0, ARGV[2])
+for _, m in ipairs(stale) do
+	table.insert(due, m)
+end
+for _, m in ipairs(due) do
+	redis.call('ZADD', KEYS[2], ARGV[1], m)
+end
+return due
+`)
+
+// delayedSetKey is the sorted set of delayed messages, scored by due time.
+// Members are the message envelopes, so storing a message is a single ZADD.
+func (c *Client) delayedSetKey() string {
+	return c.ExchangeName + ":{delayed}"
+}
+
+// releasingKey is the sorted set of messages being released, scored by the
+// time their release started. It shares the hash tag of delayedSetKey so
+// takeDue can touch both on Redis Cluster.
+func (c *Client) releasingKey() string {
+	return c.ExchangeName + ":{delayed}:releasing"
+}
+
+// schedule releases delayed messages as they come due until the client is closed
+func (c *Client) schedule() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		for {
+			released, err := c.releaseDue()
+			if err != nil {
+				log.Printf("Failed to release delayed messages: %v", err)
+				break
+			}
+			if released < schedulerBatch {
+				break
+			}
+		}
+	}
+}
+
+// releaseDue publishes the messages that have come due. A message leaves the
+// releasing set only once it is published, so a crash in between publishes it
+// again with the same message ID rather than losing it.
+func (c *Client) releaseDue() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	due, err := takeDue.Run(ctx, c.rdb,
+		[]string{c.delayedSetKey(), c.releasingKey()},
+		strconv.FormatInt(now.UnixMilli(), 10),
+		schedulerBatch,
+		strconv.FormatInt(now.Add(-releaseTimeout).UnixMilli(), 10),
+	).StringSlice()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, member := range due {
+		if err := c.release(ctx, member); err != nil {
+			return 0, err
+		}
+	}
+	return len(due), nil
+}
+
+// release publishes one delayed message and removes it from the releasing set
+func (c *Client) release(ctx context.Context, member string) error {
+	var env envelope
+	if err := json.Unmarshal([]byte(member), &env); err != nil {
+		log.Printf("Dropping malformed delayed message: %v", err)
+		return c.rdb.ZRem(ctx, c.releasingKey(), member).Err()
+	}
+
+	pipe := c.rdb.Pipeline()
+	if _, err := c.enqueue(ctx, pipe, env.Meta, env.Body, broker.PublishOptions{}); err != nil {
+		return err
+	}
+	cmds, _ := pipe.Exec(ctx)
+	if err := commandsErr(cmds); err != nil {
+		return fmt.Errorf("failed to publish delayed message %s: %w", env.Meta.MessageID, err)
+	}
+
+	return c.rdb.ZRem(ctx, c.releasingKey(), member).Err()
+}
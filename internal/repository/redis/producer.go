@@ -0,0 +1,196 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/Gaoey/scale-websocket/internal/repository/broker"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+// Publish appends the message to the stream of every durable queue bound to
+// its routing key and publishes it on the channel of the routing key.
+// Mandatory publishes fail with broker.ErrUnroutable when neither a
+// subscriber nor a durable queue receives the message. Delayed messages are
+// stored in Redis until they are due, so they survive restarts.
+func (c *Client) Publish(ctx context.Context, routingKey string, msg broker.Message, opts ...broker.PublishOption) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	options := broker.NewPublishOptions(opts...)
+	meta := options.Metadata
+	meta.RoutingKey = routingKey
+
+	body, err := broker.Encode(msg, &meta)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	if broker.IsJSON(meta.ContentType) {
+		log.Printf("Publishing message to routing key %s: %s", routingKey, body)
+	} else {
+		log.Printf("Publishing %d byte %s message to routing key %s", len(body), meta.ContentType, routingKey)
+	}
+
+	// The queue streams may live on different cluster nodes, so the copies
+	// are pipelined rather than sent in one transaction
+	pipe := c.rdb.Pipeline()
+	r, err := c.enqueue(ctx, pipe, meta, body, options)
+	if err != nil {
+		return err
+	}
+	cmds, _ := pipe.Exec(ctx)
+	if err := commandsErr(cmds); err != nil {
+		return fmt.Errorf("failed to publish message: %w", err)
+	}
+
+	if options.Mandatory && r.reached() == 0 {
+		return &broker.UnroutableError{RoutingKey: routingKey, Reason: "NO_ROUTE"}
+	}
+	return nil
+}
+
+// PublishBatch sends msgs to Redis in a single pipeline and reports the
+// outcome of each message
+func (c *Client) PublishBatch(ctx context.Context, msgs []broker.BatchMessage) []error {
+	errs := make([]error, len(msgs))
+	if ctx.Err() != nil {
+		for i := range errs {
+			errs[i] = ctx.Err()
+		}
+		return errs
+	}
+
+	type queued struct {
+		index     int
+		mandatory bool
+		routing   string
+		cmds      int // commands queued on the pipeline for the message
+		routed    routed
+	}
+
+	pipe := c.rdb.Pipeline()
+	batch := make([]queued, 0, len(msgs))
+	for i, m := range msgs {
+		options := broker.NewPublishOptions(m.Options...)
+		meta := options.Metadata
+		meta.RoutingKey = m.RoutingKey
+
+		body, err := broker.Encode(m.Message, &meta)
+		if err != nil {
+			errs[i] = fmt.Errorf("failed to marshal message: %w", err)
+			continue
+		}
+
+		before := pipe.Len()
+		r, err := c.enqueue(ctx, pipe, meta, body, options)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		batch = append(batch, queued{
+			index:     i,
+			mandatory: options.Mandatory,
+			routing:   m.RoutingKey,
+			cmds:      pipe.Len() - before,
+			routed:    r,
+		})
+	}
+
+	log.Printf("Publishing batch of %d messages", len(batch))
+	// Exec reports the first failure only, every command keeps its own error
+	cmds, _ := pipe.Exec(ctx)
+
+	// Commands come back in the order they were queued
+	next := 0
+	for _, q := range batch {
+		if err := commandsErr(cmds[next : next+q.cmds]); err != nil {
+			errs[q.index] = fmt.Errorf("failed to publish message: %w", err)
+		}
+		next += q.cmds
+
+		if errs[q.index] == nil && q.mandatory && q.routed.reached() == 0 {
+			errs[q.index] = &broker.UnroutableError{RoutingKey: q.routing, Reason: "NO_ROUTE"}
+		}
+	}
+	return errs
+}
+
+// routed holds the commands that deliver one message
+type routed struct {
+	// streams are the appends to the bound queues, which come back empty
+	// for a queue removed since the bindings were read
+	streams []*goredis.StringCmd
+	// receivers counts the subscribers reached, nil for delayed messages
+	receivers *goredis.IntCmd
+}
+
+// reached is how many queues and subscribers received the message. Delayed
+// messages count as received once they are stored.
+func (r routed) reached() int64 {
+	if r.receivers == nil {
+		return 1
+	}
+	n := r.receivers.Val()
+	for _, cmd := range r.streams {
+		if cmd.Err() == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// enqueue queues the commands that publish a message on pipe: an append to
+// the stream of every durable queue bound to its routing key and a PUBLISH
+// for the subscribers, or a single ZADD when the message is delayed
+func (c *Client) enqueue(ctx context.Context, pipe goredis.Pipeliner, meta broker.Metadata, body []byte, options broker.PublishOptions) (routed, error) {
+	env, err := json.Marshal(envelope{Meta: meta, Body: body})
+	if err != nil {
+		return routed{}, fmt.Errorf("failed to marshal envelope: %w", err)
+	}
+
+	if options.Delay() > 0 {
+		pipe.ZAdd(ctx, c.delayedSetKey(), goredis.Z{
+			Score:  float64(options.DeliverAt.UnixMilli()),
+			Member: env,
+		})
+		return routed{}, nil
+	}
+
+	queues, err := c.routes(ctx, meta.RoutingKey)
+	if err != nil {
+		return routed{}, err
+	}
+	values, err := streamValues(meta, body)
+	if err != nil {
+		return routed{}, err
+	}
+
+	var r routed
+	for _, queueName := range queues {
+		// Streams are created with the queue's consumer group, so a queue
+		// removed in the meantime is not brought back without one
+		r.streams = append(r.streams, pipe.XAdd(ctx, &goredis.XAddArgs{
+			Stream:     c.queueKey(queueName),
+			NoMkStream: true,
+			Values:     values,
+		}))
+	}
+	r.receivers = pipe.Publish(ctx, c.channelName(meta.RoutingKey), env)
+	return r, nil
+}
+
+// commandsErr returns the first error of cmds, ignoring the empty replies of
+// appends to removed queues
+func commandsErr(cmds []goredis.Cmder) error {
+	for _, cmd := range cmds {
+		if err := cmd.Err(); err != nil && !errors.Is(err, goredis.Nil) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,396 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Gaoey/scale-websocket/internal/repository/broker"
+	"github.com/alicebob/miniredis/v2"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+func newTestClient(t *testing.T, cfg Config) (*Client, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	cfg.URL = "redis://" + mr.Addr()
+	if cfg.ExchangeName == "" {
+		cfg.ExchangeName = "test"
+	}
+	client, err := NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client, mr
+}
+
+// recorder collects the messages a consumer handles
+type recorder struct {
+	mu   sync.Mutex
+	msgs []broker.Delivery
+	got  chan struct{}
+}
+
+func newRecorder() *recorder {
+	return &recorder{got: make(chan struct{}, 100)}
+}
+
+func (r *recorder) handle(d broker.Delivery) error {
+	r.mu.Lock()
+	r.msgs = append(r.msgs, d)
+	r.mu.Unlock()
+	r.got <- struct{}{}
+	return nil
+}
+
+func (r *recorder) wait(t *testing.T, n int) []broker.Delivery {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-r.got:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d of %d messages", i, n)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]broker.Delivery(nil), r.msgs...)
+}
+
+// none fails if a message arrives within d
+func (r *recorder) none(t *testing.T, d time.Duration) {
+	t.Helper()
+	select {
+	case <-r.got:
+		t.Fatal("received an unexpected message")
+	case <-time.After(d):
+	}
+}
+
+func routingKeys(ds []broker.Delivery) []string {
+	keys := make([]string, len(ds))
+	for i, d := range ds {
+		keys[i] = d.RoutingKey
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestPatternRouting(t *testing.T) {
+	client, _ := newTestClient(t, Config{})
+	ctx := context.Background()
+
+	words, tail := newRecorder(), newRecorder()
+	for queue, c := range map[string]struct {
+		keys []string
+		rec  *recorder
+	}{
+		"words": {keys: []string{"orders.*"}, rec: words},
+		"tail":  {keys: []string{"orders.#"}, rec: tail},
+	} {
+		cons, err := client.StartConsumer(ctx, queue, c.keys, c.rec.handle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cons.Shutdown(ctx)
+	}
+
+	live := newRecorder()
+	cons, err := client.StartConsumer(ctx, "live", []string{"orders.*.new"}, live.handle, broker.WithQueueMode(broker.QueueExclusive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cons.Shutdown(ctx)
+
+	for _, key := range []string{"orders.new", "orders.eu.new", "payments.new"} {
+		if err := client.Publish(ctx, key, map[string]string{"key": key}); err != nil {
+			t.Fatalf("publish %s: %v", key, err)
+		}
+	}
+
+	if got := routingKeys(words.wait(t, 1)); len(got) != 1 || got[0] != "orders.new" {
+		t.Errorf("orders.* received %v", got)
+	}
+	if got := routingKeys(tail.wait(t, 2)); len(got) != 2 || got[0] != "orders.eu.new" || got[1] != "orders.new" {
+		t.Errorf("orders.# received %v", got)
+	}
+	if got := routingKeys(live.wait(t, 1)); len(got) != 1 || got[0] != "orders.eu.new" {
+		t.Errorf("orders.*.new received %v", got)
+	}
+	words.none(t, 100*time.Millisecond)
+
+	// Mandatory publishes nobody is bound to fail
+	err = client.Publish(ctx, "payments.new", 1, broker.WithMandatory())
+	if !errors.Is(err, broker.ErrUnroutable) {
+		t.Fatalf("mandatory publish: got %v, want %v", err, broker.ErrUnroutable)
+	}
+	if err := client.Publish(ctx, "orders.new", 1, broker.WithMandatory()); err != nil {
+		t.Fatalf("mandatory publish: %v", err)
+	}
+}
+
+func TestQueueDeclaredOnAnotherNode(t *testing.T) {
+	publisher, mr := newTestClient(t, Config{})
+	other, err := NewClient(Config{URL: "redis://" + mr.Addr(), ExchangeName: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	ctx := context.Background()
+
+	// Caches the bindings without the queue
+	err = publisher.Publish(ctx, "orders.new", 1, broker.WithMandatory())
+	if !errors.Is(err, broker.ErrUnroutable) {
+		t.Fatalf("mandatory publish: got %v, want %v", err, broker.ErrUnroutable)
+	}
+
+	rec := newRecorder()
+	cons, err := other.StartConsumer(ctx, "orders", []string{"orders.*"}, rec.handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cons.Shutdown(ctx)
+
+	// Announced to the publisher well before its cache would expire
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for {
+		err := publisher.Publish(ctx, "orders.new", 1, broker.WithMandatory())
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("queue declared on another node is still unroutable: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	rec.wait(t, 1)
+}
+
+func TestQueueStreamsOnlyHoldUnackedMessages(t *testing.T) {
+	// The stopped consumer's last blocking read may still take the next
+	// message, which the new consumer then claims
+	client, mr := newTestClient(t, Config{ClaimIdle: 100 * time.Millisecond})
+	ctx := context.Background()
+
+	rec := newRecorder()
+	cons, err := client.StartConsumer(ctx, "q", []string{"a.*"}, rec.handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := client.Publish(ctx, "a.b", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rec.wait(t, 5)
+	if err := cons.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := mr.Stream(client.queueKey("q"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("stream holds %d acked entries", len(entries))
+	}
+
+	// Messages published while no consumer runs wait in the queue's stream
+	if err := client.Publish(ctx, "a.b", "waiting"); err != nil {
+		t.Fatal(err)
+	}
+	cons, err = client.StartConsumer(ctx, "q", []string{"a.*"}, rec.handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cons.Shutdown(ctx)
+	rec.wait(t, 1)
+}
+
+func TestRedeliversUnackedMessages(t *testing.T) {
+	client, _ := newTestClient(t, Config{ClaimIdle: 100 * time.Millisecond})
+	ctx := context.Background()
+
+	rec := newRecorder()
+	cons, err := client.StartConsumer(ctx, "q", []string{"a.*"}, rec.handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cons.Shutdown(ctx)
+
+	// Stop the real consumer from reading, then let a consumer that crashes
+	// before acking take the message
+	if err := cons.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Publish(ctx, "a.b", "lost"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := client.rdb.XReadGroup(ctx, &goredis.XReadGroupArgs{
+		Group:    "q",
+		Consumer: "crashed",
+		Streams:  []string{client.queueKey("q"), ">"},
+		Count:    10,
+	}).Result()
+	if err != nil || len(res) != 1 || len(res[0].Messages) != 1 {
+		t.Fatalf("crashed consumer read %v: %v", res, err)
+	}
+
+	cons, err = client.StartConsumer(ctx, "q", []string{"a.*"}, rec.handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cons.Shutdown(ctx)
+
+	got := rec.wait(t, 1)
+	if got[0].MessageID == "" || string(got[0].Body) != `"lost"` {
+		t.Fatalf("unexpected redelivery %+v", got[0])
+	}
+
+	pending, err := client.rdb.XPending(ctx, client.queueKey("q"), "q").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending.Count != 0 {
+		t.Fatalf("%d messages still pending", pending.Count)
+	}
+}
+
+func TestRetriesThenDeadLetters(t *testing.T) {
+	client, _ := newTestClient(t, Config{})
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	attempts := 0
+	done := make(chan struct{})
+	cons, err := client.StartConsumer(ctx, "q", []string{"a.*"}, func(d broker.Delivery) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts == 3 {
+			close(done)
+		}
+		return errors.New("boom")
+	}, broker.WithRetry(3, 10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cons.Shutdown(ctx)
+
+	if err := client.Publish(ctx, "a.b", "x"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was not retried")
+	}
+
+	var letters []broker.DeadLetter
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if letters, err = client.DeadLetters(ctx, "q", 10); err != nil {
+			t.Fatal(err)
+		}
+		if len(letters) > 0 {
+			break
+		}
+	}
+	if len(letters) != 1 || letters[0].Attempts != 3 || letters[0].Reason != "boom" {
+		t.Fatalf("unexpected dead letters %+v", letters)
+	}
+}
+
+func TestDelayedRelease(t *testing.T) {
+	client, _ := newTestClient(t, Config{})
+	ctx := context.Background()
+
+	rec := newRecorder()
+	cons, err := client.StartConsumer(ctx, "q", []string{"a.*"}, rec.handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cons.Shutdown(ctx)
+
+	start := time.Now()
+	if err := client.Publish(ctx, "a.b", "later", broker.WithDelay(time.Second), broker.WithMessageID("m1")); err != nil {
+		t.Fatal(err)
+	}
+	got := rec.wait(t, 1)
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Fatalf("delivered after %v", elapsed)
+	}
+	if got[0].MessageID != "m1" || got[0].RoutingKey != "a.b" {
+		t.Fatalf("unexpected delivery %+v", got[0].Metadata)
+	}
+
+	n, err := client.rdb.ZCard(ctx, client.releasingKey()).Result()
+	if err != nil || n != 0 {
+		t.Fatalf("releasing set holds %d messages: %v", n, err)
+	}
+}
+
+func TestTakeDueScript(t *testing.T) {
+	client, _ := newTestClient(t, Config{})
+	ctx := context.Background()
+	// Keep the background scheduler out of the way
+	client.closeOnce.Do(func() { close(client.done) })
+	client.wg.Wait()
+
+	member := func(id string) string {
+		env, _ := json.Marshal(envelope{Meta: broker.Metadata{MessageID: id, RoutingKey: "a.b"}, Body: []byte(`1`)})
+		return string(env)
+	}
+	now := time.Now()
+	client.rdb.ZAdd(ctx, client.delayedSetKey(),
+		goredis.Z{Score: float64(now.Add(-time.Second).UnixMilli()), Member: member("due")},
+		goredis.Z{Score: float64(now.Add(time.Hour).UnixMilli()), Member: member("later")},
+	)
+	// Taken by a node that crashed before publishing it
+	client.rdb.ZAdd(ctx, client.releasingKey(),
+		goredis.Z{Score: float64(now.Add(-time.Minute).UnixMilli()), Member: member("stale")},
+		goredis.Z{Score: float64(now.UnixMilli()), Member: member("busy")},
+	)
+
+	taken, err := takeDue.Run(ctx, client.rdb,
+		[]string{client.delayedSetKey(), client.releasingKey()},
+		now.UnixMilli(), schedulerBatch, now.Add(-releaseTimeout).UnixMilli(),
+	).StringSlice()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make([]string, len(taken))
+	for i, m := range taken {
+		var env envelope
+		json.Unmarshal([]byte(m), &env)
+		ids[i] = env.Meta.MessageID
+	}
+	sort.Strings(ids)
+	if len(ids) != 2 || ids[0] != "due" || ids[1] != "stale" {
+		t.Fatalf("took %v, want [due stale]", ids)
+	}
+
+	if left, _ := client.rdb.ZRange(ctx, client.delayedSetKey(), 0, -1).Result(); len(left) != 1 || left[0] != member("later") {
+		t.Fatalf("delayed set holds %v", left)
+	}
+	if n, _ := client.rdb.ZCard(ctx, client.releasingKey()).Result(); n != 3 {
+		t.Fatalf("releasing set holds %d messages, want 3", n)
+	}
+
+	// Publishing them empties the releasing set of the taken messages only
+	for _, m := range taken {
+		if err := client.release(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if left, _ := client.rdb.ZRange(ctx, client.releasingKey(), 0, -1).Result(); len(left) != 1 || left[0] != member("busy") {
+		t.Fatalf("releasing set holds %v", left)
+	}
+}
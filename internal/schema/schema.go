@@ -0,0 +1,177 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/Gaoey/scale-websocket/internal/repository/broker"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// ErrInvalid is matched by errors.Is when a message fails its channel's schema
+var ErrInvalid = errors.New("message does not match schema")
+
+// FieldError describes one violation, located by a JSON pointer into the message
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every violation of a message against a channel schema
+type ValidationError struct {
+	Channel string       `json:"channel"`
+	Fields  []FieldError `json:"fields"`
+}
+
+func (e *ValidationError) Error() string {
+	parts := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		parts = append(parts, f.Field+": "+f.Message)
+	}
+	return fmt.Sprintf("invalid message for channel %s: %s", e.Channel, strings.Join(parts, "; "))
+}
+
+// Is makes errors.Is(err, ErrInvalid) true for every ValidationError
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrInvalid
+}
+
+type channelSchema struct {
+	schema      *jsonschema.Schema
+	routingKeys []string
+}
+
+// Registry holds the compiled JSON Schema of each channel. Channels without a
+// schema accept any message.
+type Registry struct {
+	mu       sync.RWMutex
+	channels map[string]channelSchema
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		channels: make(map[string]channelSchema),
+	}
+}
+
+// Register compiles schema and attaches it to channel. routingKeys are the
+// patterns the channel consumes, used to find the schemas that apply to a
+// publish.
+func (r *Registry) Register(channel string, routingKeys []string, schema []byte) error {
+	compiler := jsonschema.NewCompiler()
+	url := channel + ".json"
+	if err := compiler.AddResource(url, bytes.NewReader(schema)); err != nil {
+		return fmt.Errorf("failed to load schema for channel %s: %w", channel, err)
+	}
+	compiled, err := compiler.Compile(url)
+	if err != nil {
+		return fmt.Errorf("failed to compile schema for channel %s: %w", channel, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.channels[channel] = channelSchema{schema: compiled, routingKeys: routingKeys}
+	return nil
+}
+
+// RegisterFile registers the schema stored in a file
+func (r *Registry) RegisterFile(channel string, routingKeys []string, path string) error {
+	schema, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read schema for channel %s: %w", channel, err)
+	}
+	return r.Register(channel, routingKeys, schema)
+}
+
+// Validate checks msg against the schema of channel
+func (r *Registry) Validate(channel string, msg broker.Message) error {
+	r.mu.RLock()
+	cs, ok := r.channels[channel]
+	r.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	return validate(channel, cs.schema, msg)
+}
+
+// ValidateRoutingKey checks msg against the schema of every channel that
+// consumes routingKey
+func (r *Registry) ValidateRoutingKey(routingKey string, msg broker.Message) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for channel, cs := range r.channels {
+		for _, pattern := range cs.routingKeys {
+			if !broker.MatchRoutingKey(pattern, routingKey) {
+				continue
+			}
+			if err := validate(channel, cs.schema, msg); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	return nil
+}
+
+func validate(channel string, schema *jsonschema.Schema, msg broker.Message) error {
+	instance, err := toInstance(msg)
+	if err != nil {
+		return &ValidationError{
+			Channel: channel,
+			Fields:  []FieldError{{Field: "/", Message: err.Error()}},
+		}
+	}
+
+	err = schema.Validate(instance)
+	if err == nil {
+		return nil
+	}
+
+	var ve *jsonschema.ValidationError
+	if !errors.As(err, &ve) {
+		return err
+	}
+	return &ValidationError{Channel: channel, Fields: fieldErrors(ve)}
+}
+
+// toInstance converts a message into the generic JSON values the validator
+// understands, whatever codec it was decoded with
+func toInstance(msg broker.Message) (interface{}, error) {
+	data, err := broker.ToJSON(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var instance interface{}
+	if err := decoder.Decode(&instance); err != nil {
+		return nil, fmt.Errorf("message is not valid JSON: %w", err)
+	}
+	return instance, nil
+}
+
+// fieldErrors flattens the validator's error tree into its leaves, which
+// carry the actual violations
+func fieldErrors(ve *jsonschema.ValidationError) []FieldError {
+	if len(ve.Causes) == 0 {
+		field := ve.InstanceLocation
+		if field == "" {
+			field = "/"
+		}
+		return []FieldError{{Field: field, Message: ve.Message}}
+	}
+
+	var fields []FieldError
+	for _, cause := range ve.Causes {
+		fields = append(fields, fieldErrors(cause)...)
+	}
+	return fields
+}
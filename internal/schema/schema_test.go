@@ -0,0 +1,136 @@
+package schema
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/Gaoey/scale-websocket/internal/repository/broker"
+)
+
+const orderSchema = `{
+	"type": "object",
+	"required": ["order_id", "amount"],
+	"properties": {
+		"order_id": {"type": "string"},
+		"amount": {"type": "number"}
+	}
+}`
+
+func newTestRegistry(t *testing.T) *Registry {
+	t.Helper()
+	r := NewRegistry()
+	if err := r.Register("orders", []string{"order.*"}, []byte(orderSchema)); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestValidate(t *testing.T) {
+	r := newTestRegistry(t)
+
+	tests := []struct {
+		name    string
+		channel string
+		msg     broker.Message
+		// fields are the violations reported, none when the message is valid
+		fields []FieldError
+	}{
+		{
+			name:    "valid",
+			channel: "orders",
+			msg:     map[string]interface{}{"order_id": "o-1", "amount": 12.5},
+		},
+		{
+			name:    "valid raw JSON",
+			channel: "orders",
+			msg:     json.RawMessage(`{"order_id":"o-1","amount":3}`),
+		},
+		{
+			name:    "missing required field",
+			channel: "orders",
+			msg:     map[string]interface{}{"order_id": "o-1"},
+			fields:  []FieldError{{Field: "/", Message: "missing properties: 'amount'"}},
+		},
+		{
+			name:    "wrong type",
+			channel: "orders",
+			msg:     map[string]interface{}{"order_id": 1, "amount": "ten"},
+			fields: []FieldError{
+				{Field: "/amount", Message: "expected number, but got string"},
+				{Field: "/order_id", Message: "expected string, but got number"},
+			},
+		},
+		{
+			name:    "not JSON",
+			channel: "orders",
+			msg:     json.RawMessage(`{`),
+			fields:  []FieldError{{Field: "/", Message: "message is not valid JSON: unexpected EOF"}},
+		},
+		{
+			name:    "unknown channel",
+			channel: "trades",
+			msg:     "anything",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := r.Validate(tt.channel, tt.msg)
+			if tt.fields == nil {
+				if err != nil {
+					t.Fatalf("Validate: %v", err)
+				}
+				return
+			}
+
+			var invalid *ValidationError
+			if !errors.As(err, &invalid) || !errors.Is(err, ErrInvalid) {
+				t.Fatalf("Validate returned %v, want a ValidationError", err)
+			}
+			if invalid.Channel != tt.channel {
+				t.Errorf("error for channel %s, want %s", invalid.Channel, tt.channel)
+			}
+			// Sibling violations come in no particular order
+			sort.Slice(invalid.Fields, func(i, j int) bool { return invalid.Fields[i].Field < invalid.Fields[j].Field })
+			if !reflect.DeepEqual(invalid.Fields, tt.fields) {
+				t.Errorf("fields %+v, want %+v", invalid.Fields, tt.fields)
+			}
+		})
+	}
+}
+
+func TestValidateRoutingKey(t *testing.T) {
+	r := newTestRegistry(t)
+	invalid := map[string]interface{}{"order_id": "o-1"}
+
+	tests := []struct {
+		routingKey string
+		msg        broker.Message
+		wantErr    bool
+	}{
+		{"order.created", map[string]interface{}{"order_id": "o-1", "amount": 1}, false},
+		{"order.created", invalid, true},
+		// No channel consumes these, nothing to check them against
+		{"order.created.eu", invalid, false},
+		{"trade.created", invalid, false},
+	}
+	for _, tt := range tests {
+		err := r.ValidateRoutingKey(tt.routingKey, tt.msg)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ValidateRoutingKey(%s, %v) = %v", tt.routingKey, tt.msg, err)
+			continue
+		}
+		var ve *ValidationError
+		if err != nil && (!errors.As(err, &ve) || ve.Channel != "orders") {
+			t.Errorf("ValidateRoutingKey(%s) returned %v, want a ValidationError for orders", tt.routingKey, err)
+		}
+	}
+}
+
+func TestRegisterInvalidSchema(t *testing.T) {
+	if err := NewRegistry().Register("orders", nil, []byte(`{"type": 5}`)); err == nil {
+		t.Fatal("registered a schema that does not compile")
+	}
+}
@@ -0,0 +1,39 @@
+package stores
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+)
+
+// Activity records when a connection last read or wrote a message. It is
+// shared by every copy of a ConnectionData, so touching it through any of
+// them is seen by all.
+type Activity struct {
+	last atomic.Int64
+}
+
+func NewActivity() *Activity {
+	a := &Activity{}
+	a.Touch()
+	return a
+}
+
+// Touch marks the connection active now
+func (a *Activity) Touch() {
+	if a != nil {
+		a.last.Store(time.Now().UnixNano())
+	}
+}
+
+// Time returns when the connection was last active
+func (a *Activity) Time() time.Time {
+	if a == nil {
+		return time.Time{}
+	}
+	return time.Unix(0, a.last.Load())
+}
+
+func (a *Activity) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.Time())
+}
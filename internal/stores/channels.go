@@ -0,0 +1,163 @@
+package stores
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+// subscriberBuckets is the number of independently locked parts each
+// channel's subscribers are split into by connection ID. A subscribe,
+// unsubscribe or disconnect only locks and invalidates the bucket of its
+// connection, so with a single busy channel churn costs a rebuild of a
+// fraction of its subscribers rather than all of them.
+const subscriberBuckets = 64
+
+// channelIndex maps channels to their subscribed connections. Its lock is
+// only taken for writing to add or drop a channel; changes to the
+// subscribers of a channel that exists hold it for reading.
+type channelIndex struct {
+	mu       sync.RWMutex
+	channels map[string]*channelSubscribers
+}
+
+// channelSubscribers holds the connections of one channel
+type channelSubscribers struct {
+	// count is the number of subscribers, so an empty channel is dropped
+	// without locking every bucket
+	count   atomic.Int64
+	buckets [subscriberBuckets]subscriberBucket
+}
+
+// subscriberBucket holds part of a channel's connections by connection ID.
+// snapshot caches them as a slice for fan-out and is rebuilt after a change.
+type subscriberBucket struct {
+	mu       sync.RWMutex
+	conns    map[string]ConnectionData
+	snapshot []ConnectionData
+}
+
+func newChannelIndex() *channelIndex {
+	return &channelIndex{channels: make(map[string]*channelSubscribers)}
+}
+
+func (subs *channelSubscribers) bucket(connID string) *subscriberBucket {
+	h := fnv.New32a()
+	h.Write([]byte(connID))
+	return &subs.buckets[h.Sum32()%subscriberBuckets]
+}
+
+// add subscribes a connection to channel, replacing its previous entry
+func (idx *channelIndex) add(channel string, conn ConnectionData) {
+	for {
+		idx.mu.RLock()
+		if subs, ok := idx.channels[channel]; ok {
+			// Holding the read lock keeps the channel from being dropped as
+			// empty before the connection is in it
+			subs.put(conn)
+			idx.mu.RUnlock()
+			return
+		}
+		idx.mu.RUnlock()
+
+		// The channel may be dropped again before it is read locked, in
+		// which case it is created once more
+		idx.mu.Lock()
+		if _, ok := idx.channels[channel]; !ok {
+			idx.channels[channel] = &channelSubscribers{}
+		}
+		idx.mu.Unlock()
+	}
+}
+
+func (subs *channelSubscribers) put(conn ConnectionData) {
+	b := subs.bucket(conn.ConnectionID)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.conns == nil {
+		b.conns = make(map[string]ConnectionData)
+	}
+	if _, ok := b.conns[conn.ConnectionID]; !ok {
+		subs.count.Add(1)
+	}
+	b.conns[conn.ConnectionID] = conn
+	b.snapshot = nil
+}
+
+// remove unsubscribes a connection from channel, dropping the channel once
+// nobody is subscribed to it
+func (idx *channelIndex) remove(channel, connID string) {
+	if channel == "" {
+		return
+	}
+
+	idx.mu.RLock()
+	subs, ok := idx.channels[channel]
+	if !ok {
+		idx.mu.RUnlock()
+		return
+	}
+
+	b := subs.bucket(connID)
+	b.mu.Lock()
+	if _, ok := b.conns[connID]; ok {
+		delete(b.conns, connID)
+		b.snapshot = nil
+		subs.count.Add(-1)
+	}
+	b.mu.Unlock()
+	empty := subs.count.Load() == 0
+	idx.mu.RUnlock()
+
+	if !empty {
+		return
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	// Nobody can subscribe while the write lock is held
+	if idx.channels[channel] == subs && subs.count.Load() == 0 {
+		delete(idx.channels, channel)
+	}
+}
+
+// get returns the connections subscribed to channel in a new slice owned by
+// the caller. Each bucket's snapshot is rebuilt only if it changed since the
+// last call.
+func (idx *channelIndex) get(channel string) []ConnectionData {
+	idx.mu.RLock()
+	subs, ok := idx.channels[channel]
+	idx.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	conns := make([]ConnectionData, 0, subs.count.Load())
+	for i := range subs.buckets {
+		conns = append(conns, subs.buckets[i].get()...)
+	}
+	return conns
+}
+
+// get returns the bucket's snapshot, which must not be modified
+func (b *subscriberBucket) get() []ConnectionData {
+	b.mu.RLock()
+	snapshot, conns := b.snapshot, len(b.conns)
+	b.mu.RUnlock()
+	if snapshot != nil || conns == 0 {
+		return snapshot
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Another caller may have rebuilt it while unlocked
+	if b.snapshot == nil {
+		b.snapshot = make([]ConnectionData, 0, len(b.conns))
+		for _, conn := range b.conns {
+			b.snapshot = append(b.snapshot, conn)
+		}
+	}
+	return b.snapshot
+}
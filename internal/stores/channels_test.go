@@ -0,0 +1,175 @@
+package stores
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func connIDs(conns []ConnectionData) []string {
+	ids := make([]string, len(conns))
+	for i, c := range conns {
+		ids[i] = c.ConnectionID
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestChannelIndex(t *testing.T) {
+	idx := newChannelIndex()
+
+	for i := 0; i < 200; i++ {
+		idx.add("a", ConnectionData{ConnectionID: fmt.Sprintf("c%03d", i)})
+	}
+	idx.add("b", ConnectionData{ConnectionID: "c000"})
+	// Subscribing again replaces the entry
+	idx.add("a", ConnectionData{ConnectionID: "c000", ClientID: "u"})
+
+	got := idx.get("a")
+	if len(got) != 200 {
+		t.Fatalf("channel a has %d subscribers, want 200", len(got))
+	}
+	for _, c := range got {
+		if c.ConnectionID == "c000" && c.ClientID != "u" {
+			t.Fatalf("entry was not replaced: %+v", c)
+		}
+	}
+
+	// The returned slice belongs to the caller
+	got[0] = ConnectionData{}
+	if ids := connIDs(idx.get("a")); ids[0] != "c000" || len(ids) != 200 {
+		t.Fatalf("modifying the result changed the index: %v", ids[:3])
+	}
+
+	for i := 1; i < 200; i++ {
+		idx.remove("a", fmt.Sprintf("c%03d", i))
+	}
+	if ids := connIDs(idx.get("a")); len(ids) != 1 || ids[0] != "c000" {
+		t.Fatalf("channel a has %v", ids)
+	}
+
+	idx.remove("a", "c000")
+	idx.remove("a", "c000")
+	if _, ok := idx.channels["a"]; ok {
+		t.Fatal("empty channel was kept")
+	}
+	if got := idx.get("a"); got != nil {
+		t.Fatalf("empty channel returned %v", got)
+	}
+	if ids := connIDs(idx.get("b")); len(ids) != 1 {
+		t.Fatalf("channel b has %v", ids)
+	}
+
+	// A dropped channel comes back on the next subscribe
+	idx.add("a", ConnectionData{ConnectionID: "c001"})
+	if ids := connIDs(idx.get("a")); len(ids) != 1 || ids[0] != "c001" {
+		t.Fatalf("channel a has %v", ids)
+	}
+}
+
+func TestChannelIndexConcurrentDropAndAdd(t *testing.T) {
+	idx := newChannelIndex()
+
+	// Channels emptied by one goroutine while another subscribes must not
+	// lose the new subscriber
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				id := fmt.Sprintf("g%d-%d", g, i)
+				idx.add("a", ConnectionData{ConnectionID: id})
+				idx.get("a")
+				idx.remove("a", id)
+			}
+			idx.add("a", ConnectionData{ConnectionID: fmt.Sprintf("g%d", g)})
+		}(g)
+	}
+	wg.Wait()
+
+	if ids := connIDs(idx.get("a")); len(ids) != 8 {
+		t.Fatalf("channel a has %v, want one connection per goroutine", ids)
+	}
+}
+
+const benchConnections = 100_000
+
+// subscribedStorage returns a store with n connections subscribed to channel
+func subscribedStorage(b *testing.B, channel string, n int) *ConnectionStorage {
+	b.Helper()
+
+	s := NewConnectionStorage()
+	for i := 0; i < n; i++ {
+		user, conn := fmt.Sprintf("user-%d", i), fmt.Sprintf("conn-%d", i)
+		s.Add(context.Background(), user, conn, nil, true)
+		s.AddChannel(user, conn, channel)
+	}
+	return s
+}
+
+// BenchmarkGetByChannel is the fan-out of a message to 100k subscribers of
+// one channel that nobody joins or leaves
+func BenchmarkGetByChannel(b *testing.B) {
+	s := subscribedStorage(b, "order_update", benchConnections)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if conns, _ := s.GetByChannel("order_update"); len(conns) != benchConnections {
+			b.Fatalf("got %d subscribers", len(conns))
+		}
+	}
+}
+
+// BenchmarkGetByChannelAfterChurn is the fan-out to 100k subscribers when
+// a connection left and another one joined since the previous message
+func BenchmarkGetByChannelAfterChurn(b *testing.B) {
+	s := subscribedStorage(b, "order_update", benchConnections)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		user, conn := fmt.Sprintf("user-%d", i%benchConnections), fmt.Sprintf("conn-%d", i%benchConnections)
+		s.RemoveByConnID(user, conn)
+		s.Add(context.Background(), user, conn, nil, true)
+		s.AddChannel(user, conn, "order_update")
+
+		s.GetByChannel("order_update")
+	}
+}
+
+// BenchmarkSubscribeChurn is connections joining and leaving a channel of
+// 100k subscribers while messages are fanned out to it
+func BenchmarkSubscribeChurn(b *testing.B) {
+	s := subscribedStorage(b, "order_update", benchConnections)
+
+	stop := make(chan struct{})
+	fanOut := make(chan struct{})
+	go func() {
+		defer close(fanOut)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				s.GetByChannel("order_update")
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			user, conn := fmt.Sprintf("user-%d", i%benchConnections), fmt.Sprintf("conn-%d", i%benchConnections)
+			s.RemoveChannel(user, conn, "order_update")
+			s.AddChannel(user, conn, "order_update")
+		}
+	})
+	b.StopTimer()
+
+	close(stop)
+	<-fanOut
+}
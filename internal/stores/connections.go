@@ -2,6 +2,7 @@ package stores
 
 import (
 	"context"
+	"sort"
 	"sync"
 	"time"
 
@@ -9,107 +10,212 @@ import (
 	"github.com/google/uuid"
 )
 
+// ConnectionStorage holds the open connections of this node by user, with
+// indexes by connection ID and by subscribed channel. Every change happens
+// under one lock so the indexes never disagree, while fan-out only reads
+// the channel index and does not take it.
+//
+// Slices of connections are copied on write: a slice returned by a getter is
+// a snapshot that later changes do not touch.
 type ConnectionStorage struct {
-	conns sync.Map
-	// mu          sync.RWMutex
-	connections map[string]map[string]struct{}
+	mu    sync.RWMutex
+	conns map[string][]ConnectionData
+	// owners maps connection IDs to the user they belong to
+	owners map[string]string
+	// channels indexes the connections by subscribed channel for fan-out
+	channels *channelIndex
 }
 
 func NewConnectionStorage() *ConnectionStorage {
 	return &ConnectionStorage{
-		conns:       sync.Map{},
-		connections: make(map[string]map[string]struct{}),
+		conns:    make(map[string][]ConnectionData),
+		owners:   make(map[string]string),
+		channels: newChannelIndex(),
 	}
 }
 
 type ConnectionData struct {
-	ClientID          string
-	ConnectionID      string
-	Ctx               context.Context
-	Conn              *websocket.Conn
-	SubscribedChannel string
-	IsAuthenticated   bool
-	CreatedAt         time.Time
+	ClientID     string
+	ConnectionID string
+	Ctx          context.Context
+	Conn         *websocket.Conn
+	// SubscribedChannels is the sorted set of channels the connection
+	// receives. It is replaced, never modified, when the set changes.
+	SubscribedChannels []string
+	IsAuthenticated    bool
+	CreatedAt          time.Time
+	// LastActive is touched on every read and write, for the idle timeout
+	LastActive *Activity
+}
+
+// IsSubscribed reports whether the connection receives channel
+func (c ConnectionData) IsSubscribed(channel string) bool {
+	i := sort.SearchStrings(c.SubscribedChannels, channel)
+	return i < len(c.SubscribedChannels) && c.SubscribedChannels[i] == channel
 }
 
 func (s *ConnectionStorage) Add(ctx context.Context, id, connId string, conn *websocket.Conn, isAuth bool) {
 	newConn := ConnectionData{
-		ClientID:          id,
-		ConnectionID:      connId,
-		Ctx:               ctx,
-		Conn:              conn,
-		IsAuthenticated:   isAuth,
-		SubscribedChannel: "",
-		CreatedAt:         time.Now(),
+		ClientID:        id,
+		ConnectionID:    connId,
+		Ctx:             ctx,
+		Conn:            conn,
+		IsAuthenticated: isAuth,
+		CreatedAt:       time.Now(),
+		LastActive:      NewActivity(),
 	}
 
-	if !s.IsExists(id) {
-		data := []ConnectionData{newConn}
-		s.conns.Store(id, data)
-	} else {
-		data, _ := s.Get(id)
-		newData := append(data, newConn)
-		s.conns.Store(id, newData)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data := s.conns[id]
+	newData := make([]ConnectionData, 0, len(data)+1)
+	for _, connData := range data {
+		// Adding a known connection ID again replaces it
+		if connData.ConnectionID == connId {
+			s.unindex(connData)
+			continue
+		}
+		newData = append(newData, connData)
 	}
+	s.conns[id] = append(newData, newConn)
+	s.owners[connId] = id
+}
+
+// AddChannel subscribes a connection to channel, keeping its other
+// subscriptions, and returns its subscriptions
+func (s *ConnectionStorage) AddChannel(id string, connId, channel string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
+	return s.update(id, connId, func(connData *ConnectionData) {
+		if connData.IsSubscribed(channel) {
+			return
+		}
+		channels := append(append([]string{}, connData.SubscribedChannels...), channel)
+		sort.Strings(channels)
+		connData.SubscribedChannels = channels
+	})
 }
 
-func (s *ConnectionStorage) AddChannel(id string, connId, channel string) {
-	data, _ := s.Get(id)
-	for i, connData := range data {
-		if connData.ConnectionID == connId && connData.SubscribedChannel == "" || connData.SubscribedChannel != channel {
-			data[i].SubscribedChannel = channel
-			break
+// RemoveChannel unsubscribes a connection from channel and returns its
+// remaining subscriptions. ok is false when it was not subscribed.
+func (s *ConnectionStorage) RemoveChannel(id string, connId, channel string) (subscriptions []string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subscriptions = s.update(id, connId, func(connData *ConnectionData) {
+		if !connData.IsSubscribed(channel) {
+			return
 		}
-	}
-	s.conns.Store(id, data)
+		channels := make([]string, 0, len(connData.SubscribedChannels)-1)
+		for _, c := range connData.SubscribedChannels {
+			if c != channel {
+				channels = append(channels, c)
+			}
+		}
+		connData.SubscribedChannels = channels
+		s.channels.remove(channel, connId)
+		ok = true
+	})
+	return subscriptions, ok
 }
 
-func (s *ConnectionStorage) GetByChannel(channel string) ([]ConnectionData, error) {
-	allConns := s.GetAll()
+// update applies change to a copy of a connection, stores it and refreshes
+// its channel index entries. It returns the connection's subscriptions and
+// must be called with mu held.
+func (s *ConnectionStorage) update(id, connId string, change func(*ConnectionData)) []string {
+	data := s.conns[id]
+	for i, connData := range data {
+		if connData.ConnectionID != connId {
+			continue
+		}
+
+		change(&connData)
+		newData := append([]ConnectionData{}, data...)
+		newData[i] = connData
+		s.conns[id] = newData
 
-	var filteredConns []ConnectionData
-	for _, connData := range allConns {
-		if connData.SubscribedChannel == channel {
-			filteredConns = append(filteredConns, connData)
+		for _, channel := range connData.SubscribedChannels {
+			s.channels.add(channel, connData)
 		}
+		return connData.SubscribedChannels
 	}
-	return filteredConns, nil
+	return nil
 }
 
+// Subscriptions returns the channels a connection is subscribed to
+func (s *ConnectionStorage) Subscriptions(id string, connId string) []string {
+	conn, ok := s.GetByConnID(id, connId)
+	if !ok {
+		return nil
+	}
+	return conn.SubscribedChannels
+}
+
+// GetByChannel returns the connections subscribed to channel from the
+// channel index, in a new slice owned by the caller
+func (s *ConnectionStorage) GetByChannel(channel string) ([]ConnectionData, error) {
+	return s.channels.get(channel), nil
+}
+
+// Remove drops every connection of a user
 func (s *ConnectionStorage) Remove(id string) {
-	s.conns.Delete(id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, connData := range s.conns[id] {
+		s.unindex(connData)
+	}
+	delete(s.conns, id)
 }
 
 // GetUserForConnection returns the user ID associated with a connection ID
 func (s *ConnectionStorage) GetUserForConnection(connectionID string) string {
-	for userID, connections := range s.connections {
-		if _, exists := connections[connectionID]; exists {
-			return userID
-		}
-	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	return ""
+	return s.owners[connectionID]
 }
 
 func (s *ConnectionStorage) RemoveByConnID(id string, connId string) {
-	data, _ := s.Get(id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data := s.conns[id]
 	for i, connData := range data {
-		if connData.ConnectionID == connId {
-			data = append(data[:i], data[i+1:]...)
-			break
+		if connData.ConnectionID != connId {
+			continue
 		}
+
+		s.unindex(connData)
+		if len(data) == 1 {
+			delete(s.conns, id)
+			return
+		}
+		newData := make([]ConnectionData, 0, len(data)-1)
+		newData = append(newData, data[:i]...)
+		s.conns[id] = append(newData, data[i+1:]...)
+		return
 	}
+}
 
-	s.conns.Store(id, data)
+// unindex removes a connection from the indexes, with mu held
+func (s *ConnectionStorage) unindex(connData ConnectionData) {
+	for _, channel := range connData.SubscribedChannels {
+		s.channels.remove(channel, connData.ConnectionID)
+	}
+	delete(s.owners, connData.ConnectionID)
 }
 
 func (s *ConnectionStorage) GetAll() []ConnectionData {
-	allConns := make([]ConnectionData, 0)
-	s.conns.Range(func(key, value interface{}) bool {
-		allConns = append(allConns, value.([]ConnectionData)...)
-		return true
-	})
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	allConns := make([]ConnectionData, 0, len(s.owners))
+	for _, data := range s.conns {
+		allConns = append(allConns, data...)
+	}
 	return allConns
 }
 
@@ -127,15 +233,15 @@ func (s *ConnectionStorage) GetByConnID(id string, connId string) (*ConnectionDa
 }
 
 func (s *ConnectionStorage) Get(id string) ([]ConnectionData, bool) {
-	v, ok := s.conns.Load(id)
-	if !ok {
-		return nil, false
-	}
-	return v.([]ConnectionData), true
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	data, ok := s.conns[id]
+	return data, ok
 }
 
 func (s *ConnectionStorage) IsExists(id string) bool {
-	_, ok := s.conns.Load(id)
+	_, ok := s.Get(id)
 	return ok
 }
 
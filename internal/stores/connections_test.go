@@ -0,0 +1,206 @@
+package stores
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// checkIndexes fails unless the connID→user index and the channel index
+// agree with the connections stored by user
+func checkIndexes(t *testing.T, s *ConnectionStorage) {
+	t.Helper()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	subscribed := make(map[string]map[string]bool)
+	total := 0
+	for user, conns := range s.conns {
+		if len(conns) == 0 {
+			t.Errorf("user %s is kept without connections", user)
+		}
+		for _, c := range conns {
+			total++
+			if owner := s.owners[c.ConnectionID]; owner != user {
+				t.Errorf("connection %s of %s is indexed under %q", c.ConnectionID, user, owner)
+			}
+			for _, channel := range c.SubscribedChannels {
+				if subscribed[channel] == nil {
+					subscribed[channel] = make(map[string]bool)
+				}
+				subscribed[channel][c.ConnectionID] = true
+			}
+		}
+	}
+	if len(s.owners) != total {
+		t.Errorf("%d connections indexed, %d stored", len(s.owners), total)
+	}
+
+	for channel, want := range subscribed {
+		got := s.channels.get(channel)
+		if len(got) != len(want) {
+			t.Errorf("channel %s indexes %d connections, %d are subscribed", channel, len(got), len(want))
+		}
+		for _, c := range got {
+			if !want[c.ConnectionID] {
+				t.Errorf("channel %s indexes unsubscribed connection %s", channel, c.ConnectionID)
+			}
+		}
+	}
+	for channel := range s.channels.channels {
+		if subscribed[channel] == nil {
+			t.Errorf("channel %s is indexed without subscribers", channel)
+		}
+	}
+}
+
+func TestConnectionStorage(t *testing.T) {
+	s := NewConnectionStorage()
+	ctx := context.Background()
+
+	s.Add(ctx, "u1", "c1", nil, true)
+	s.Add(ctx, "u1", "c2", nil, true)
+	s.Add(ctx, "u2", "c3", nil, false)
+
+	if got := s.AddChannel("u1", "c1", "b"); len(got) != 1 || got[0] != "b" {
+		t.Fatalf("subscriptions %v", got)
+	}
+	if got := s.AddChannel("u1", "c1", "a"); len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Fatalf("subscriptions are not sorted: %v", got)
+	}
+	s.AddChannel("u1", "c2", "a")
+	if got := s.AddChannel("u1", "missing", "a"); got != nil {
+		t.Fatalf("unknown connection subscribed to %v", got)
+	}
+
+	if got := s.GetUserForConnection("c3"); got != "u2" {
+		t.Fatalf("c3 belongs to %q", got)
+	}
+	if got, _ := s.GetByChannel("a"); len(got) != 2 {
+		t.Fatalf("channel a has %d subscribers", len(got))
+	}
+
+	if got, ok := s.RemoveChannel("u1", "c1", "b"); !ok || len(got) != 1 {
+		t.Fatalf("unsubscribe: %v, %v", got, ok)
+	}
+	if _, ok := s.RemoveChannel("u1", "c1", "b"); ok {
+		t.Fatal("unsubscribed twice")
+	}
+
+	// Adding a known connection again drops its subscriptions
+	s.Add(ctx, "u1", "c2", nil, true)
+	if got := s.Subscriptions("u1", "c2"); len(got) != 0 {
+		t.Fatalf("replaced connection kept %v", got)
+	}
+	checkIndexes(t, s)
+
+	s.RemoveByConnID("u1", "c1")
+	if got := s.GetUserForConnection("c1"); got != "" {
+		t.Fatalf("removed connection belongs to %q", got)
+	}
+	s.Remove("u1")
+	if s.IsExists("u1") {
+		t.Fatal("removed user still exists")
+	}
+	if got, _ := s.GetByChannel("a"); len(got) != 0 {
+		t.Fatalf("channel a still has %d subscribers", len(got))
+	}
+	checkIndexes(t, s)
+}
+
+// TestConnectionStorageStress runs the operations of many connections of
+// the same users at once. Run it with -race.
+func TestConnectionStorageStress(t *testing.T) {
+	s := NewConnectionStorage()
+	ctx := context.Background()
+
+	const (
+		users       = 25
+		goroutines  = 50
+		connections = 100
+	)
+	channels := []string{"a", "b", "c"}
+
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < connections; i++ {
+				user := fmt.Sprintf("user-%d", (g+i)%users)
+				connID := fmt.Sprintf("conn-%d-%d", g, i)
+
+				s.Add(ctx, user, connID, nil, true)
+				s.AddChannel(user, connID, channels[i%len(channels)])
+				s.AddChannel(user, connID, channels[(i+1)%len(channels)])
+				if got := s.GetUserForConnection(connID); got != user {
+					t.Errorf("connection %s belongs to %q, want %s", connID, got, user)
+				}
+				if i%20 == 0 {
+					s.GetByChannel(channels[i%len(channels)])
+					s.GetAll()
+				}
+
+				// Every other connection leaves again, some after unsubscribing
+				switch i % 4 {
+				case 0:
+					s.RemoveByConnID(user, connID)
+				case 1:
+					s.RemoveChannel(user, connID, channels[i%len(channels)])
+				case 2:
+					s.RemoveChannel(user, connID, channels[i%len(channels)])
+					s.RemoveByConnID(user, connID)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	checkIndexes(t, s)
+
+	// Half the connections stay, under the right user
+	if got := len(s.GetAll()); got != goroutines*connections/2 {
+		t.Fatalf("%d connections left, want %d", got, goroutines*connections/2)
+	}
+	for g := 0; g < goroutines; g++ {
+		for i := 0; i < connections; i++ {
+			want := ""
+			if i%4 == 1 || i%4 == 3 {
+				want = fmt.Sprintf("user-%d", (g+i)%users)
+			}
+			connID := fmt.Sprintf("conn-%d-%d", g, i)
+			if got := s.GetUserForConnection(connID); got != want {
+				t.Fatalf("connection %s belongs to %q, want %q", connID, got, want)
+			}
+		}
+	}
+}
+
+// TestConnectionStorageRemoveUserStress removes whole users while their
+// connections are being added and subscribed
+func TestConnectionStorageRemoveUserStress(t *testing.T) {
+	s := NewConnectionStorage()
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 20; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				user := fmt.Sprintf("user-%d", i%5)
+				connID := fmt.Sprintf("conn-%d-%d", g, i)
+				s.Add(ctx, user, connID, nil, true)
+				s.AddChannel(user, connID, "a")
+				if i%10 == 0 {
+					s.Remove(user)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	checkIndexes(t, s)
+}
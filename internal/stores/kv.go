@@ -0,0 +1,166 @@
+package stores
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrLeaseNotFound is returned for a lease that expired or was revoked
+var ErrLeaseNotFound = errors.New("lease not found")
+
+// LeaseID identifies a lease granted by a KV
+type LeaseID string
+
+// KeyValue is one entry of a KV
+type KeyValue struct {
+	Key   string
+	Value []byte
+}
+
+// KV is the key-value store behind a Registry. Every key is attached to a
+// lease and disappears with it, so the entries of a node that stops renewing
+// its lease expire on their own.
+type KV interface {
+	// Grant creates a lease that expires after ttl unless kept alive
+	Grant(ctx context.Context, ttl time.Duration) (LeaseID, error)
+	// KeepAlive renews a lease for another ttl, failing with
+	// ErrLeaseNotFound once it has expired
+	KeepAlive(ctx context.Context, lease LeaseID) error
+	// Revoke ends a lease and deletes its keys
+	Revoke(ctx context.Context, lease LeaseID) error
+	Put(ctx context.Context, key string, value []byte, lease LeaseID) error
+	Delete(ctx context.Context, key string) error
+	// List returns the live entries whose key starts with prefix, sorted by key
+	List(ctx context.Context, prefix string) ([]KeyValue, error)
+}
+
+var _ KV = (*MemoryKV)(nil)
+
+// MemoryKV is a KV held in process memory. It is only shared by the
+// registries of one process, which makes it suitable for a single node and
+// for tests.
+type MemoryKV struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+	leases  map[LeaseID]memoryLease
+}
+
+type memoryEntry struct {
+	value []byte
+	lease LeaseID
+}
+
+type memoryLease struct {
+	ttl     time.Duration
+	expires time.Time
+}
+
+func NewMemoryKV() *MemoryKV {
+	return &MemoryKV{
+		entries: make(map[string]memoryEntry),
+		leases:  make(map[LeaseID]memoryLease),
+	}
+}
+
+func (kv *MemoryKV) Grant(_ context.Context, ttl time.Duration) (LeaseID, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	id := LeaseID(uuid.New().String())
+	kv.leases[id] = memoryLease{ttl: ttl, expires: time.Now().Add(ttl)}
+	return id, nil
+}
+
+func (kv *MemoryKV) KeepAlive(_ context.Context, lease LeaseID) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	l, ok := kv.liveLease(lease)
+	if !ok {
+		return ErrLeaseNotFound
+	}
+	l.expires = time.Now().Add(l.ttl)
+	kv.leases[lease] = l
+	return nil
+}
+
+func (kv *MemoryKV) Revoke(_ context.Context, lease LeaseID) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.expire(lease)
+	return nil
+}
+
+func (kv *MemoryKV) Put(_ context.Context, key string, value []byte, lease LeaseID) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	if _, ok := kv.liveLease(lease); !ok {
+		return ErrLeaseNotFound
+	}
+	kv.entries[key] = memoryEntry{value: append([]byte(nil), value...), lease: lease}
+	return nil
+}
+
+func (kv *MemoryKV) Delete(_ context.Context, key string) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	delete(kv.entries, key)
+	return nil
+}
+
+func (kv *MemoryKV) List(_ context.Context, prefix string) ([]KeyValue, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	var out []KeyValue
+	for key, e := range kv.entries {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if _, ok := kv.liveLease(e.lease); !ok {
+			continue
+		}
+		out = append(out, KeyValue{Key: key, Value: append([]byte(nil), e.value...)})
+	}
+	sortKeyValues(out)
+	return out, nil
+}
+
+// liveLease returns a lease that has not expired, removing it and its keys
+// if it has. mu must be held.
+func (kv *MemoryKV) liveLease(id LeaseID) (memoryLease, bool) {
+	l, ok := kv.leases[id]
+	if !ok {
+		return l, false
+	}
+	if !time.Now().Before(l.expires) {
+		kv.expire(id)
+		return l, false
+	}
+	return l, true
+}
+
+// expire removes a lease and its keys, with mu held
+func (kv *MemoryKV) expire(id LeaseID) {
+	delete(kv.leases, id)
+	for key, e := range kv.entries {
+		if e.lease == id {
+			delete(kv.entries, key)
+		}
+	}
+}
+
+func sortKeyValues(kvs []KeyValue) {
+	sort.Slice(kvs, func(i, j int) bool {
+		return kvs[i].Key < kvs[j].Key
+	})
+}
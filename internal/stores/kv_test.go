@@ -0,0 +1,261 @@
+package stores
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+const testLeaseTTL = 200 * time.Millisecond
+
+// kvCase is a KV under test with a way to let time pass for its leases
+type kvCase struct {
+	name    string
+	new     func(t *testing.T) KV
+	advance func(d time.Duration)
+}
+
+func kvCases() []kvCase {
+	var mr *miniredis.Miniredis
+	return []kvCase{
+		{
+			name:    "memory",
+			new:     func(t *testing.T) KV { return NewMemoryKV() },
+			advance: time.Sleep,
+		},
+		{
+			name: "redis",
+			new: func(t *testing.T) KV {
+				mr = miniredis.RunT(t)
+				kv, err := NewRedisKV("redis://"+mr.Addr(), "test:")
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { kv.Close() })
+				return kv
+			},
+			advance: func(d time.Duration) { mr.FastForward(d) },
+		},
+	}
+}
+
+func listKeys(t *testing.T, kv KV, prefix string) []string {
+	t.Helper()
+	entries, err := kv.List(context.Background(), prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, len(entries))
+	for i, e := range entries {
+		keys[i] = e.Key
+	}
+	return keys
+}
+
+func equalKeys(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func grant(t *testing.T, kv KV) LeaseID {
+	t.Helper()
+	lease, err := kv.Grant(context.Background(), testLeaseTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lease
+}
+
+func put(t *testing.T, kv KV, key string, lease LeaseID) {
+	t.Helper()
+	if err := kv.Put(context.Background(), key, []byte(key), lease); err != nil {
+		t.Fatalf("put %s: %v", key, err)
+	}
+}
+
+func TestKVList(t *testing.T) {
+	for _, tc := range kvCases() {
+		t.Run(tc.name, func(t *testing.T) {
+			kv := tc.new(t)
+			lease := grant(t, kv)
+			for _, key := range []string{"conns/u2/c3", "conns/u1/c2", "conns/u1/c1", "conns/u10/c4", "other"} {
+				put(t, kv, key, lease)
+			}
+
+			tests := []struct {
+				prefix string
+				want   []string
+			}{
+				{"", []string{"conns/u1/c1", "conns/u1/c2", "conns/u10/c4", "conns/u2/c3", "other"}},
+				{"conns/", []string{"conns/u1/c1", "conns/u1/c2", "conns/u10/c4", "conns/u2/c3"}},
+				{"conns/u1/", []string{"conns/u1/c1", "conns/u1/c2"}},
+				{"conns/u1", []string{"conns/u1/c1", "conns/u1/c2", "conns/u10/c4"}},
+				{"conns/u1/c", []string{"conns/u1/c1", "conns/u1/c2"}},
+				{"conns/u3/", nil},
+			}
+			for _, tt := range tests {
+				if got := listKeys(t, kv, tt.prefix); !equalKeys(got, tt.want) {
+					t.Errorf("List(%q) = %v, want %v", tt.prefix, got, tt.want)
+				}
+			}
+
+			entries, err := kv.List(context.Background(), "conns/u2/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 || string(entries[0].Value) != "conns/u2/c3" {
+				t.Fatalf("List returned %v", entries)
+			}
+		})
+	}
+}
+
+func TestKVPutReplacesAndDeletes(t *testing.T) {
+	for _, tc := range kvCases() {
+		t.Run(tc.name, func(t *testing.T) {
+			kv := tc.new(t)
+			ctx := context.Background()
+			lease := grant(t, kv)
+
+			put(t, kv, "conns/u1/c1", lease)
+			if err := kv.Put(ctx, "conns/u1/c1", []byte("updated"), lease); err != nil {
+				t.Fatal(err)
+			}
+			entries, _ := kv.List(ctx, "conns/u1/")
+			if len(entries) != 1 || string(entries[0].Value) != "updated" {
+				t.Fatalf("List returned %v", entries)
+			}
+
+			if err := kv.Delete(ctx, "conns/u1/c1"); err != nil {
+				t.Fatal(err)
+			}
+			if err := kv.Delete(ctx, "conns/u1/c1"); err != nil {
+				t.Fatalf("deleting a missing key: %v", err)
+			}
+			if got := listKeys(t, kv, ""); len(got) != 0 {
+				t.Fatalf("deleted key is listed: %v", got)
+			}
+		})
+	}
+}
+
+func TestKVLeaseExpiry(t *testing.T) {
+	for _, tc := range kvCases() {
+		t.Run(tc.name, func(t *testing.T) {
+			kv := tc.new(t)
+			ctx := context.Background()
+			kept := grant(t, kv)
+			lost := grant(t, kv)
+			put(t, kv, "conns/u1/c1", kept)
+			put(t, kv, "conns/u1/c2", lost)
+
+			tc.advance(testLeaseTTL + 50*time.Millisecond)
+			if err := kv.KeepAlive(ctx, lost); !errors.Is(err, ErrLeaseNotFound) {
+				t.Fatalf("KeepAlive of an expired lease: %v", err)
+			}
+			if err := kv.Put(ctx, "conns/u1/c3", nil, lost); !errors.Is(err, ErrLeaseNotFound) {
+				t.Fatalf("Put under an expired lease: %v", err)
+			}
+			if got := listKeys(t, kv, ""); len(got) != 0 {
+				t.Fatalf("keys of expired leases are listed: %v", got)
+			}
+
+			// A lease that is kept alive outlives its first TTL
+			kept = grant(t, kv)
+			put(t, kv, "conns/u1/c1", kept)
+			for i := 0; i < 3; i++ {
+				tc.advance(testLeaseTTL / 2)
+				if err := kv.KeepAlive(ctx, kept); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := listKeys(t, kv, ""); !equalKeys(got, []string{"conns/u1/c1"}) {
+				t.Fatalf("List = %v after keepalive", got)
+			}
+		})
+	}
+}
+
+func TestKVRevoke(t *testing.T) {
+	for _, tc := range kvCases() {
+		t.Run(tc.name, func(t *testing.T) {
+			kv := tc.new(t)
+			ctx := context.Background()
+			first := grant(t, kv)
+			second := grant(t, kv)
+			put(t, kv, "conns/u1/c1", first)
+			put(t, kv, "conns/u1/c2", first)
+			put(t, kv, "conns/u2/c3", second)
+
+			// c2 moved to the second lease, revoking the first keeps it
+			put(t, kv, "conns/u1/c2", second)
+
+			if err := kv.Revoke(ctx, first); err != nil {
+				t.Fatal(err)
+			}
+			if got := listKeys(t, kv, ""); !equalKeys(got, []string{"conns/u1/c2", "conns/u2/c3"}) {
+				t.Fatalf("List = %v after revoke", got)
+			}
+			if err := kv.Put(ctx, "conns/u1/c1", nil, first); !errors.Is(err, ErrLeaseNotFound) {
+				t.Fatalf("Put under a revoked lease: %v", err)
+			}
+			if err := kv.KeepAlive(ctx, first); !errors.Is(err, ErrLeaseNotFound) {
+				t.Fatalf("KeepAlive of a revoked lease: %v", err)
+			}
+
+			if err := kv.Revoke(ctx, second); err != nil {
+				t.Fatal(err)
+			}
+			if got := listKeys(t, kv, ""); len(got) != 0 {
+				t.Fatalf("List = %v after revoking every lease", got)
+			}
+		})
+	}
+}
+
+// TestRedisKVKeysByUser checks that Redis keeps one hash per user and drops
+// it, and everything recorded for a lease, once empty
+func TestRedisKVKeysByUser(t *testing.T) {
+	mr := miniredis.RunT(t)
+	kv, err := NewRedisKV("redis://"+mr.Addr(), "test:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	ctx := context.Background()
+
+	lease := grant(t, kv)
+	put(t, kv, "conns/u1/c1", lease)
+	put(t, kv, "conns/u2/c2", lease)
+
+	if got, _ := mr.HKeys("test:dir:conns/u1/"); len(got) != 1 || got[0] != "c1" {
+		t.Fatalf("hash of u1 holds %v", got)
+	}
+
+	if err := kv.Delete(ctx, "conns/u1/c1"); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists("test:dir:conns/u1/") {
+		t.Fatal("empty hash of u1 was kept")
+	}
+	if got, _ := mr.ZMembers("test:dirs"); len(got) != 1 || got[0] != "conns/u2/" {
+		t.Fatalf("directories %v", got)
+	}
+
+	if err := kv.Revoke(ctx, lease); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range mr.Keys() {
+		t.Errorf("%s left after revoke", key)
+	}
+}
@@ -0,0 +1,178 @@
+package stores
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// EvictionReason says why the reaper removed a connection
+type EvictionReason string
+
+const (
+	// EvictIdle is a connection that neither read nor wrote for the idle timeout
+	EvictIdle EvictionReason = "idle"
+	// EvictMaxLifetime is a connection open for longer than the max lifetime
+	EvictMaxLifetime EvictionReason = "max_lifetime"
+	// EvictClosed is an entry left behind by a connection whose handler
+	// already returned
+	EvictClosed EvictionReason = "closed"
+)
+
+// Close reasons sent to clients with StatusGoingAway (1001)
+var closeReasons = map[EvictionReason]string{
+	EvictIdle:        "idle timeout",
+	EvictMaxLifetime: "max connection lifetime reached",
+}
+
+const (
+	minReapInterval = time.Second
+	maxReapInterval = 30 * time.Second
+)
+
+// ReaperConfig holds the limits enforced by a Reaper. A zero limit is not
+// enforced.
+type ReaperConfig struct {
+	// IdleTimeout closes connections without reads or writes for this long
+	IdleTimeout time.Duration
+	// MaxLifetime closes connections open for this long, however active.
+	// Clients are expected to reconnect.
+	MaxLifetime time.Duration
+	// Interval is how often connections are checked, by default a quarter
+	// of the shortest limit, between 1s and 30s
+	Interval time.Duration
+}
+
+// Reaper periodically closes the connections of a store that exceed their
+// limits and removes entries whose connection is already gone
+type Reaper struct {
+	store       ConnectionStore
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+	interval    time.Duration
+
+	idle, lifetime, closed atomic.Uint64
+
+	done     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func NewReaper(store ConnectionStore, cfg ReaperConfig) *Reaper {
+	if cfg.Interval <= 0 {
+		cfg.Interval = maxReapInterval
+		for _, limit := range []time.Duration{cfg.IdleTimeout, cfg.MaxLifetime} {
+			if limit > 0 && limit/4 < cfg.Interval {
+				cfg.Interval = limit / 4
+			}
+		}
+		if cfg.Interval < minReapInterval {
+			cfg.Interval = minReapInterval
+		}
+	}
+
+	return &Reaper{
+		store:       store,
+		idleTimeout: cfg.IdleTimeout,
+		maxLifetime: cfg.MaxLifetime,
+		interval:    cfg.Interval,
+		done:        make(chan struct{}),
+	}
+}
+
+// Start runs the reaper in the background until Stop
+func (r *Reaper) Start() {
+	log.Printf("Starting connection reaper (idle timeout %v, max lifetime %v)", r.idleTimeout, r.maxLifetime)
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-r.done:
+				return
+			case <-ticker.C:
+				r.Reap()
+			}
+		}
+	}()
+}
+
+// Stop stops the reaper and waits for a pass in progress to finish
+func (r *Reaper) Stop() {
+	r.stopOnce.Do(func() { close(r.done) })
+	r.wg.Wait()
+}
+
+// Reap checks every connection once and returns how many were evicted
+func (r *Reaper) Reap() int {
+	now := time.Now()
+	evicted := 0
+
+	for _, c := range r.store.GetAll() {
+		reason, ok := r.check(c, now)
+		if !ok {
+			continue
+		}
+		r.evict(c, reason)
+		evicted++
+	}
+
+	if evicted > 0 {
+		log.Printf("Connection reaper evicted %d connections", evicted)
+	}
+	return evicted
+}
+
+// check returns why a connection must go, if it must
+func (r *Reaper) check(c ConnectionData, now time.Time) (EvictionReason, bool) {
+	switch {
+	case c.Conn == nil || (c.Ctx != nil && c.Ctx.Err() != nil):
+		return EvictClosed, true
+	case r.maxLifetime > 0 && now.Sub(c.CreatedAt) >= r.maxLifetime:
+		return EvictMaxLifetime, true
+	case r.idleTimeout > 0 && c.LastActive != nil && now.Sub(c.LastActive.Time()) >= r.idleTimeout:
+		return EvictIdle, true
+	}
+	return "", false
+}
+
+// evict removes a connection from the store so it gets no more messages,
+// then closes it with StatusGoingAway and the reason
+func (r *Reaper) evict(c ConnectionData, reason EvictionReason) {
+	r.store.RemoveByConnID(c.ClientID, c.ConnectionID)
+
+	switch reason {
+	case EvictIdle:
+		r.idle.Add(1)
+	case EvictMaxLifetime:
+		r.lifetime.Add(1)
+	case EvictClosed:
+		r.closed.Add(1)
+		return
+	}
+
+	log.Printf("Evicting connection %s of user %s: %s", c.ConnectionID, c.ClientID, reason)
+	// Close waits for the client to complete the close handshake
+	go func() {
+		if err := c.Conn.Close(websocket.StatusGoingAway, closeReasons[reason]); err != nil {
+			log.Printf("Failed to close connection %s: %v", c.ConnectionID, err)
+		}
+	}()
+}
+
+// Evictions returns how many connections were evicted for each reason
+func (r *Reaper) Evictions() map[EvictionReason]uint64 {
+	return map[EvictionReason]uint64{
+		EvictIdle:        r.idle.Load(),
+		EvictMaxLifetime: r.lifetime.Load(),
+		EvictClosed:      r.closed.Load(),
+	}
+}
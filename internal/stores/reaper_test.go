@@ -0,0 +1,178 @@
+package stores
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// wsPair opens a WebSocket connection and returns its server and client side
+func wsPair(t *testing.T) (server, client *websocket.Conn) {
+	t.Helper()
+
+	accepted := make(chan *websocket.Conn, 1)
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		accepted <- conn
+		<-done
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(done) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, _, err := websocket.Dial(ctx, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.CloseNow() })
+	return <-accepted, client
+}
+
+// expectClosed waits for the client side to be closed with StatusGoingAway
+// and reason
+func expectClosed(t *testing.T, client *websocket.Conn, reason string) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, _, err := client.Read(ctx)
+	var closeErr websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.StatusGoingAway || closeErr.Reason != reason {
+		t.Fatalf("connection closed with %v, want %v %q", err, websocket.StatusGoingAway, reason)
+	}
+}
+
+func TestReaperEvictsIdleConnections(t *testing.T) {
+	s := NewConnectionStorage()
+	ctx := context.Background()
+
+	idle, idleClient := wsPair(t)
+	active, _ := wsPair(t)
+	s.Add(ctx, "u1", "idle", idle, true)
+	s.Add(ctx, "u1", "active", active, true)
+	s.AddChannel("u1", "idle", "a")
+
+	r := NewReaper(s, ReaperConfig{IdleTimeout: 50 * time.Millisecond})
+	if n := r.Reap(); n != 0 {
+		t.Fatalf("evicted %d fresh connections", n)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if c, ok := s.GetByConnID("u1", "active"); ok {
+		c.LastActive.Touch()
+	}
+	if n := r.Reap(); n != 1 {
+		t.Fatalf("evicted %d connections, want 1", n)
+	}
+
+	// Removed from the store, and its channels, before it is closed
+	if _, ok := s.GetByConnID("u1", "idle"); ok {
+		t.Fatal("idle connection is still stored")
+	}
+	if conns, _ := s.GetByChannel("a"); len(conns) != 0 {
+		t.Fatal("idle connection still receives its channel")
+	}
+	if _, ok := s.GetByConnID("u1", "active"); !ok {
+		t.Fatal("active connection was evicted")
+	}
+	expectClosed(t, idleClient, "idle timeout")
+
+	if got := r.Evictions(); got[EvictIdle] != 1 || got[EvictMaxLifetime] != 0 || got[EvictClosed] != 0 {
+		t.Fatalf("evictions %v", got)
+	}
+}
+
+func TestReaperEnforcesMaxLifetime(t *testing.T) {
+	s := NewConnectionStorage()
+	server, client := wsPair(t)
+	s.Add(context.Background(), "u1", "c1", server, true)
+
+	r := NewReaper(s, ReaperConfig{IdleTimeout: time.Hour, MaxLifetime: 50 * time.Millisecond})
+	time.Sleep(60 * time.Millisecond)
+
+	// However active it is
+	if c, ok := s.GetByConnID("u1", "c1"); ok {
+		c.LastActive.Touch()
+	}
+	if n := r.Reap(); n != 1 {
+		t.Fatalf("evicted %d connections, want 1", n)
+	}
+	expectClosed(t, client, "max connection lifetime reached")
+	if got := r.Evictions(); got[EvictMaxLifetime] != 1 {
+		t.Fatalf("evictions %v", got)
+	}
+}
+
+func TestReaperRemovesClosedConnections(t *testing.T) {
+	s := NewConnectionStorage()
+	ended, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	s.Add(context.Background(), "u1", "no-conn", nil, true)
+	server, _ := wsPair(t)
+	s.Add(ended, "u1", "handler-returned", server, true)
+
+	r := NewReaper(s, ReaperConfig{})
+	if n := r.Reap(); n != 2 {
+		t.Fatalf("evicted %d connections, want 2", n)
+	}
+	if s.IsExists("u1") {
+		t.Fatal("stale entries are still stored")
+	}
+	if got := r.Evictions(); got[EvictClosed] != 2 {
+		t.Fatalf("evictions %v", got)
+	}
+}
+
+func TestReaperInterval(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  ReaperConfig
+		want time.Duration
+	}{
+		{"no limits", ReaperConfig{}, maxReapInterval},
+		{"quarter of the idle timeout", ReaperConfig{IdleTimeout: 10 * time.Second}, 2500 * time.Millisecond},
+		{"shortest limit", ReaperConfig{IdleTimeout: time.Hour, MaxLifetime: 20 * time.Second}, 5 * time.Second},
+		{"at least a second", ReaperConfig{IdleTimeout: time.Second}, minReapInterval},
+		{"at most 30s", ReaperConfig{MaxLifetime: 24 * time.Hour}, maxReapInterval},
+		{"explicit", ReaperConfig{IdleTimeout: time.Second, Interval: 10 * time.Millisecond}, 10 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		if got := NewReaper(NewConnectionStorage(), tt.cfg).interval; got != tt.want {
+			t.Errorf("%s: interval %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReaperRunsUntilStopped(t *testing.T) {
+	s := NewConnectionStorage()
+	r := NewReaper(s, ReaperConfig{Interval: 10 * time.Millisecond})
+	r.Start()
+	defer r.Stop()
+
+	s.Add(context.Background(), "u1", "c1", nil, true)
+	deadline := time.Now().Add(2 * time.Second)
+	for s.IsExists("u1") {
+		if time.Now().After(deadline) {
+			t.Fatal("stale entry was not reaped")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	r.Stop()
+	s.Add(context.Background(), "u2", "c2", nil, true)
+	time.Sleep(50 * time.Millisecond)
+	if !s.IsExists("u2") {
+		t.Fatal("reaped after Stop")
+	}
+}
@@ -0,0 +1,304 @@
+package stores
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+var _ KV = (*RedisKV)(nil)
+
+// RedisKV is a KV shared through Redis. Leases are keys with a TTL. Entries
+// are grouped by directory, the part of their key up to the last /, into one
+// hash per directory, so listing the connections of one user reads that
+// user's hash only. A sorted set of the directories finds the ones under a
+// prefix, and a set per lease the entries to delete when it is revoked.
+// Entries of an expired lease are skipped by List and removed as it comes
+// across them.
+type RedisKV struct {
+	rdb    *goredis.Client
+	prefix string
+}
+
+// redisEntry is the hash value of one entry
+type redisEntry struct {
+	Lease LeaseID `json:"lease"`
+	Value []byte  `json:"value"`
+}
+
+// putEntry writes an entry if its lease is live, recording it in the
+// directories and in the lease's entries, which expire together with the
+// lease
+//
+// KEYS: lease, directory hash, directories, lease entries
+// ARGV: field, entry, directory, key
+var putEntry = goredis.NewScript(`
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl == -2 then
+	return 0
+end
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[2])
+redis.call('ZADD', KEYS[3], 0, ARGV[3])
+redis.call('SADD', KEYS[4], ARGV[4])
+if ttl > 0 then
+	redis.call('PEXPIRE', KEYS[4], ttl)
+end
+return 1
+`)
+
+// deleteEntry deletes an entry if it is attached to the given lease, and its
+// directory once empty. It returns 0 when the entry is attached to another
+// lease.
+//
+// KEYS: directory hash, directories, lease entries
+// ARGV: field, directory, lease, key
+var deleteEntry = goredis.NewScript(`
+redis.call('SREM', KEYS[3], ARGV[4])
+local entry = redis.call('HGET', KEYS[1], ARGV[1])
+if not entry then
+	return 1
+end
+if cjson.decode(entry).lease ~= ARGV[3] then
+	return 0
+end
+redis.call('HDEL', KEYS[1], ARGV[1])
+if redis.call('HLEN', KEYS[1]) == 0 then
+	redis.call('ZREM', KEYS[2], ARGV[2])
+end
+return 1
+`)
+
+// NewRedisKV connects to Redis, keeping every key under prefix
+func NewRedisKV(url, prefix string) (*RedisKV, error) {
+	opts, err := goredis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL: %w", err)
+	}
+
+	rdb := goredis.NewClient(opts)
+	if err := rdb.Ping(context.Background()).Err(); err != nil {
+		rdb.Close()
+		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
+	}
+
+	return &RedisKV{rdb: rdb, prefix: prefix}, nil
+}
+
+// Close closes the connections to Redis
+func (kv *RedisKV) Close() error {
+	return kv.rdb.Close()
+}
+
+// splitKey splits a key into its directory, up to and including the last /,
+// and its name within the directory
+func splitKey(key string) (dir, name string) {
+	i := strings.LastIndex(key, "/")
+	return key[:i+1], key[i+1:]
+}
+
+func (kv *RedisKV) dirKey(dir string) string {
+	return kv.prefix + "dir:" + dir
+}
+
+func (kv *RedisKV) dirsKey() string {
+	return kv.prefix + "dirs"
+}
+
+func (kv *RedisKV) leaseKey(lease LeaseID) string {
+	return kv.prefix + "lease:" + string(lease)
+}
+
+func (kv *RedisKV) leaseEntriesKey(lease LeaseID) string {
+	return kv.prefix + "lease:" + string(lease) + ":keys"
+}
+
+func (kv *RedisKV) Grant(ctx context.Context, ttl time.Duration) (LeaseID, error) {
+	id := LeaseID(uuid.New().String())
+	if err := kv.rdb.Set(ctx, kv.leaseKey(id), ttl.Milliseconds(), ttl).Err(); err != nil {
+		return "", fmt.Errorf("failed to grant lease: %w", err)
+	}
+	return id, nil
+}
+
+func (kv *RedisKV) KeepAlive(ctx context.Context, lease LeaseID) error {
+	ttl, err := kv.rdb.Get(ctx, kv.leaseKey(lease)).Int64()
+	if errors.Is(err, goredis.Nil) {
+		return ErrLeaseNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to renew lease: %w", err)
+	}
+
+	pipe := kv.rdb.Pipeline()
+	renewed := pipe.PExpire(ctx, kv.leaseKey(lease), time.Duration(ttl)*time.Millisecond)
+	pipe.PExpire(ctx, kv.leaseEntriesKey(lease), time.Duration(ttl)*time.Millisecond)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to renew lease: %w", err)
+	}
+	if !renewed.Val() {
+		return ErrLeaseNotFound
+	}
+	return nil
+}
+
+func (kv *RedisKV) Revoke(ctx context.Context, lease LeaseID) error {
+	// Without the lease no entry can be put under it any more
+	if err := kv.rdb.Del(ctx, kv.leaseKey(lease)).Err(); err != nil {
+		return fmt.Errorf("failed to revoke lease: %w", err)
+	}
+
+	keys, err := kv.rdb.SMembers(ctx, kv.leaseEntriesKey(lease)).Result()
+	if err != nil {
+		return fmt.Errorf("failed to read keys of lease: %w", err)
+	}
+	for _, key := range keys {
+		if _, err := kv.deleteIfLease(ctx, key, lease); err != nil {
+			return fmt.Errorf("failed to delete keys of lease: %w", err)
+		}
+	}
+	return kv.rdb.Del(ctx, kv.leaseEntriesKey(lease)).Err()
+}
+
+func (kv *RedisKV) Put(ctx context.Context, key string, value []byte, lease LeaseID) error {
+	encoded, err := json.Marshal(redisEntry{Lease: lease, Value: value})
+	if err != nil {
+		return err
+	}
+
+	dir, name := splitKey(key)
+	put, err := putEntry.Run(ctx, kv.rdb,
+		[]string{kv.leaseKey(lease), kv.dirKey(dir), kv.dirsKey(), kv.leaseEntriesKey(lease)},
+		name, encoded, dir, key,
+	).Int()
+	if err != nil {
+		return fmt.Errorf("failed to put %s: %w", key, err)
+	}
+	if put == 0 {
+		return ErrLeaseNotFound
+	}
+	return nil
+}
+
+// deleteAttempts bounds how often Delete tries again when the entry moved to
+// another lease between reading and deleting it
+const deleteAttempts = 3
+
+func (kv *RedisKV) Delete(ctx context.Context, key string) error {
+	dir, name := splitKey(key)
+	for i := 0; i < deleteAttempts; i++ {
+		encoded, err := kv.rdb.HGet(ctx, kv.dirKey(dir), name).Bytes()
+		if errors.Is(err, goredis.Nil) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to delete %s: %w", key, err)
+		}
+
+		var e redisEntry
+		if err := json.Unmarshal(encoded, &e); err != nil {
+			return kv.rdb.HDel(ctx, kv.dirKey(dir), name).Err()
+		}
+		deleted, err := kv.deleteIfLease(ctx, key, e.Lease)
+		if err != nil {
+			return fmt.Errorf("failed to delete %s: %w", key, err)
+		}
+		if deleted {
+			return nil
+		}
+	}
+	return fmt.Errorf("failed to delete %s: entry keeps changing", key)
+}
+
+// deleteIfLease deletes an entry unless it is attached to another lease
+func (kv *RedisKV) deleteIfLease(ctx context.Context, key string, lease LeaseID) (bool, error) {
+	dir, name := splitKey(key)
+	deleted, err := deleteEntry.Run(ctx, kv.rdb,
+		[]string{kv.dirKey(dir), kv.dirsKey(), kv.leaseEntriesKey(lease)},
+		name, dir, string(lease), key,
+	).Int()
+	return deleted == 1, err
+}
+
+func (kv *RedisKV) List(ctx context.Context, prefix string) ([]KeyValue, error) {
+	dirs, err := kv.dirs(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	pipe := kv.rdb.Pipeline()
+	hashes := make([]*goredis.MapStringStringCmd, len(dirs))
+	for i, dir := range dirs {
+		hashes[i] = pipe.HGetAll(ctx, kv.dirKey(dir))
+	}
+	if len(dirs) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, fmt.Errorf("failed to read entries: %w", err)
+		}
+	}
+
+	entries := make(map[string]redisEntry)
+	for i, dir := range dirs {
+		for name, encoded := range hashes[i].Val() {
+			key := dir + name
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			var e redisEntry
+			if err := json.Unmarshal([]byte(encoded), &e); err != nil {
+				continue
+			}
+			entries[key] = e
+		}
+	}
+
+	leases := make(map[LeaseID]*goredis.IntCmd)
+	pipe = kv.rdb.Pipeline()
+	for _, e := range entries {
+		if _, ok := leases[e.Lease]; !ok {
+			leases[e.Lease] = pipe.Exists(ctx, kv.leaseKey(e.Lease))
+		}
+	}
+	if len(leases) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, fmt.Errorf("failed to check leases: %w", err)
+		}
+	}
+
+	var out []KeyValue
+	for key, e := range entries {
+		if leases[e.Lease].Val() == 0 {
+			// Left behind by a node that stopped without revoking its lease
+			kv.deleteIfLease(ctx, key, e.Lease)
+			continue
+		}
+		out = append(out, KeyValue{Key: key, Value: e.Value})
+	}
+
+	sortKeyValues(out)
+	return out, nil
+}
+
+// dirs returns the directories that may hold keys starting with prefix: the
+// directories under it and the one it ends in
+func (kv *RedisKV) dirs(ctx context.Context, prefix string) ([]string, error) {
+	by := &goredis.ZRangeBy{Min: "-", Max: "+"}
+	if prefix != "" {
+		// Keys are compared bytewise, \xff sorts after every UTF-8 byte
+		by = &goredis.ZRangeBy{Min: "[" + prefix, Max: "(" + prefix + "\xff"}
+	}
+	dirs, err := kv.rdb.ZRangeByLex(ctx, kv.dirsKey(), by).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directories: %w", err)
+	}
+
+	if dir, name := splitKey(prefix); name != "" {
+		dirs = append(dirs, dir)
+	}
+	return dirs, nil
+}
@@ -0,0 +1,455 @@
+package stores
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+const (
+	defaultLeaseTTL = 30 * time.Second
+	registryTimeout = 5 * time.Second
+)
+
+// ConnectionInfo is what the registry records about a connection
+type ConnectionInfo struct {
+	NodeID       string    `json:"node_id"`
+	UserID       string    `json:"user_id"`
+	ConnectionID string    `json:"connection_id"`
+	Channels     []string  `json:"channels"`
+	ConnectedAt  time.Time `json:"connected_at"`
+}
+
+// Registry records the connections of every node in a shared KV. Each node
+// attaches its entries to a lease it keeps renewing, so the connections of a
+// node that dies disappear once the lease expires.
+type Registry struct {
+	kv     KV
+	nodeID string
+	ttl    time.Duration
+
+	mu    sync.Mutex
+	lease LeaseID
+	// local is what this node registered, put again under a new lease when
+	// the old one was lost
+	local map[string]ConnectionInfo
+	// unsynced are the keys whose last put or delete failed, retried on the
+	// next heartbeat
+	unsynced map[string]struct{}
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// NewRegistry grants the node's lease and starts renewing it. A zero ttl
+// defaults to 30s.
+func NewRegistry(kv KV, nodeID string, ttl time.Duration) (*Registry, error) {
+	if ttl <= 0 {
+		ttl = defaultLeaseTTL
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+	defer cancel()
+
+	lease, err := kv.Grant(ctx, ttl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to grant registry lease: %w", err)
+	}
+
+	r := &Registry{
+		kv:       kv,
+		nodeID:   nodeID,
+		ttl:      ttl,
+		lease:    lease,
+		local:    make(map[string]ConnectionInfo),
+		unsynced: make(map[string]struct{}),
+		done:     make(chan struct{}),
+	}
+
+	r.wg.Add(1)
+	go r.heartbeat()
+
+	return r, nil
+}
+
+// NodeID is the node this registry records connections for
+func (r *Registry) NodeID() string {
+	return r.nodeID
+}
+
+// connKey is the key of a connection, grouped by user so a user's
+// connections can be listed by prefix
+func connKey(userID, connID string) string {
+	return "conns/" + url.PathEscape(userID) + "/" + url.PathEscape(connID)
+}
+
+// Register records a connection of this node, replacing what was recorded
+// for it before
+func (r *Registry) Register(ctx context.Context, info ConnectionInfo) error {
+	info.NodeID = r.nodeID
+	value, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("failed to marshal connection: %w", err)
+	}
+
+	key := connKey(info.UserID, info.ConnectionID)
+
+	r.mu.Lock()
+	r.local[key] = info
+	lease := r.lease
+	r.mu.Unlock()
+
+	err = r.kv.Put(ctx, key, value, lease)
+	r.synced(key, err)
+	if err != nil {
+		return fmt.Errorf("failed to register connection %s: %w", info.ConnectionID, err)
+	}
+	return nil
+}
+
+// Unregister removes a connection of this node
+func (r *Registry) Unregister(ctx context.Context, userID, connID string) error {
+	key := connKey(userID, connID)
+
+	r.mu.Lock()
+	delete(r.local, key)
+	r.mu.Unlock()
+
+	err := r.kv.Delete(ctx, key)
+	r.synced(key, err)
+	if err != nil {
+		return fmt.Errorf("failed to unregister connection %s: %w", connID, err)
+	}
+	return nil
+}
+
+// synced records whether the last write of key reached the KV, the heartbeat
+// retries it when it did not
+func (r *Registry) synced(key string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.unsynced[key] = struct{}{}
+	} else {
+		delete(r.unsynced, key)
+	}
+}
+
+// Locate returns the connections of a user across the cluster
+func (r *Registry) Locate(ctx context.Context, userID string) ([]ConnectionInfo, error) {
+	return r.list(ctx, "conns/"+url.PathEscape(userID)+"/")
+}
+
+// List returns every connection across the cluster
+func (r *Registry) List(ctx context.Context) ([]ConnectionInfo, error) {
+	return r.list(ctx, "conns/")
+}
+
+func (r *Registry) list(ctx context.Context, prefix string) ([]ConnectionInfo, error) {
+	entries, err := r.kv.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]ConnectionInfo, 0, len(entries))
+	for _, e := range entries {
+		var info ConnectionInfo
+		if err := json.Unmarshal(e.Value, &info); err != nil {
+			log.Printf("Skipping malformed registry entry %s: %v", e.Key, err)
+			continue
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// heartbeat renews the lease at a third of its TTL and retries the writes
+// that failed. When the lease was lost, after a network partition or a long
+// pause, it takes a new one and registers the node's connections again.
+func (r *Registry) heartbeat() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+		err := r.renew(ctx)
+		cancel()
+		if err != nil {
+			log.Printf("Failed to renew registry lease of node %s: %v", r.nodeID, err)
+		}
+	}
+}
+
+func (r *Registry) renew(ctx context.Context) error {
+	r.mu.Lock()
+	lease := r.lease
+	r.mu.Unlock()
+
+	err := r.kv.KeepAlive(ctx, lease)
+	if errors.Is(err, ErrLeaseNotFound) {
+		log.Printf("Registry lease of node %s expired, registering its connections again", r.nodeID)
+		if lease, err = r.kv.Grant(ctx, r.ttl); err != nil {
+			return err
+		}
+
+		// Entries of the old lease are gone, failed deletes included
+		r.mu.Lock()
+		r.lease = lease
+		r.unsynced = make(map[string]struct{}, len(r.local))
+		for key := range r.local {
+			r.unsynced[key] = struct{}{}
+		}
+		r.mu.Unlock()
+	} else if err != nil {
+		return err
+	}
+	return r.resync(ctx, lease)
+}
+
+// resync writes the keys whose last write failed again, putting those that
+// are still registered and deleting the others
+func (r *Registry) resync(ctx context.Context, lease LeaseID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for key := range r.unsynced {
+		var err error
+		if info, ok := r.local[key]; ok {
+			var value []byte
+			if value, err = json.Marshal(info); err == nil {
+				err = r.kv.Put(ctx, key, value, lease)
+			}
+		} else {
+			err = r.kv.Delete(ctx, key)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to sync registry entry %s: %w", key, err)
+		}
+		delete(r.unsynced, key)
+	}
+	return nil
+}
+
+// Close stops renewing the lease and revokes it, removing the node's
+// connections from the registry
+func (r *Registry) Close() error {
+	r.closeOnce.Do(func() { close(r.done) })
+	r.wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+	defer cancel()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.kv.Revoke(ctx, r.lease)
+}
+
+// registryQueues is the number of queues the registry updates of connections
+// are spread over, by connection ID
+const registryQueues = 64
+
+// registryUpdate records or removes a connection in the registry
+type registryUpdate struct {
+	userID string
+	connID string
+	remove bool
+}
+
+// registryQueue holds the registry updates waiting for its goroutine. A
+// connection has at most one update waiting: registering reads the
+// connection when it runs, so another one adds nothing, and a removal
+// replaces it and is never replaced itself.
+type registryQueue struct {
+	mu      sync.Mutex
+	pending map[string]registryUpdate
+	order   []string
+	wake    chan struct{}
+}
+
+func (q *registryQueue) push(u registryUpdate) {
+	q.mu.Lock()
+	prev, ok := q.pending[u.connID]
+	if !ok {
+		q.order = append(q.order, u.connID)
+	}
+	if !prev.remove {
+		q.pending[u.connID] = u
+	}
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *registryQueue) pop() (registryUpdate, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.order) == 0 {
+		return registryUpdate{}, false
+	}
+	connID := q.order[0]
+	q.order = q.order[1:]
+	u := q.pending[connID]
+	delete(q.pending, connID)
+	return u, true
+}
+
+// DistributedStore is a ConnectionStorage that also records its connections
+// in a Registry, so any node can tell where a user is connected. The local
+// storage is authoritative: the registry is updated in the background and
+// its failures are logged, then retried by the lease heartbeat.
+type DistributedStore struct {
+	*ConnectionStorage
+	registry *Registry
+	// queues apply the registry updates of a connection one at a time and in
+	// order, so one that read it just before it was removed cannot record
+	// it again after it was unregistered
+	queues [registryQueues]registryQueue
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+func NewDistributedStore(local *ConnectionStorage, registry *Registry) *DistributedStore {
+	s := &DistributedStore{
+		ConnectionStorage: local,
+		registry:          registry,
+		done:              make(chan struct{}),
+	}
+	for i := range s.queues {
+		q := &s.queues[i]
+		q.pending = make(map[string]registryUpdate)
+		q.wake = make(chan struct{}, 1)
+		s.wg.Add(1)
+		go s.run(q)
+	}
+	return s
+}
+
+// Registry returns the cluster-wide view of connections
+func (s *DistributedStore) Registry() *Registry {
+	return s.registry
+}
+
+// Close applies the registry updates still queued and stops. Updates made
+// afterwards only change the local storage.
+func (s *DistributedStore) Close() {
+	s.closeOnce.Do(func() { close(s.done) })
+	s.wg.Wait()
+}
+
+func (s *DistributedStore) Add(ctx context.Context, id, connId string, conn *websocket.Conn, isAuth bool) {
+	s.ConnectionStorage.Add(ctx, id, connId, conn, isAuth)
+	s.update(registryUpdate{userID: id, connID: connId})
+}
+
+func (s *DistributedStore) AddChannel(id string, connId, channel string) []string {
+	subscriptions := s.ConnectionStorage.AddChannel(id, connId, channel)
+	s.update(registryUpdate{userID: id, connID: connId})
+	return subscriptions
+}
+
+func (s *DistributedStore) RemoveChannel(id string, connId, channel string) ([]string, bool) {
+	subscriptions, ok := s.ConnectionStorage.RemoveChannel(id, connId, channel)
+	if ok {
+		s.update(registryUpdate{userID: id, connID: connId})
+	}
+	return subscriptions, ok
+}
+
+func (s *DistributedStore) Remove(id string) {
+	data, _ := s.ConnectionStorage.Get(id)
+	s.ConnectionStorage.Remove(id)
+	for _, connData := range data {
+		s.update(registryUpdate{userID: id, connID: connData.ConnectionID, remove: true})
+	}
+}
+
+func (s *DistributedStore) RemoveByConnID(id string, connId string) {
+	s.ConnectionStorage.RemoveByConnID(id, connId)
+	s.update(registryUpdate{userID: id, connID: connId, remove: true})
+}
+
+// update queues a registry update on the queue of its connection
+func (s *DistributedStore) update(u registryUpdate) {
+	h := fnv.New32a()
+	h.Write([]byte(u.connID))
+	s.queues[h.Sum32()%registryQueues].push(u)
+}
+
+// run applies the updates of a queue until the store is closed
+func (s *DistributedStore) run(q *registryQueue) {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case <-q.wake:
+		case <-s.done:
+		}
+
+		for {
+			u, ok := q.pop()
+			if !ok {
+				break
+			}
+			s.apply(u)
+		}
+
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+	}
+}
+
+// apply records the current state of a local connection, or removes it.
+// Connections are only removed locally before their removal is queued, so
+// one read here is never already unregistered.
+func (s *DistributedStore) apply(u registryUpdate) {
+	ctx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+	defer cancel()
+
+	if u.remove {
+		if err := s.registry.Unregister(ctx, u.userID, u.connID); err != nil {
+			log.Printf("Registry: %v", err)
+		}
+		return
+	}
+
+	connData, ok := s.ConnectionStorage.GetByConnID(u.userID, u.connID)
+	if !ok {
+		return
+	}
+
+	err := s.registry.Register(ctx, ConnectionInfo{
+		UserID:       u.userID,
+		ConnectionID: u.connID,
+		Channels:     connData.SubscribedChannels,
+		ConnectedAt:  connData.CreatedAt,
+	})
+	if err != nil {
+		log.Printf("Registry: %v", err)
+	}
+}
@@ -0,0 +1,263 @@
+package stores
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestRegistry(t *testing.T, kv KV, nodeID string, ttl time.Duration) *Registry {
+	t.Helper()
+	r, err := NewRegistry(kv, nodeID, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+func TestRegistryAcrossNodes(t *testing.T) {
+	kv := NewMemoryKV()
+	ctx := context.Background()
+	node1 := newTestRegistry(t, kv, "node-1", 0)
+	node2 := newTestRegistry(t, kv, "node-2", 0)
+
+	for _, reg := range []struct {
+		r    *Registry
+		info ConnectionInfo
+	}{
+		{node1, ConnectionInfo{UserID: "u1", ConnectionID: "c1", Channels: []string{"a"}}},
+		{node2, ConnectionInfo{UserID: "u1", ConnectionID: "c2"}},
+		{node2, ConnectionInfo{UserID: "u/2", ConnectionID: "c3"}},
+	} {
+		if err := reg.r.Register(ctx, reg.info); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	located, err := node2.Locate(ctx, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(located) != 2 || located[0].NodeID != "node-1" || located[1].NodeID != "node-2" {
+		t.Fatalf("u1 located at %+v", located)
+	}
+	if located[0].Channels[0] != "a" {
+		t.Fatalf("channels of c1 not recorded: %+v", located[0])
+	}
+
+	// User IDs are escaped, so u/2 is not listed under u
+	if located, _ := node1.Locate(ctx, "u"); len(located) != 0 {
+		t.Fatalf("u located at %+v", located)
+	}
+	if located, _ := node1.Locate(ctx, "u/2"); len(located) != 1 || located[0].ConnectionID != "c3" {
+		t.Fatalf("u/2 located at %+v", located)
+	}
+
+	if err := node1.Unregister(ctx, "u1", "c1"); err != nil {
+		t.Fatal(err)
+	}
+	if all, _ := node1.List(ctx); len(all) != 2 {
+		t.Fatalf("%d connections listed after unregister", len(all))
+	}
+
+	// A node that stops takes its connections with it
+	if err := node2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if all, _ := node1.List(ctx); len(all) != 0 {
+		t.Fatalf("connections of a closed node listed: %+v", all)
+	}
+}
+
+func TestRegistryRegistersAgainAfterLosingItsLease(t *testing.T) {
+	kv := NewMemoryKV()
+	ctx := context.Background()
+	r := newTestRegistry(t, kv, "node-1", 150*time.Millisecond)
+
+	if err := r.Register(ctx, ConnectionInfo{UserID: "u1", ConnectionID: "c1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// As if the lease expired during a partition
+	r.mu.Lock()
+	lease := r.lease
+	r.mu.Unlock()
+	kv.Revoke(ctx, lease)
+	if located, _ := r.Locate(ctx, "u1"); len(located) != 0 {
+		t.Fatalf("located on a revoked lease: %+v", located)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if located, _ := r.Locate(ctx, "u1"); len(located) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("connection was not registered again")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// failingKV fails writes while failing is set
+type failingKV struct {
+	KV
+	failing atomic.Bool
+}
+
+func (kv *failingKV) Put(ctx context.Context, key string, value []byte, lease LeaseID) error {
+	if kv.failing.Load() {
+		return errors.New("unavailable")
+	}
+	return kv.KV.Put(ctx, key, value, lease)
+}
+
+func (kv *failingKV) Delete(ctx context.Context, key string) error {
+	if kv.failing.Load() {
+		return errors.New("unavailable")
+	}
+	return kv.KV.Delete(ctx, key)
+}
+
+func TestRegistryRetriesFailedWrites(t *testing.T) {
+	kv := &failingKV{KV: NewMemoryKV()}
+	ctx := context.Background()
+	r := newTestRegistry(t, kv, "node-1", 150*time.Millisecond)
+
+	located := func(userID string) int {
+		t.Helper()
+		infos, err := r.Locate(ctx, userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(infos)
+	}
+	eventually := func(what string, cond func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(2 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s was not retried", what)
+			}
+		}
+	}
+
+	if err := r.Register(ctx, ConnectionInfo{UserID: "u1", ConnectionID: "c1"}); err != nil {
+		t.Fatal(err)
+	}
+	kv.failing.Store(true)
+	if err := r.Register(ctx, ConnectionInfo{UserID: "u2", ConnectionID: "c2"}); err == nil {
+		t.Fatal("register succeeded on a failing KV")
+	}
+	if err := r.Unregister(ctx, "u1", "c1"); err == nil {
+		t.Fatal("unregister succeeded on a failing KV")
+	}
+	kv.failing.Store(false)
+
+	eventually("failed register", func() bool { return located("u2") == 1 })
+	eventually("failed unregister", func() bool { return located("u1") == 0 })
+}
+
+// blockingKV holds puts until released
+type blockingKV struct {
+	KV
+	release chan struct{}
+}
+
+func (kv blockingKV) Put(ctx context.Context, key string, value []byte, lease LeaseID) error {
+	<-kv.release
+	return kv.KV.Put(ctx, key, value, lease)
+}
+
+func TestDistributedStoreDoesNotWaitForTheRegistry(t *testing.T) {
+	ctx := context.Background()
+	kv := blockingKV{KV: NewMemoryKV(), release: make(chan struct{})}
+	registry := newTestRegistry(t, kv, "node-1", 0)
+	s := NewDistributedStore(NewConnectionStorage(), registry)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Add(ctx, "u1", "c1", nil, true)
+		s.AddChannel("u1", "c1", "a")
+		s.AddChannel("u1", "c1", "b")
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the store waited for the registry")
+	}
+	if conns, _ := s.GetByChannel("b"); len(conns) != 1 {
+		t.Fatal("the local store was not updated")
+	}
+
+	close(kv.release)
+	s.Close()
+	located, err := registry.Locate(ctx, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(located) != 1 || len(located[0].Channels) != 2 {
+		t.Fatalf("registered %+v, want c1 with both channels", located)
+	}
+}
+
+// slowKV takes a while to put entries, as a remote KV does
+type slowKV struct {
+	KV
+}
+
+func (kv slowKV) Put(ctx context.Context, key string, value []byte, lease LeaseID) error {
+	time.Sleep(time.Millisecond)
+	return kv.KV.Put(ctx, key, value, lease)
+}
+
+// TestDistributedStoreRemoveWhileRegistering removes connections while they
+// are being subscribed. A removed connection must not be registered again.
+func TestDistributedStoreRemoveWhileRegistering(t *testing.T) {
+	ctx := context.Background()
+	registry := newTestRegistry(t, slowKV{NewMemoryKV()}, "node-1", 0)
+	s := NewDistributedStore(NewConnectionStorage(), registry)
+
+	const connections = 200
+	var wg sync.WaitGroup
+	for i := 0; i < connections; i++ {
+		user := fmt.Sprintf("user-%d", i%10)
+		connID := fmt.Sprintf("conn-%d", i)
+		s.Add(ctx, user, connID, nil, true)
+
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				s.AddChannel(user, connID, fmt.Sprintf("channel-%d", j))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			// Lands while some subscription is being registered
+			time.Sleep(time.Duration(i%5) * time.Millisecond)
+			s.RemoveByConnID(user, connID)
+		}()
+	}
+	wg.Wait()
+	s.Close()
+
+	all, err := registry.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 0 {
+		t.Fatalf("%d removed connections are registered, e.g. %+v", len(all), all[0])
+	}
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if len(registry.local) != 0 {
+		t.Fatalf("%d removed connections would be registered again", len(registry.local))
+	}
+}
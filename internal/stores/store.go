@@ -0,0 +1,33 @@
+package stores
+
+import (
+	"context"
+
+	"github.com/coder/websocket"
+)
+
+// ConnectionStore keeps track of the WebSocket connections of this node
+type ConnectionStore interface {
+	Add(ctx context.Context, id, connId string, conn *websocket.Conn, isAuth bool)
+	// AddChannel subscribes a connection to channel and returns its subscriptions
+	AddChannel(id string, connId, channel string) []string
+	// RemoveChannel unsubscribes a connection from channel and returns its
+	// remaining subscriptions, ok is false when it was not subscribed
+	RemoveChannel(id string, connId, channel string) (subscriptions []string, ok bool)
+	Subscriptions(id string, connId string) []string
+	// GetByChannel returns the connections subscribed to channel, in a new
+	// slice owned by the caller
+	GetByChannel(channel string) ([]ConnectionData, error)
+	Remove(id string)
+	RemoveByConnID(id string, connId string)
+	GetUserForConnection(connectionID string) string
+	GetAll() []ConnectionData
+	GetByConnID(id string, connId string) (*ConnectionData, bool)
+	Get(id string) ([]ConnectionData, bool)
+	IsExists(id string) bool
+}
+
+var (
+	_ ConnectionStore = (*ConnectionStorage)(nil)
+	_ ConnectionStore = (*DistributedStore)(nil)
+)
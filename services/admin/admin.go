@@ -0,0 +1,91 @@
+package admin
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/Gaoey/scale-websocket/internal/repository/broker"
+	"github.com/labstack/echo/v4"
+)
+
+const defaultDeadLetterLimit = 50
+
+type AdminHandler struct {
+	DeadLetters broker.DeadLetterQueue
+}
+
+func NewAdminHandler(deadLetters broker.DeadLetterQueue) *AdminHandler {
+	return &AdminHandler{
+		DeadLetters: deadLetters,
+	}
+}
+
+// ListDeadLetters returns the dead letters of a consumer queue without removing them
+func (h *AdminHandler) ListDeadLetters(c echo.Context) error {
+	if h.DeadLetters == nil {
+		return c.JSON(http.StatusNotImplemented, map[string]string{
+			"error": "Broker backend does not support dead letters",
+		})
+	}
+
+	limit, err := parseLimit(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid limit",
+		})
+	}
+
+	letters, err := h.DeadLetters.DeadLetters(c.Request().Context(), c.Param("queue"), limit)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to read dead letters",
+		})
+	}
+
+	return c.JSON(http.StatusOK, letters)
+}
+
+// ReplayDeadLetters moves dead letters back onto the queue they failed on
+func (h *AdminHandler) ReplayDeadLetters(c echo.Context) error {
+	if h.DeadLetters == nil {
+		return c.JSON(http.StatusNotImplemented, map[string]string{
+			"error": "Broker backend does not support dead letters",
+		})
+	}
+
+	limit, err := parseLimit(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid limit",
+		})
+	}
+
+	replayed, err := h.DeadLetters.ReplayDeadLetters(c.Request().Context(), c.Param("queue"), limit)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]interface{}{
+			"error":    "Failed to replay dead letters",
+			"replayed": replayed,
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status":   "dead letters replayed successfully",
+		"replayed": replayed,
+	})
+}
+
+func parseLimit(c echo.Context) (int, error) {
+	raw := c.QueryParam("limit")
+	if raw == "" {
+		return defaultDeadLetterLimit, nil
+	}
+
+	limit, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, err
+	}
+	if limit <= 0 {
+		return 0, strconv.ErrRange
+	}
+	return limit, nil
+}
@@ -16,11 +16,12 @@ var (
 type Claims struct {
 	UserID   string `json:"user_id"`
 	Username string `json:"username"`
+	Role     string `json:"role,omitempty"`
 	jwt.RegisteredClaims
 }
 
 // GenerateToken creates a new JWT token for the given user
-func GenerateToken(userID, username string) (string, error) {
+func GenerateToken(userID, username, role string) (string, error) {
 	// Set expiration time
 	expirationTime := time.Now().Add(24 * time.Hour)
 
@@ -28,6 +29,7 @@ func GenerateToken(userID, username string) (string, error) {
 	claims := &Claims{
 		UserID:   userID,
 		Username: username,
+		Role:     role,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
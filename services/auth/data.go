@@ -4,13 +4,21 @@ type User struct {
 	UserID   string `json:"user_id"`
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Role     string `json:"role"`
 }
 
+const (
+	// RoleAdmin may manage the broker through the /api/admin routes and see
+	// where users are connected across the cluster
+	RoleAdmin = "admin"
+)
+
 var MockUsers = map[string]User{
 	"admin": {
 		UserID:   "user123",
 		Username: "admin",
 		Password: "password",
+		Role:     RoleAdmin,
 	},
 	"user": {
 		UserID:   "user456",
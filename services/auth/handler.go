@@ -34,7 +34,7 @@ func LoginHandler(c echo.Context) error {
 
 	if req.Password == user.Password {
 		// Generate JWT token
-		token, err := GenerateToken(user.UserID, req.Username)
+		token, err := GenerateToken(user.UserID, req.Username, user.Role)
 		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, "Could not generate token")
 		}
@@ -0,0 +1,101 @@
+package example
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/Gaoey/scale-websocket/internal/repository/broker"
+	"github.com/Gaoey/scale-websocket/internal/schema"
+	"github.com/labstack/echo/v4"
+)
+
+// maxBatchSize caps the number of messages accepted by one batch request
+const maxBatchSize = 10000
+
+type BatchPayload struct {
+	Messages []BodyPayload `json:"messages"`
+}
+
+// BatchResult reports the outcome of one message of a batch, in request order
+type BatchResult struct {
+	Index     int                 `json:"index"`
+	MessageID string              `json:"message_id,omitempty"`
+	Status    string              `json:"status"`
+	Error     string              `json:"error,omitempty"`
+	Details   []schema.FieldError `json:"details,omitempty"`
+}
+
+// PublishBatch publishes many messages in one request. Messages that fail
+// validation are skipped, the rest go out together and every message gets
+// its own result.
+func (h *ExampleHandler) PublishBatch(c echo.Context) error {
+	var payload BatchPayload
+	if err := c.Bind(&payload); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid request body",
+		})
+	}
+	if len(payload.Messages) == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "messages is required",
+		})
+	}
+	if len(payload.Messages) > maxBatchSize {
+		return c.JSON(http.StatusRequestEntityTooLarge, map[string]string{
+			"error": fmt.Sprintf("a batch holds at most %d messages", maxBatchSize),
+		})
+	}
+
+	results := make([]BatchResult, len(payload.Messages))
+	msgs := make([]broker.BatchMessage, 0, len(payload.Messages))
+	indexes := make([]int, 0, len(payload.Messages))
+
+	for i := range payload.Messages {
+		p := &payload.Messages[i]
+		results[i] = BatchResult{Index: i, Status: "failed"}
+
+		if err := h.validate(*p); err != nil {
+			results[i].Error = "Failed to validate message"
+			var invalid *schema.ValidationError
+			if errors.As(err, &invalid) {
+				results[i].Error = "Message does not match the schema of channel " + invalid.Channel
+				results[i].Details = invalid.Fields
+			}
+			continue
+		}
+
+		opts, err := p.options()
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		results[i].MessageID = p.MessageID
+
+		msgs = append(msgs, broker.BatchMessage{
+			RoutingKey: p.RoutingKey,
+			Message:    p.Message,
+			Options:    opts,
+		})
+		indexes = append(indexes, i)
+	}
+
+	errs := broker.PublishBatch(c.Request().Context(), h.Client, msgs)
+
+	published := 0
+	for j, err := range errs {
+		i := indexes[j]
+		if err != nil {
+			_, results[i].Error = publishError(payload.Messages[i].RoutingKey, err)
+			continue
+		}
+		results[i].Status = "published"
+		published++
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"published": published,
+		"failed":    len(results) - published,
+		"results":   results,
+	})
+}
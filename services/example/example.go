@@ -1,24 +1,40 @@
 package example
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"time"
 
-	"github.com/Gaoey/scale-websocket/internal/repository/rabbitmq"
+	"github.com/Gaoey/scale-websocket/internal/repository/broker"
+	"github.com/Gaoey/scale-websocket/internal/schema"
 	"github.com/labstack/echo/v4"
 )
 
 type BodyPayload struct {
-	RoutingKey string      `json:"routing_key"`
-	Message    interface{} `json:"message"`
+	RoutingKey    string                 `json:"routing_key"`
+	Message       interface{}            `json:"message"`
+	Mandatory     bool                   `json:"mandatory"`
+	MessageID     string                 `json:"message_id"`
+	CorrelationID string                 `json:"correlation_id"`
+	Headers       map[string]interface{} `json:"headers"`
+	// ContentType picks the codec the message is published with, JSON by default
+	ContentType string `json:"content_type"`
+	// DeliverAt (RFC 3339) or Delay (e.g. "5m") hold the message back until it is due
+	DeliverAt *time.Time `json:"deliver_at"`
+	Delay     string     `json:"delay"`
 }
 
 type ExampleHandler struct {
-	Client *rabbitmq.Client
+	Client  broker.Broker
+	Schemas *schema.Registry
 }
 
-func NewExampleHandler(client *rabbitmq.Client) *ExampleHandler {
+func NewExampleHandler(client broker.Broker, schemas *schema.Registry) *ExampleHandler {
 	return &ExampleHandler{
-		Client: client,
+		Client:  client,
+		Schemas: schemas,
 	}
 }
 
@@ -31,15 +47,108 @@ func (h *ExampleHandler) PublishMessage(c echo.Context) error {
 		})
 	}
 
-	// Publish message to RabbitMQ
-	err := h.Client.Publish(c.Request().Context(), payload.RoutingKey, payload.Message)
-	if err != nil {
+	// Reject messages the subscribed channels could not render
+	if err := h.validate(payload); err != nil {
+		var invalid *schema.ValidationError
+		if errors.As(err, &invalid) {
+			return c.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+				"error":   "Message does not match the schema of channel " + invalid.Channel,
+				"details": invalid.Fields,
+			})
+		}
 		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": "Failed to publish message",
+			"error": "Failed to validate message",
+		})
+	}
+
+	// An Idempotency-Key becomes the message ID so consumers drop retried publishes
+	if key := c.Request().Header.Get("Idempotency-Key"); key != "" {
+		payload.MessageID = key
+	}
+
+	opts, err := payload.options()
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	// Publish message to the broker
+	err = h.Client.Publish(c.Request().Context(), payload.RoutingKey, payload.Message, opts...)
+	if err != nil {
+		status, reason := publishError(payload.RoutingKey, err)
+		return c.JSON(status, map[string]string{
+			"error": reason,
 		})
 	}
 
 	return c.JSON(http.StatusOK, map[string]string{
-		"status": "message published successfully",
+		"status":     "message published successfully",
+		"message_id": payload.MessageID,
 	})
 }
+
+// validate checks the message against the schemas of the channels it is routed to
+func (h *ExampleHandler) validate(payload BodyPayload) error {
+	if h.Schemas == nil {
+		return nil
+	}
+	return h.Schemas.ValidateRoutingKey(payload.RoutingKey, payload.Message)
+}
+
+// options turns the payload into publish options, assigning a message ID
+// when the caller did not pick one
+func (p *BodyPayload) options() ([]broker.PublishOption, error) {
+	if p.MessageID == "" {
+		p.MessageID = broker.NewMessageID()
+	}
+
+	opts := []broker.PublishOption{
+		broker.WithMessageID(p.MessageID),
+		broker.WithCorrelationID(p.CorrelationID),
+		broker.WithHeaders(p.Headers),
+	}
+	if p.ContentType != "" {
+		codec, err := broker.CodecFor(p.ContentType)
+		if err != nil {
+			return nil, err
+		}
+		// The message arrives as decoded JSON, which codecs of typed
+		// payloads such as protobuf cannot encode
+		if _, err := codec.Marshal(p.Message); err != nil {
+			return nil, fmt.Errorf("content type %s cannot encode a JSON message: %w", p.ContentType, err)
+		}
+		opts = append(opts, broker.WithContentType(p.ContentType))
+	}
+	if p.Mandatory {
+		opts = append(opts, broker.WithMandatory())
+	}
+
+	switch {
+	case p.DeliverAt != nil && p.Delay != "":
+		return nil, fmt.Errorf("deliver_at and delay cannot be used together")
+	case p.DeliverAt != nil:
+		opts = append(opts, broker.WithDeliverAt(*p.DeliverAt))
+	case p.Delay != "":
+		delay, err := time.ParseDuration(p.Delay)
+		if err != nil || delay < 0 {
+			return nil, fmt.Errorf("invalid delay %q", p.Delay)
+		}
+		opts = append(opts, broker.WithDelay(delay))
+	}
+	return opts, nil
+}
+
+// publishError maps a publish failure to an HTTP status and a message for the caller
+func publishError(routingKey string, err error) (int, string) {
+	switch {
+	case errors.Is(err, broker.ErrUnroutable):
+		return http.StatusNotFound, "No queue is bound to routing key " + routingKey
+	case errors.Is(err, broker.ErrDelayUnsupported):
+		return http.StatusNotImplemented, "Delayed delivery is not supported by the broker backend"
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, "Timed out waiting for broker confirmation"
+	default:
+		return http.StatusInternalServerError, "Failed to publish message"
+	}
+}
@@ -0,0 +1,88 @@
+package example
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Gaoey/scale-websocket/internal/repository/broker"
+	"github.com/Gaoey/scale-websocket/internal/repository/memory"
+	"github.com/labstack/echo/v4"
+)
+
+func TestPublishMessageContentType(t *testing.T) {
+	client, err := memory.NewClient(memory.Config{ExchangeName: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	h := NewExampleHandler(client, nil)
+
+	for _, tc := range []struct {
+		contentType string
+		want        int
+	}{
+		{contentType: "", want: http.StatusOK},
+		{contentType: "application/json", want: http.StatusOK},
+		{contentType: "application/msgpack", want: http.StatusOK},
+		// A JSON body cannot be encoded as protobuf
+		{contentType: "application/protobuf; proto=orders.OrderUpdate", want: http.StatusBadRequest},
+		{contentType: "text/plain", want: http.StatusBadRequest},
+	} {
+		body := `{"routing_key":"ws.order.update.1","message":{"order_id":"1"},"content_type":"` + tc.contentType + `"}`
+		req := httptest.NewRequest(http.MethodPost, "/publish", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+
+		if err := h.PublishMessage(echo.New().NewContext(req, rec)); err != nil {
+			t.Fatalf("%q: %v", tc.contentType, err)
+		}
+		if rec.Code != tc.want {
+			t.Errorf("%q: got status %d, want %d: %s", tc.contentType, rec.Code, tc.want, rec.Body)
+		}
+	}
+}
+
+func TestPublishMessageErrors(t *testing.T) {
+	client, err := memory.NewClient(memory.Config{ExchangeName: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	h := NewExampleHandler(client, nil)
+
+	ctx := context.Background()
+	cons, err := client.StartConsumer(ctx, "orders", []string{"order.*"}, func(broker.Delivery) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cons.Shutdown(ctx)
+
+	for _, tc := range []struct {
+		name string
+		body string
+		want int
+	}{
+		{"mandatory and routed", `{"routing_key":"order.created","message":{},"mandatory":true}`, http.StatusOK},
+		{"mandatory without a queue", `{"routing_key":"trade.created","message":{},"mandatory":true}`, http.StatusNotFound},
+		{"not mandatory without a queue", `{"routing_key":"trade.created","message":{}}`, http.StatusOK},
+		// The memory broker cannot hold messages back
+		{"delay", `{"routing_key":"order.created","message":{},"delay":"5m"}`, http.StatusNotImplemented},
+		{"deliver_at", `{"routing_key":"order.created","message":{},"deliver_at":"2100-01-01T00:00:00Z"}`, http.StatusNotImplemented},
+		{"invalid delay", `{"routing_key":"order.created","message":{},"delay":"soon"}`, http.StatusBadRequest},
+		{"delay and deliver_at", `{"routing_key":"order.created","message":{},"delay":"5m","deliver_at":"2100-01-01T00:00:00Z"}`, http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/publish", strings.NewReader(tc.body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+
+		if err := h.PublishMessage(echo.New().NewContext(req, rec)); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if rec.Code != tc.want {
+			t.Errorf("%s: got status %d, want %d: %s", tc.name, rec.Code, tc.want, rec.Body)
+		}
+	}
+}
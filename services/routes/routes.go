@@ -4,7 +4,8 @@ import (
 	"net/http"
 	"strings"
 
-	"github.com/Gaoey/scale-websocket/services/auth"
+	"github.com/Gaoey/scale-websocket/services/admin"
+	authsvc "github.com/Gaoey/scale-websocket/services/auth"
 	"github.com/Gaoey/scale-websocket/services/example"
 	"github.com/Gaoey/scale-websocket/services/healthcheck"
 	"github.com/Gaoey/scale-websocket/services/store"
@@ -13,19 +14,29 @@ import (
 	"github.com/labstack/echo/v4/middleware"
 )
 
-func SetupRoutes(e *echo.Echo, wsHandler *ws.WebSocketHandler, exampleHandler *example.ExampleHandler, storeHandler *store.StoreHandler) {
+func SetupRoutes(e *echo.Echo, wsHandler *ws.WebSocketHandler, exampleHandler *example.ExampleHandler, storeHandler *store.StoreHandler, adminHandler *admin.AdminHandler) {
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
 
 	e.GET("/health", healthcheck.HealthCheckHandler)
-	e.POST("/login", auth.LoginHandler)
+	e.POST("/login", authsvc.LoginHandler)
 	e.POST("/connections", storeHandler.GetAllConnections)
+	// Where every user is connected is for admins only
+	adminOnly := []echo.MiddlewareFunc{JWTAuth(), RequireRole(authsvc.RoleAdmin)}
+	e.GET("/connections/cluster", storeHandler.GetClusterConnections, adminOnly...)
+	e.GET("/connections/users/:user_id", storeHandler.LocateUser, adminOnly...)
+	e.GET("/connections/evictions", storeHandler.GetEvictions, adminOnly...)
 	e.POST("/publish", exampleHandler.PublishMessage)
+	e.POST("/publish/batch", exampleHandler.PublishBatch)
 	e.GET("/auth-ws", wsHandler.AuthWebSocketHandler)
 
 	auth := e.Group("/api")
 	auth.Use(JWTAuth())
 	// API auth list
+	admin := auth.Group("/admin")
+	admin.Use(RequireRole(authsvc.RoleAdmin))
+	admin.GET("/dead-letters/:queue", adminHandler.ListDeadLetters)
+	admin.POST("/dead-letters/:queue/replay", adminHandler.ReplayDeadLetters)
 }
 
 // JWTAuth middleware for JWT authentication
@@ -44,7 +55,7 @@ func JWTAuth() echo.MiddlewareFunc {
 			tokenString := strings.TrimPrefix(authHeader, "Bearer ")
 
 			// Validate the token
-			claims, err := auth.ValidateToken(tokenString)
+			claims, err := authsvc.ValidateToken(tokenString)
 			if err != nil {
 				return echo.NewHTTPError(http.StatusUnauthorized, "Invalid or expired token")
 			}
@@ -52,9 +63,23 @@ func JWTAuth() echo.MiddlewareFunc {
 			// Set user information in context
 			c.Set("userID", claims.UserID)
 			c.Set("username", claims.Username)
+			c.Set("role", claims.Role)
 
 			// Continue to the next middleware/handler
 			return next(c)
 		}
 	}
 }
+
+// RequireRole middleware rejects requests whose token was not issued for role.
+// It must run after JWTAuth.
+func RequireRole(role string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if r, _ := c.Get("role").(string); r != role {
+				return echo.NewHTTPError(http.StatusForbidden, "Insufficient permissions")
+			}
+			return next(c)
+		}
+	}
+}
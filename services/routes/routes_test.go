@@ -0,0 +1,72 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Gaoey/scale-websocket/internal/stores"
+	"github.com/Gaoey/scale-websocket/services/admin"
+	authsvc "github.com/Gaoey/scale-websocket/services/auth"
+	"github.com/Gaoey/scale-websocket/services/example"
+	"github.com/Gaoey/scale-websocket/services/store"
+	"github.com/Gaoey/scale-websocket/services/ws"
+	"github.com/labstack/echo/v4"
+)
+
+func TestAdminRoutesRequireAdminRole(t *testing.T) {
+	e := echo.New()
+	SetupRoutes(e, &ws.WebSocketHandler{}, &example.ExampleHandler{}, store.NewStoreHandler(stores.NewConnectionStorage(), nil), &admin.AdminHandler{})
+
+	userToken, err := authsvc.GenerateToken("user456", "user", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminToken, err := authsvc.GenerateToken("user123", "admin", authsvc.RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths := []struct {
+		method, path string
+	}{
+		{http.MethodGet, "/connections/cluster"},
+		{http.MethodGet, "/connections/users/user456"},
+		{http.MethodGet, "/connections/evictions"},
+		{http.MethodGet, "/api/admin/dead-letters/orders"},
+		{http.MethodPost, "/api/admin/dead-letters/orders/replay"},
+	}
+	tokens := []struct {
+		name, token string
+		want        int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"invalid token", "nope", http.StatusUnauthorized},
+		{"user token", userToken, http.StatusForbidden},
+	}
+
+	for _, p := range paths {
+		for _, tt := range tokens {
+			req := httptest.NewRequest(p.method, p.path, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("%s %s with %s: got %d, want %d", p.method, p.path, tt.name, rec.Code, tt.want)
+			}
+		}
+	}
+
+	// Admins reach the handlers, which have no registry or reaper here
+	for _, path := range []string{"/connections/cluster", "/connections/users/user456", "/connections/evictions"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != http.StatusNotImplemented {
+			t.Errorf("GET %s as admin: got %d, want %d", path, rec.Code, http.StatusNotImplemented)
+		}
+	}
+}
@@ -8,12 +8,17 @@ import (
 )
 
 type StoreHandler struct {
-	Store *stores.ConnectionStorage
+	Store stores.ConnectionStore
+	// Registry, when set, answers for the connections of the whole cluster
+	Registry *stores.Registry
+	// Reaper, when set, reports the connections it evicted
+	Reaper *stores.Reaper
 }
 
-func NewStoreHandler(store *stores.ConnectionStorage) *StoreHandler {
+func NewStoreHandler(store stores.ConnectionStore, registry *stores.Registry) *StoreHandler {
 	return &StoreHandler{
-		Store: store,
+		Store:    store,
+		Registry: registry,
 	}
 }
 
@@ -21,3 +26,54 @@ func (h *StoreHandler) GetAllConnections(c echo.Context) error {
 	allStores := h.Store.GetAll()
 	return c.JSON(http.StatusOK, allStores)
 }
+
+// GetClusterConnections lists the connections of every node
+func (h *StoreHandler) GetClusterConnections(c echo.Context) error {
+	if h.Registry == nil {
+		return c.JSON(http.StatusNotImplemented, map[string]string{
+			"error": "Connection registry is not configured",
+		})
+	}
+
+	conns, err := h.Registry.List(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to read connection registry",
+		})
+	}
+
+	return c.JSON(http.StatusOK, conns)
+}
+
+// LocateUser tells which nodes a user is connected to
+func (h *StoreHandler) LocateUser(c echo.Context) error {
+	if h.Registry == nil {
+		return c.JSON(http.StatusNotImplemented, map[string]string{
+			"error": "Connection registry is not configured",
+		})
+	}
+
+	conns, err := h.Registry.Locate(c.Request().Context(), c.Param("user_id"))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to read connection registry",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"user_id":     c.Param("user_id"),
+		"online":      len(conns) > 0,
+		"connections": conns,
+	})
+}
+
+// GetEvictions reports how many connections the reaper evicted, by reason
+func (h *StoreHandler) GetEvictions(c echo.Context) error {
+	if h.Reaper == nil {
+		return c.JSON(http.StatusNotImplemented, map[string]string{
+			"error": "Connection reaper is not running",
+		})
+	}
+
+	return c.JSON(http.StatusOK, h.Reaper.Evictions())
+}
@@ -5,10 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"sync"
 
-	"github.com/Gaoey/scale-websocket/internal/repository/rabbitmq"
+	"github.com/Gaoey/scale-websocket/internal/history"
+	"github.com/Gaoey/scale-websocket/internal/repository/broker"
+	"github.com/Gaoey/scale-websocket/internal/schema"
 	"github.com/Gaoey/scale-websocket/internal/stores"
-	"github.com/coder/websocket"
 )
 
 var (
@@ -19,17 +21,40 @@ var (
 	CHANNELS = []string{OrderUpdateChannel}
 )
 
+// Encoding selects how broker payloads are forwarded to WebSocket clients
+type Encoding int
+
+const (
+	// EncodingJSON converts every payload to JSON inside the usual message envelope
+	EncodingJSON Encoding = iota
+	// EncodingNative writes non-JSON payloads to clients as binary frames in
+	// the encoding they were published with. JSON payloads keep the envelope.
+	EncodingNative
+)
+
 type WSChannel struct {
-	Client      *rabbitmq.Client
+	Client      broker.Broker
 	ChannelName string
 	QueueName   string
 	RoutingKeys []string
-	store       *stores.ConnectionStorage
-	ctx         context.Context
-	cancelFunc  context.CancelFunc
+	Options     []broker.ConsumerOption
+	Encoding    Encoding
+	// Schemas, when set, drops messages that do not match the channel schema
+	Schemas *schema.Registry
+	// History, when set, keeps the channel's recent messages for clients
+	// that ask for them on subscribe
+	History history.Log
+	store   stores.ConnectionStore
+	// mu orders appends to the history against subscriptions, so a client
+	// catching up gets every message either replayed or live, never both
+	mu         sync.Mutex
+	replaying  map[string]*pendingFrames
+	consumer   broker.Consumer
+	ctx        context.Context
+	cancelFunc context.CancelFunc
 }
 
-func NewWSChannel(client *rabbitmq.Client, channelName string, queueName string, routingKeys []string, store *stores.ConnectionStorage) *WSChannel {
+func NewWSChannel(client broker.Broker, channelName string, queueName string, routingKeys []string, store stores.ConnectionStore, opts ...broker.ConsumerOption) *WSChannel {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	return &WSChannel{
@@ -37,46 +62,57 @@ func NewWSChannel(client *rabbitmq.Client, channelName string, queueName string,
 		ChannelName: channelName,
 		QueueName:   queueName,
 		RoutingKeys: routingKeys,
+		Options:     opts,
 		store:       store,
+		replaying:   make(map[string]*pendingFrames),
 		ctx:         ctx,
 		cancelFunc:  cancel,
 	}
 }
 
 func (ws *WSChannel) StartConsumer() error {
-	return ws.Client.StartConsumer(ws.ctx, ws.QueueName, ws.RoutingKeys, ws.MessageHandler)
+	consumer, err := ws.Client.StartConsumer(ws.ctx, ws.QueueName, ws.RoutingKeys, ws.MessageHandler, ws.Options...)
+	if err != nil {
+		return err
+	}
+	ws.consumer = consumer
+	return nil
 }
 
-func (ws *WSChannel) MessageHandler(msg rabbitmq.Message) error {
+func (ws *WSChannel) MessageHandler(d broker.Delivery) error {
+	// An invalid message stays invalid, dead-letter it without retrying
+	if ws.Schemas != nil {
+		if err := ws.Schemas.Validate(ws.ChannelName, d.Message); err != nil {
+			log.Printf("Rejecting message %s for channel=%s: %v", d.MessageID, ws.ChannelName, err)
+			return broker.Permanent(err)
+		}
+	}
 
-	// transform message to type Message
-	store, err := ws.store.GetByChannel(ws.ChannelName)
+	// Encode the frame once and write the same bytes to every subscriber
+	frame, live, err := ws.prepare(d)
 	if err != nil {
 		return err
 	}
 
-	if len(store) == 0 {
-		log.Printf("No clients connected to channel=%s", ws.ChannelName)
-		return fmt.Errorf("no clients connected to channel=%s", ws.ChannelName)
+	// Nobody to deliver to is not a failure: retrying cannot help and would
+	// only fill the dead-letter queue, so the message is acked. Channels with
+	// a history still keep it for the clients that subscribe later.
+	if len(live) == 0 {
+		return nil
 	}
 
-	res := NewSuccessMessage(ws.ChannelName, msg)
-	// Handle incoming messages from RabbitMQ
-	data, err := json.Marshal(res)
-	if err != nil {
-		log.Printf("Error marshaling message: %v", err)
-		return fmt.Errorf("cannot marshaling message")
-	}
+	typ, data := messageType(frame), frame.Data
 
 	// Track connections that need to be removed
 	var brokenConnections []string
 
-	for _, c := range store {
-		if err := c.Conn.Write(c.Ctx, websocket.MessageText, data); err != nil {
+	for _, c := range live {
+		if err := c.Conn.Write(c.Ctx, typ, data); err != nil {
 			log.Printf("Failed to send message to client=%s, %v", c.ClientID, err)
 			brokenConnections = append(brokenConnections, c.ConnectionID)
 			continue
 		}
+		c.LastActive.Touch()
 	}
 
 	// Clean up broken connections
@@ -94,6 +130,82 @@ func (ws *WSChannel) MessageHandler(msg rabbitmq.Message) error {
 	return nil
 }
 
+// prepare builds the frame sent to subscribers for a delivery and returns
+// the connections to write it to now. Channels with a history number the
+// frame and record it under ws.mu, holding it back for the connections still
+// catching up; the others take no lock.
+func (ws *WSChannel) prepare(d broker.Delivery) (history.Entry, []stores.ConnectionData, error) {
+	if ws.History == nil {
+		frame, err := ws.encode(d, 0)
+		if err != nil {
+			log.Printf("Error marshaling message: %v", err)
+			return history.Entry{}, nil, fmt.Errorf("cannot marshaling message")
+		}
+		conns, err := ws.store.GetByChannel(ws.ChannelName)
+		return frame, conns, err
+	}
+
+	// Only the envelope carrying the offset is left to encode under the lock
+	if ws.Encoding != EncodingNative || broker.IsJSON(d.ContentType) {
+		payload, err := broker.ToJSON(d.Message)
+		if err != nil {
+			log.Printf("Error marshaling message: %v", err)
+			return history.Entry{}, nil, fmt.Errorf("cannot marshaling message")
+		}
+		d.Message = payload
+	}
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	frame, err := ws.History.Append(func(offset uint64) (history.Entry, error) {
+		return ws.encode(d, offset)
+	})
+	if err != nil {
+		log.Printf("Error marshaling message: %v", err)
+		return history.Entry{}, nil, fmt.Errorf("cannot marshaling message")
+	}
+
+	store, err := ws.store.GetByChannel(ws.ChannelName)
+	if err != nil {
+		return history.Entry{}, nil, err
+	}
+
+	// Clients still catching up get the frame after their replay. The slice
+	// is ours, so it is filtered in place.
+	live := store[:0]
+	for _, c := range store {
+		if pending, ok := ws.replaying[c.ConnectionID]; ok {
+			pending.frames = append(pending.frames, frame)
+			continue
+		}
+		live = append(live, c)
+	}
+	return frame, live, nil
+}
+
+// encode builds the frame of a delivery, numbered with offset when non-zero
+func (ws *WSChannel) encode(d broker.Delivery, offset uint64) (history.Entry, error) {
+	if ws.Encoding == EncodingNative && !broker.IsJSON(d.ContentType) {
+		return history.Entry{Binary: true, Data: d.Body}, nil
+	}
+
+	// Raw JSON payloads are embedded as they came off the broker
+	payload, err := broker.ToJSON(d.Message)
+	if err != nil {
+		return history.Entry{}, err
+	}
+	d.Message = payload
+
+	msg := NewBrokerMessage(ws.ChannelName, d)
+	msg.Offset = offset
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return history.Entry{}, err
+	}
+	return history.Entry{Data: data}, nil
+}
+
 func ValidateChannel(msg Message) error {
 	if msg.Channel == "" {
 		return fmt.Errorf("channel name is required")
@@ -108,8 +220,15 @@ func ValidateChannel(msg Message) error {
 	return fmt.Errorf("invalid channel name: %s", msg.Channel)
 }
 
-func (c *WSChannel) Stop() {
+// Stop drains the consumer, letting in-flight messages finish until ctx
+// expires, and returns once it has fully stopped
+func (c *WSChannel) Stop(ctx context.Context) error {
+	var err error
+	if c.consumer != nil {
+		err = c.consumer.Shutdown(ctx)
+	}
 	if c.cancelFunc != nil {
 		c.cancelFunc()
 	}
+	return err
 }
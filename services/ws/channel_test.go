@@ -0,0 +1,406 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Gaoey/scale-websocket/internal/history"
+	"github.com/Gaoey/scale-websocket/internal/repository/broker"
+	"github.com/Gaoey/scale-websocket/internal/repository/memory"
+	"github.com/Gaoey/scale-websocket/internal/schema"
+	"github.com/Gaoey/scale-websocket/internal/stores"
+	"github.com/Gaoey/scale-websocket/services/auth"
+	"github.com/coder/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+// testServer is a WebSocket server fed by an order_update channel consuming
+// from the in-memory broker
+type testServer struct {
+	broker  *memory.Client
+	channel *WSChannel
+	store   *stores.ConnectionStorage
+	url     string
+}
+
+func newTestServer(t *testing.T, ring history.Log) *testServer {
+	t.Helper()
+
+	client, err := memory.NewClient(memory.Config{ExchangeName: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	store := stores.NewConnectionStorage()
+	channel := NewWSChannel(client, OrderUpdateChannel, "ws.test", []string{"order.#"}, store)
+	channel.History = ring
+	if err := channel.StartConsumer(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		channel.Stop(ctx)
+	})
+
+	handler := NewWebSocketHandler(store)
+	handler.RegisterChannel(channel)
+	e := echo.New()
+	e.GET("/auth-ws", handler.AuthWebSocketHandler)
+	srv := httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+
+	return &testServer{broker: client, channel: channel, store: store, url: srv.URL + "/auth-ws"}
+}
+
+// testClient is a WebSocket connection whose messages are read in the
+// background, since a read that times out closes the connection
+type testClient struct {
+	conn *websocket.Conn
+	msgs chan Message
+}
+
+// dial connects as userID and reads the welcome message
+func (s *testServer) dial(t *testing.T, userID string) *testClient {
+	t.Helper()
+
+	token, err := auth.GenerateToken(userID, userID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, s.url+"?token="+token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close(websocket.StatusNormalClosure, "") })
+
+	c := &testClient{conn: conn, msgs: make(chan Message, 1000)}
+	go func() {
+		defer close(c.msgs)
+		for {
+			_, data, err := conn.Read(context.Background())
+			if err != nil {
+				return
+			}
+			var msg Message
+			if err := json.Unmarshal(data, &msg); err != nil {
+				t.Errorf("invalid frame %s", data)
+				return
+			}
+			c.msgs <- msg
+		}
+	}()
+
+	if msg := c.read(t); msg.Event != "auth" {
+		t.Fatalf("expected the welcome message, got %+v", msg)
+	}
+	return c
+}
+
+func (s *testServer) publish(t *testing.T, routingKey string, msg broker.Message) {
+	t.Helper()
+	if err := s.broker.Publish(context.Background(), routingKey, msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *testClient) send(t *testing.T, msg Message) {
+	t.Helper()
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.conn.Write(context.Background(), websocket.MessageText, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *testClient) read(t *testing.T) Message {
+	t.Helper()
+	select {
+	case msg, ok := <-c.msgs:
+		if !ok {
+			t.Fatal("connection closed")
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+	return Message{}
+}
+
+// expectNothing fails if a message arrives within a short while
+func (c *testClient) expectNothing(t *testing.T) {
+	t.Helper()
+	select {
+	case msg := <-c.msgs:
+		t.Fatalf("unexpected message %+v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// subscribe subscribes the client and returns the acknowledgement
+func (c *testClient) subscribe(t *testing.T, channel string, data interface{}) Message {
+	t.Helper()
+	c.send(t, Message{Event: SubscribeEvent, Channel: channel, Data: data})
+	ack := c.read(t)
+	if ack.Event != SubscribeEvent || ack.Status != "1001" {
+		t.Fatalf("subscribe to %s failed: %+v", channel, ack)
+	}
+	return ack
+}
+
+// waitSubscribers waits until the store has n subscribers on channel
+func (s *testServer) waitSubscribers(t *testing.T, channel string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if conns, _ := s.store.GetByChannel(channel); len(conns) == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("channel %s never had %d subscribers", channel, n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestFanOutOverMemoryBroker(t *testing.T) {
+	s := newTestServer(t, nil)
+	alice := s.dial(t, "alice")
+	alice2 := s.dial(t, "alice")
+	bob := s.dial(t, "bob")
+
+	alice.subscribe(t, OrderUpdateChannel, nil)
+	alice2.subscribe(t, OrderUpdateChannel, nil)
+
+	s.publish(t, "order.created.eu", map[string]interface{}{"order_id": "o1"})
+
+	// Every subscribed connection gets the message, the others none
+	for _, c := range []*testClient{alice, alice2} {
+		msg := c.read(t)
+		if msg.Event != OrderUpdateChannel || msg.MessageID == "" || msg.PublishedAt == 0 {
+			t.Fatalf("unexpected frame %+v", msg)
+		}
+		if data, _ := msg.Data.(map[string]interface{}); data["order_id"] != "o1" {
+			t.Fatalf("unexpected payload %+v", msg.Data)
+		}
+		if msg.Offset != 0 {
+			t.Fatalf("frame of a channel without history has offset %d", msg.Offset)
+		}
+	}
+	bob.expectNothing(t)
+
+	// Not bound to the consumer's routing keys
+	s.publish(t, "payment.created", map[string]interface{}{"order_id": "o2"})
+	alice.expectNothing(t)
+
+	// A message nobody is subscribed to is acked, not dead-lettered
+	alice.send(t, Message{Event: UnsubscribeEvent, Channel: OrderUpdateChannel})
+	alice.read(t)
+	alice2.send(t, Message{Event: UnsubscribeEvent, Channel: OrderUpdateChannel})
+	alice2.read(t)
+	s.publish(t, "order.created", map[string]interface{}{"order_id": "o3"})
+	alice.expectNothing(t)
+	if letters, _ := s.broker.DeadLetters(context.Background(), "ws.test", 10); len(letters) != 0 {
+		t.Fatalf("unexpected dead letters %+v", letters)
+	}
+
+	// Closed connections are removed from the channel
+	bob.subscribe(t, OrderUpdateChannel, nil)
+	bob.conn.Close(websocket.StatusNormalClosure, "")
+	s.waitSubscribers(t, OrderUpdateChannel, 0)
+}
+
+func TestSubscriptionSet(t *testing.T) {
+	defer func(channels []string) { CHANNELS = channels }(CHANNELS)
+	CHANNELS = append([]string{"trades"}, CHANNELS...)
+
+	s := newTestServer(t, nil)
+	conn := s.dial(t, "alice")
+
+	subscriptions := func(msg Message) []interface{} {
+		t.Helper()
+		data, _ := msg.Data.(map[string]interface{})
+		subs, ok := data["subscriptions"].([]interface{})
+		if !ok {
+			t.Fatalf("no subscriptions in %+v", msg)
+		}
+		return subs
+	}
+
+	conn.send(t, Message{Event: SubscriptionsEvent})
+	if got := subscriptions(conn.read(t)); len(got) != 0 {
+		t.Fatalf("new connection subscribed to %v", got)
+	}
+
+	conn.subscribe(t, OrderUpdateChannel, nil)
+	ack := conn.subscribe(t, "trades", nil)
+	if got := subscriptions(ack); len(got) != 2 || got[0] != OrderUpdateChannel || got[1] != "trades" {
+		t.Fatalf("subscriptions %v", got)
+	}
+	// Subscribing again changes nothing
+	if got := subscriptions(conn.subscribe(t, "trades", nil)); len(got) != 2 {
+		t.Fatalf("subscriptions %v after subscribing twice", got)
+	}
+
+	conn.send(t, Message{Event: SubscribeEvent, Channel: "unknown"})
+	if msg := conn.read(t); msg.Status != "1002" {
+		t.Fatalf("subscribed to an unknown channel: %+v", msg)
+	}
+
+	conn.send(t, Message{Event: UnsubscribeEvent, Channel: "trades"})
+	if got := subscriptions(conn.read(t)); len(got) != 1 || got[0] != OrderUpdateChannel {
+		t.Fatalf("subscriptions %v after unsubscribing", got)
+	}
+	conn.send(t, Message{Event: UnsubscribeEvent, Channel: "trades"})
+	if msg := conn.read(t); msg.Status != "1002" {
+		t.Fatalf("unsubscribed twice: %+v", msg)
+	}
+
+	// Still receiving the channel it stayed subscribed to
+	s.publish(t, "order.created", map[string]interface{}{"order_id": "o1"})
+	if msg := conn.read(t); msg.Event != OrderUpdateChannel {
+		t.Fatalf("unexpected frame %+v", msg)
+	}
+}
+
+func TestHistoryReplay(t *testing.T) {
+	ring := history.NewRing(3)
+	s := newTestServer(t, ring)
+
+	// Kept by the history while nobody is subscribed
+	watcher := s.dial(t, "watcher")
+	watcher.subscribe(t, OrderUpdateChannel, nil)
+	for i := 1; i <= 4; i++ {
+		s.publish(t, "order.created", map[string]interface{}{"seq": i})
+		if msg := watcher.read(t); msg.Offset != uint64(i) {
+			t.Fatalf("frame %d has offset %d", i, msg.Offset)
+		}
+	}
+
+	conn := s.dial(t, "alice")
+	ack := conn.subscribe(t, OrderUpdateChannel, map[string]interface{}{"last": 2})
+	hist, _ := ack.Data.(map[string]interface{})["history"].(map[string]interface{})
+	if hist["epoch"] != ring.Epoch() || hist["replayed"] != float64(2) || hist["complete"] != true {
+		t.Fatalf("unexpected history %+v", ack.Data)
+	}
+	for _, want := range []uint64{3, 4} {
+		if msg := conn.read(t); msg.Offset != want {
+			t.Fatalf("replayed offset %d, want %d", msg.Offset, want)
+		}
+	}
+
+	// Since an offset that is no longer kept replays what is left
+	late := s.dial(t, "bob")
+	ack = late.subscribe(t, OrderUpdateChannel, map[string]interface{}{"since": 0, "epoch": ring.Epoch()})
+	if hist := ack.Data.(map[string]interface{})["history"].(map[string]interface{}); hist["complete"] != false || hist["replayed"] != float64(3) {
+		t.Fatalf("unexpected history %+v", ack.Data)
+	}
+	for _, want := range []uint64{2, 3, 4} {
+		if msg := late.read(t); msg.Offset != want {
+			t.Fatalf("replayed offset %d, want %d", msg.Offset, want)
+		}
+	}
+
+	// Offsets of another epoch mean nothing here
+	other := s.dial(t, "carol")
+	ack = other.subscribe(t, OrderUpdateChannel, map[string]interface{}{"since": 3, "epoch": "previous"})
+	if hist := ack.Data.(map[string]interface{})["history"].(map[string]interface{}); hist["complete"] != false || hist["replayed"] != float64(3) {
+		t.Fatalf("unexpected history %+v", ack.Data)
+	}
+}
+
+// TestHistorySwitchOver subscribes with since:0 while messages are being
+// published. The client must get every message exactly once and in order,
+// first from the history and then live.
+func TestHistorySwitchOver(t *testing.T) {
+	const messages = 1000
+	s := newTestServer(t, history.NewRing(messages))
+	conn := s.dial(t, "alice")
+
+	published := make(chan struct{})
+	halfway := make(chan struct{})
+	go func() {
+		defer close(published)
+		for i := 1; i <= messages; i++ {
+			if err := s.broker.Publish(context.Background(), "order.created", map[string]interface{}{"seq": i}); err != nil {
+				t.Error(err)
+				return
+			}
+			if i == messages/2 {
+				close(halfway)
+			}
+			// Keep publishing while the history is being replayed
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+
+	<-halfway
+	conn.subscribe(t, OrderUpdateChannel, map[string]interface{}{"since": 0})
+
+	var offsets []uint64
+	for len(offsets) < messages {
+		msg := conn.read(t)
+		if msg.Event != OrderUpdateChannel {
+			t.Fatalf("unexpected message %+v", msg)
+		}
+		offsets = append(offsets, msg.Offset)
+	}
+	<-published
+
+	for i, offset := range offsets {
+		if offset != uint64(i+1) {
+			t.Fatalf("message %d has offset %d: %v", i+1, offset, offsets)
+		}
+	}
+	conn.expectNothing(t)
+}
+
+func TestChannelWithoutHistoryTakesNoLock(t *testing.T) {
+	channel := NewWSChannel(nil, OrderUpdateChannel, "ws.test", nil, stores.NewConnectionStorage())
+
+	// Held elsewhere, a channel without history never waits for it
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- channel.MessageHandler(broker.Delivery{Message: map[string]interface{}{"order_id": "o1"}})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("channel without history waited for the history lock")
+	}
+}
+
+func TestChannelRejectsInvalidMessagesPermanently(t *testing.T) {
+	schemas := schema.NewRegistry()
+	err := schemas.Register(OrderUpdateChannel, nil, []byte(`{"type": "object", "required": ["order_id"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	channel := NewWSChannel(nil, OrderUpdateChannel, "ws.test", nil, stores.NewConnectionStorage())
+	channel.Schemas = schemas
+
+	if err := channel.MessageHandler(broker.Delivery{Message: map[string]interface{}{"order_id": "o1"}}); err != nil {
+		t.Fatalf("valid message: %v", err)
+	}
+
+	// Dead-lettered straight away, retrying cannot make it valid
+	err = channel.MessageHandler(broker.Delivery{Message: map[string]interface{}{"status": "filled"}})
+	if !errors.Is(err, broker.ErrPermanent) || !errors.Is(err, schema.ErrInvalid) {
+		t.Fatalf("invalid message: %v, want a permanent validation error", err)
+	}
+}
@@ -15,16 +15,38 @@ import (
 // ContextKey is a custom type for context keys to avoid collisions
 type ContextKey string
 
+// DefaultPingInterval is how often connections are pinged unless
+// SetPingInterval says otherwise
+const DefaultPingInterval = 30 * time.Second
+
 type WebSocketHandler struct {
-	store *stores.ConnectionStorage
+	store        stores.ConnectionStore
+	channels     map[string]*WSChannel
+	pingInterval time.Duration
 }
 
-func NewWebSocketHandler(store *stores.ConnectionStorage) *WebSocketHandler {
+func NewWebSocketHandler(store stores.ConnectionStore) *WebSocketHandler {
 	return &WebSocketHandler{
-		store: store,
+		store:        store,
+		channels:     make(map[string]*WSChannel),
+		pingInterval: DefaultPingInterval,
 	}
 }
 
+// SetPingInterval sets how often connections are pinged, 0 disables the
+// pings. Keep it well below the idle timeout: a pong is what keeps a client
+// that only listens from being reaped. Call it before the server starts
+// accepting connections.
+func (h *WebSocketHandler) SetPingInterval(d time.Duration) {
+	h.pingInterval = d
+}
+
+// RegisterChannel lets clients subscribing to ch ask for its history. Call it
+// before the server starts accepting connections.
+func (h *WebSocketHandler) RegisterChannel(ch *WSChannel) {
+	h.channels[ch.ChannelName] = ch
+}
+
 func (h WebSocketHandler) AuthWebSocketHandler(c echo.Context) error {
 	token := c.QueryParam("token")
 	if token == "" {
@@ -54,11 +76,15 @@ func (h WebSocketHandler) AuthWebSocketHandler(c echo.Context) error {
 	log.Printf("WebSocket connection established for user: %s", claims.Username)
 	defer conn.Close(websocket.StatusNormalClosure, "Connection closed")
 
-	// Set read timeout and message size limit
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Hour)
+	// The connection lives until either side closes it, the reaper enforces
+	// the idle timeout and max lifetime. Cancelled once the handler returns,
+	// which tells the reaper an entry left behind is stale.
+	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	ws := NewAuthWebSocket(ctx, conn, claims, h.store)
+	ws.Channels = h.channels
+	go ws.KeepAlive(ctx, h.pingInterval)
 
 	// Send welcome message
 	log.Printf("Sending welcome message to user: %s", claims.Username)
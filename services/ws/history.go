@@ -0,0 +1,114 @@
+package ws
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/Gaoey/scale-websocket/internal/history"
+	"github.com/coder/websocket"
+)
+
+// HistoryRequest is the data of a subscribe event asking for past messages
+// of the channel, e.g. {"event":"subscribe","channel":"order_update","data":{"last":20}}.
+// Since takes the offset of the last message the client received, together
+// with the epoch it was received in.
+type HistoryRequest struct {
+	Last  int     `json:"last,omitempty"`
+	Since *uint64 `json:"since,omitempty"`
+	Epoch string  `json:"epoch,omitempty"`
+}
+
+// Replay is the history sent to a client that just subscribed
+type Replay struct {
+	Entries []history.Entry
+	Epoch   string
+	// Complete is false when the client asked for messages since an offset
+	// that are no longer kept, or of another epoch
+	Complete bool
+
+	connID string
+}
+
+// pendingFrames collects the live messages of a client still being replayed to
+type pendingFrames struct {
+	frames []history.Entry
+}
+
+// Subscribe adds a connection to the channel and takes the history it asked
+// for. Live messages that arrive from then on are held back until Flush has
+// written the replay, so the client sees them in order with no gap or
+// duplicate in between.
+func (ws *WSChannel) Subscribe(userID, connID string, req HistoryRequest) (*Replay, error) {
+	if ws.History == nil {
+		if req.Last > 0 || req.Since != nil {
+			return nil, fmt.Errorf("channel %s keeps no history", ws.ChannelName)
+		}
+		ws.store.AddChannel(userID, connID, ws.ChannelName)
+		return &Replay{Complete: true}, nil
+	}
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	replay := &Replay{
+		Epoch:    ws.History.Epoch(),
+		Complete: true,
+		connID:   connID,
+	}
+	switch {
+	case req.Since != nil && req.Epoch != "" && req.Epoch != replay.Epoch:
+		replay.Entries, _ = ws.History.Since(0)
+		replay.Complete = false
+	case req.Since != nil:
+		replay.Entries, replay.Complete = ws.History.Since(*req.Since)
+	case req.Last > 0:
+		replay.Entries = ws.History.Last(req.Last)
+	}
+
+	ws.store.AddChannel(userID, connID, ws.ChannelName)
+	ws.replaying[connID] = &pendingFrames{}
+	return replay, nil
+}
+
+// Flush writes the replay and then the live messages held back meanwhile,
+// after which the connection receives live messages directly
+func (ws *WSChannel) Flush(ctx context.Context, conn *websocket.Conn, replay *Replay) error {
+	if replay.connID == "" {
+		return nil
+	}
+
+	frames := replay.Entries
+	for {
+		for _, frame := range frames {
+			if err := conn.Write(ctx, messageType(frame), frame.Data); err != nil {
+				ws.stopReplay(replay.connID)
+				return fmt.Errorf("failed to replay history: %w", err)
+			}
+		}
+
+		ws.mu.Lock()
+		pending := ws.replaying[replay.connID]
+		if pending == nil || len(pending.frames) == 0 {
+			delete(ws.replaying, replay.connID)
+			ws.mu.Unlock()
+			log.Printf("Connection %s caught up on channel=%s", replay.connID, ws.ChannelName)
+			return nil
+		}
+		frames, pending.frames = pending.frames, nil
+		ws.mu.Unlock()
+	}
+}
+
+func (ws *WSChannel) stopReplay(connID string) {
+	ws.mu.Lock()
+	delete(ws.replaying, connID)
+	ws.mu.Unlock()
+}
+
+func messageType(e history.Entry) websocket.MessageType {
+	if e.Binary {
+		return websocket.MessageBinary
+	}
+	return websocket.MessageText
+}
@@ -1,11 +1,18 @@
 package ws
 
+import "github.com/Gaoey/scale-websocket/internal/repository/broker"
+
 // Message represents a WebSocket message
 type Message struct {
-	Event   string      `json:"event"`
-	Status  string      `json:"status,omitempty"`
-	Data    interface{} `json:"data"`
-	Channel string      `json:"channel,omitempty"`
+	Event     string      `json:"event"`
+	Status    string      `json:"status,omitempty"`
+	Data      interface{} `json:"data"`
+	Channel   string      `json:"channel,omitempty"`
+	MessageID string      `json:"message_id,omitempty"`
+	// PublishedAt is when the broker message was published, in unix milliseconds
+	PublishedAt int64 `json:"published_at,omitempty"`
+	// Offset numbers the messages of a channel with history, see HistoryRequest
+	Offset uint64 `json:"offset,omitempty"`
 }
 
 func NewSuccessMessage(event string, data interface{}) Message {
@@ -16,6 +23,16 @@ func NewSuccessMessage(event string, data interface{}) Message {
 	}
 }
 
+// NewBrokerMessage wraps a broker delivery for the subscribers of a channel
+func NewBrokerMessage(channel string, d broker.Delivery) Message {
+	msg := NewSuccessMessage(channel, d.Message)
+	msg.MessageID = d.MessageID
+	if !d.Timestamp.IsZero() {
+		msg.PublishedAt = d.Timestamp.UnixMilli()
+	}
+	return msg
+}
+
 func NewErrorMessage(event string, status string, errorMsg string) Message {
 	return Message{
 		Event:  event,
@@ -0,0 +1,72 @@
+package ws
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Gaoey/scale-websocket/internal/repository/broker"
+	"github.com/Gaoey/scale-websocket/internal/stores"
+)
+
+var (
+	PresenceRoutingKey = "ws.rpc.presence"
+)
+
+// presenceTimeout bounds the registry lookup of a presence request
+const presenceTimeout = 5 * time.Second
+
+// PresenceRequest asks whether a user has an open WebSocket connection
+type PresenceRequest struct {
+	UserID string `json:"user_id"`
+}
+
+// PresenceResponse is the answer to a PresenceRequest
+type PresenceResponse struct {
+	UserID      string `json:"user_id"`
+	Online      bool   `json:"online"`
+	Connections int    `json:"connections"`
+	// Nodes are the servers holding the user's connections
+	Nodes []string `json:"nodes,omitempty"`
+}
+
+// PresenceHandler answers presence requests sent with broker RPC from the
+// cluster-wide registry. Requests are served by whichever node takes them
+// from the shared queue, so answering from the node's own connections would
+// report users connected elsewhere as offline.
+func PresenceHandler(registry *stores.Registry) broker.RPCHandler {
+	return func(req broker.Delivery) (broker.Message, error) {
+		obj, ok := req.Message.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid presence request")
+		}
+		userID, _ := obj["user_id"].(string)
+		if userID == "" {
+			return nil, fmt.Errorf("user_id is required")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), presenceTimeout)
+		defer cancel()
+
+		conns, err := registry.Locate(ctx, userID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to locate user %s: %w", userID, err)
+		}
+
+		nodes := make(map[string]struct{})
+		for _, c := range conns {
+			nodes[c.NodeID] = struct{}{}
+		}
+		resp := PresenceResponse{
+			UserID:      userID,
+			Online:      len(conns) > 0,
+			Connections: len(conns),
+		}
+		for node := range nodes {
+			resp.Nodes = append(resp.Nodes, node)
+		}
+		sort.Strings(resp.Nodes)
+		return resp, nil
+	}
+}
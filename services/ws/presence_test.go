@@ -0,0 +1,75 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Gaoey/scale-websocket/internal/repository/broker"
+	"github.com/Gaoey/scale-websocket/internal/repository/memory"
+	"github.com/Gaoey/scale-websocket/internal/stores"
+)
+
+func TestPresenceAnswersFromRegistry(t *testing.T) {
+	client, err := memory.NewClient(memory.Config{ExchangeName: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	kv := stores.NewMemoryKV()
+	local, err := stores.NewRegistry(kv, "node-a", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	remote, err := stores.NewRegistry(kv, "node-b", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The user is only connected to the other node
+	if err := remote.Register(ctx, stores.ConnectionInfo{UserID: "u1", ConnectionID: "c1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := client.Serve(PresenceRoutingKey, PresenceHandler(local))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Shutdown(ctx)
+
+	reply, err := client.Call(ctx, PresenceRoutingKey, PresenceRequest{UserID: "u1"})
+	if err != nil {
+		t.Fatalf("call: %v", err)
+	}
+	resp, ok := reply.(map[string]interface{})
+	if !ok {
+		t.Fatalf("unexpected reply %T", reply)
+	}
+	if resp["online"] != true || resp["connections"] != float64(1) {
+		t.Fatalf("unexpected presence %v", resp)
+	}
+	if nodes, _ := resp["nodes"].([]interface{}); len(nodes) != 1 || nodes[0] != "node-b" {
+		t.Fatalf("unexpected nodes %v", resp["nodes"])
+	}
+
+	reply, err = client.Call(ctx, PresenceRoutingKey, PresenceRequest{UserID: "u2"})
+	if err != nil {
+		t.Fatalf("call: %v", err)
+	}
+	if resp := reply.(map[string]interface{}); resp["online"] != false {
+		t.Fatalf("unexpected presence %v", resp)
+	}
+
+	_, err = client.Call(ctx, PresenceRoutingKey, PresenceRequest{})
+	var rpcErr *broker.RPCError
+	if !errors.As(err, &rpcErr) {
+		t.Fatalf("expected an RPC error, got %v", err)
+	}
+}
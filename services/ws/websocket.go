@@ -11,30 +11,42 @@ import (
 	"github.com/coder/websocket"
 )
 
-// TODO: TTL remove connection
-
 var (
-	PingEvent      = "ping"
-	AuthEvent      = "auth"
-	SubscribeEvent = "subscribe"
+	PingEvent          = "ping"
+	AuthEvent          = "auth"
+	SubscribeEvent     = "subscribe"
+	UnsubscribeEvent   = "unsubscribe"
+	SubscriptionsEvent = "subscriptions"
 )
 
 type AuthWebSocket struct {
 	ConnectionID string
 	Conn         *websocket.Conn
 	Claims       *auth.Claims
-	Store        *stores.ConnectionStorage
+	Store        stores.ConnectionStore
+	// Channels are the consumed channels by name, used to replay their
+	// history on subscribe
+	Channels map[string]*WSChannel
+	// Activity is touched on every read and write so the reaper can tell
+	// idle connections apart
+	Activity *stores.Activity
 }
 
-func NewAuthWebSocket(ctx context.Context, conn *websocket.Conn, claims *auth.Claims, store *stores.ConnectionStorage) *AuthWebSocket {
+func NewAuthWebSocket(ctx context.Context, conn *websocket.Conn, claims *auth.Claims, store stores.ConnectionStore) *AuthWebSocket {
 	connId := stores.GenerateConnectionID()
 	store.Add(ctx, claims.UserID, connId, conn, true)
 
+	var activity *stores.Activity
+	if data, ok := store.GetByConnID(claims.UserID, connId); ok {
+		activity = data.LastActive
+	}
+
 	return &AuthWebSocket{
 		ConnectionID: connId,
 		Conn:         conn,
 		Claims:       claims,
 		Store:        store,
+		Activity:     activity,
 	}
 }
 
@@ -50,6 +62,7 @@ func (ws AuthWebSocket) AuthEventHandler(ctx context.Context) {
 			}
 			break
 		}
+		ws.Activity.Touch()
 
 		// Only process text messages
 		if msgType != websocket.MessageText {
@@ -77,11 +90,33 @@ func (ws AuthWebSocket) AuthEventHandler(ctx context.Context) {
 				ws.SendMessage(ctx, response)
 				continue
 			}
-			ws.Store.AddChannel(ws.Claims.UserID, ws.ConnectionID, msg.Channel)
-			response := NewSuccessMessage("subscribe", map[string]interface{}{
+			ws.subscribe(ctx, msg)
+
+		case UnsubscribeEvent:
+			if err := ValidateChannel(msg); err != nil {
+				response := NewErrorMessage("unsubscribe", "1002", err.Error())
+				ws.SendMessage(ctx, response)
+				continue
+			}
+			subscriptions, ok := ws.Store.RemoveChannel(ws.Claims.UserID, ws.ConnectionID, msg.Channel)
+			if !ok {
+				response := NewErrorMessage("unsubscribe", "1002", "Not subscribed to channel: "+msg.Channel)
+				ws.SendMessage(ctx, response)
+				continue
+			}
+			response := NewSuccessMessage("unsubscribe", map[string]interface{}{
 				"connection_id": ws.ConnectionID,
-				"message":       "Subscribed to channel successfully",
+				"message":       "Unsubscribed from channel successfully",
 				"channel":       msg.Channel,
+				"subscriptions": nonNil(subscriptions),
+				"timestamp":     time.Now().Unix(),
+			})
+			ws.SendMessage(ctx, response)
+
+		case SubscriptionsEvent:
+			response := NewSuccessMessage("subscriptions", map[string]interface{}{
+				"connection_id": ws.ConnectionID,
+				"subscriptions": nonNil(ws.Store.Subscriptions(ws.Claims.UserID, ws.ConnectionID)),
 				"timestamp":     time.Now().Unix(),
 			})
 			ws.SendMessage(ctx, response)
@@ -94,6 +129,80 @@ func (ws AuthWebSocket) AuthEventHandler(ctx context.Context) {
 	}
 }
 
+// subscribe adds the connection to a channel, then sends the history it
+// asked for ahead of the channel's live messages
+func (ws AuthWebSocket) subscribe(ctx context.Context, msg Message) {
+	var req HistoryRequest
+	if msg.Data != nil {
+		data, _ := json.Marshal(msg.Data)
+		if err := json.Unmarshal(data, &req); err != nil {
+			ws.SendMessage(ctx, NewErrorMessage("subscribe", "1002", "Invalid history request"))
+			return
+		}
+	}
+
+	ack := map[string]interface{}{
+		"connection_id": ws.ConnectionID,
+		"message":       "Subscribed to channel successfully",
+		"channel":       msg.Channel,
+		"timestamp":     time.Now().Unix(),
+	}
+
+	channel, ok := ws.Channels[msg.Channel]
+	if !ok {
+		ack["subscriptions"] = nonNil(ws.Store.AddChannel(ws.Claims.UserID, ws.ConnectionID, msg.Channel))
+		ws.SendMessage(ctx, NewSuccessMessage("subscribe", ack))
+		return
+	}
+
+	replay, err := channel.Subscribe(ws.Claims.UserID, ws.ConnectionID, req)
+	if err != nil {
+		ws.SendMessage(ctx, NewErrorMessage("subscribe", "1002", err.Error()))
+		return
+	}
+	ack["subscriptions"] = nonNil(ws.Store.Subscriptions(ws.Claims.UserID, ws.ConnectionID))
+	if replay.Epoch != "" {
+		ack["history"] = map[string]interface{}{
+			"epoch":    replay.Epoch,
+			"replayed": len(replay.Entries),
+			"complete": replay.Complete,
+		}
+	}
+	ws.SendMessage(ctx, NewSuccessMessage("subscribe", ack))
+
+	if err := channel.Flush(ctx, ws.Conn, replay); err != nil {
+		log.Printf("Connection %s: %v", ws.ConnectionID, err)
+	}
+}
+
+// KeepAlive pings the client every interval until ctx is done, touching the
+// connection's activity on every pong. A client that misses a pong is left
+// to the idle timeout.
+func (ws AuthWebSocket) KeepAlive(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		pingCtx, cancel := context.WithTimeout(ctx, interval)
+		err := ws.Conn.Ping(pingCtx)
+		cancel()
+		if err == nil {
+			ws.Activity.Touch()
+		} else if ctx.Err() == nil {
+			log.Printf("Connection %s: %v", ws.ConnectionID, err)
+		}
+	}
+}
+
 func (ws AuthWebSocket) SendMessage(ctx context.Context, msg Message) error {
 	result, err := json.Marshal(msg)
 	if err != nil {
@@ -103,10 +212,20 @@ func (ws AuthWebSocket) SendMessage(ctx context.Context, msg Message) error {
 
 	if err := ws.Conn.Write(ctx, websocket.MessageText, result); err != nil {
 		log.Printf("Error sending message: %v", err)
+		return nil
 	}
+	ws.Activity.Touch()
 	return nil
 }
 
+// nonNil makes an empty subscription list encode as [] rather than null
+func nonNil(channels []string) []string {
+	if channels == nil {
+		return []string{}
+	}
+	return channels
+}
+
 func ValidateMessage(ctx context.Context, data []byte) (Message, error) {
 	var msg Message
 	if err := json.Unmarshal(data, &msg); err != nil {
@@ -0,0 +1,47 @@
+package ws
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Gaoey/scale-websocket/internal/stores"
+	"github.com/labstack/echo/v4"
+)
+
+func TestPongsKeepQuietClientsConnected(t *testing.T) {
+	tests := []struct {
+		name         string
+		pingInterval time.Duration
+		reaped       bool
+	}{
+		{"pinged", 20 * time.Millisecond, false},
+		{"not pinged", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := stores.NewConnectionStorage()
+			reaper := stores.NewReaper(store, stores.ReaperConfig{IdleTimeout: 100 * time.Millisecond, Interval: 10 * time.Millisecond})
+			reaper.Start()
+			defer reaper.Stop()
+
+			handler := NewWebSocketHandler(store)
+			handler.SetPingInterval(tt.pingInterval)
+			e := echo.New()
+			e.GET("/auth-ws", handler.AuthWebSocketHandler)
+			srv := httptest.NewServer(e)
+			defer srv.Close()
+
+			// Only reads, which answers the pings, and never sends anything
+			c := (&testServer{url: srv.URL + "/auth-ws"}).dial(t, "u1")
+			time.Sleep(500 * time.Millisecond)
+
+			if reaped := !store.IsExists("u1"); reaped != tt.reaped {
+				t.Fatalf("reaped %v, want %v", reaped, tt.reaped)
+			}
+			if !tt.reaped {
+				c.expectNothing(t)
+			}
+		})
+	}
+}